@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// APIKeyHeader is the request header clients send their api key in
+const APIKeyHeader = "X-API-Key"
+
+// ErrInvalidAPIKey indicates an api key name or scope is not valid
+var ErrInvalidAPIKey = errors.New("api key is invalid")
+
+// ErrAPIKeyNotFound will be used when the specified api key is not found or has been revoked
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// Scope controls what an api key may do.  Each scope grants a role, see scopeRoles.
+type Scope string
+
+const (
+	// ScopeRead grants the viewer role
+	ScopeRead Scope = "read"
+	// ScopeWrite grants the editor role
+	ScopeWrite Scope = "write"
+	// ScopeAdmin grants the admin role
+	ScopeAdmin Scope = "admin"
+)
+
+// APIKey is a stored api key.  Only the sha256 hash of the key is kept, the key itself is
+// shown once when it is created or rotated.
+type APIKey struct {
+	// ID identifies the key in the management endpoints and is the part of the key before the dot
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Scope Scope  `json:"scope"`
+	// Hash is the hex encoded sha256 hash of the key.  It is never returned by the api.
+	Hash       string     `json:"hash,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreatedAPIKey is returned when a key is created or rotated and is the only time the key is shown
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// APIKeyStore validates api keys against the keys in a local key file and keeps the file up to
+// date as keys are created, rotated and revoked.  Last-used times are kept in memory and written
+// out with the next change, or by Flush.
+type APIKeyStore struct {
+	// path is the key file, a json array of APIKey
+	path string
+	keys map[string]*APIKey
+	// byHash maps key hashes to keys that have not been revoked
+	byHash map[string]*APIKey
+	// dirty is set when last-used times have changed since the file was written
+	dirty bool
+	mtx   *sync.Mutex
+	now   func() time.Time
+}
+
+// LoadAPIKeys reads the key file at path.  An empty path turns api key authentication off and
+// returns a nil store.  When the file is missing or holds no keys an admin key is created and
+// written once to out, not to the log, so the first real keys can be made with it.
+func LoadAPIKeys(path string, out io.Writer, logger *logrus.Logger) (*APIKeyStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	s := &APIKeyStore{
+		path:   path,
+		keys:   map[string]*APIKey{},
+		byHash: map[string]*APIKey{},
+		mtx:    &sync.Mutex{},
+		now:    time.Now,
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var keys []*APIKey
+	if len(dat) > 0 {
+		if err := json.Unmarshal(dat, &keys); err != nil {
+			return nil, fmt.Errorf("reading api key file %s: %w", path, err)
+		}
+	}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+		if k.RevokedAt == nil {
+			s.byHash[k.Hash] = k
+		}
+	}
+
+	if len(s.keys) == 0 {
+		created, err := s.Create("bootstrap", ScopeAdmin)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "created admin api key %s; store it safely, it will not be shown again\n", created.Key)
+		logger.Warnf("no api keys found in %s, created admin key %s and printed it to stdout", path, created.ID)
+	}
+	return s, nil
+}
+
+// hashAPIKey returns the hex encoded sha256 hash of an api key
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// newAPIKeySecret returns a random key for the key id
+func newAPIKeySecret(id string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return id + "." + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// Create makes a new key with the name and scope and writes it to the key file
+func (s *APIKeyStore) Create(name string, scope Scope) (*CreatedAPIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || scopeRoles[scope] == "" {
+		return nil, ErrInvalidAPIKey
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	key, err := newAPIKeySecret(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k := &APIKey{ID: id, Name: name, Scope: scope, Hash: hashAPIKey(key), CreatedAt: s.now().UTC()}
+	s.keys[id] = k
+	s.byHash[k.Hash] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, id)
+		delete(s.byHash, k.Hash)
+		return nil, err
+	}
+	return &CreatedAPIKey{APIKey: k.public(), Key: key}, nil
+}
+
+// Rotate replaces the key with the id with a new one, keeping its name and scope.  The old key
+// stops working straight away.
+// If the key is not found or has been revoked a ErrAPIKeyNotFound is returned
+func (s *APIKeyStore) Rotate(id string) (*CreatedAPIKey, error) {
+	key, err := newAPIKeySecret(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k := s.keys[id]
+	if k == nil || k.RevokedAt != nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	old := *k
+	delete(s.byHash, k.Hash)
+	k.Hash = hashAPIKey(key)
+	k.LastUsedAt = nil
+	s.byHash[k.Hash] = k
+	if err := s.save(); err != nil {
+		delete(s.byHash, k.Hash)
+		*k = old
+		s.byHash[k.Hash] = k
+		return nil, err
+	}
+	return &CreatedAPIKey{APIKey: k.public(), Key: key}, nil
+}
+
+// Revoke stops the key with the id from working.  Revoked keys stay in the key file, and are
+// listed, so it is clear when they were revoked.
+// If the key is not found or already revoked a ErrAPIKeyNotFound is returned
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k := s.keys[id]
+	if k == nil || k.RevokedAt != nil {
+		return ErrAPIKeyNotFound
+	}
+	now := s.now().UTC()
+	k.RevokedAt = &now
+	delete(s.byHash, k.Hash)
+	if err := s.save(); err != nil {
+		k.RevokedAt = nil
+		s.byHash[k.Hash] = k
+		return err
+	}
+	return nil
+}
+
+// List returns every key, revoked ones included, sorted by creation time
+func (s *APIKeyStore) List() []APIKey {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k.public())
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// authenticate returns the key matching the passed key and records that it was used, or nil
+// if the key is unknown or revoked
+func (s *APIKeyStore) authenticate(key string) *APIKey {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k := s.byHash[hashAPIKey(key)]
+	if k == nil {
+		return nil
+	}
+	now := s.now().UTC()
+	k.LastUsedAt = &now
+	s.dirty = true
+	public := k.public()
+	return &public
+}
+
+// Flush writes last-used times recorded since the key file was last written
+func (s *APIKeyStore) Flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes every key to the key file, replacing it in one step so a crash can't leave
+// it half written.  The caller must hold mtx.
+func (s *APIKeyStore) save() error {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	dat, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// public returns a copy of the key without its hash
+func (k *APIKey) public() APIKey {
+	public := *k
+	public.Hash = ""
+	return public
+}
+
+// CreateAPIKeyRequest is the payload accepted by CreateAPIKey
+type CreateAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope Scope  `json:"scope"`
+}
+
+// ListAPIKeys returns a json array of every api key, without the keys themselves
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, r, http.StatusOK, h.apiKeys.List())
+}
+
+// CreateAPIKey creates a key from a CreateAPIKeyRequest, e.g. {"name": "till 4", "scope": "write"},
+// and returns it with a 201.  The key is only ever shown in this response.
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	k, err := h.apiKeys.Create(req.Name, req.Scope)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	h.writeJSON(w, r, http.StatusCreated, k)
+}
+
+// RotateAPIKey replaces the key with the id in the path with a new one and returns it.  The old
+// key stops working straight away.
+func (h *Handler) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	k, err := h.apiKeys.Rotate(chi.URLParam(r, "id"))
+	h.writeItem(w, r, k, err)
+}
+
+// RevokeAPIKey stops the key with the id in the path from working and returns a 204
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := h.apiKeys.Revoke(chi.URLParam(r, "id")); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.WriteHeader(204)
+}
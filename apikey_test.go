@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	a := assert.New(t)
+	logger, hook := test.NewNullLogger()
+
+	s, err := LoadAPIKeys("", io.Discard, logger)
+	a.NoError(err)
+	a.Nil(s)
+
+	// a missing file gets a bootstrap admin key, printed once and kept out of the log
+	path := filepath.Join(t.TempDir(), "keys.json")
+	var out bytes.Buffer
+	s, err = LoadAPIKeys(path, &out, logger)
+	a.NoError(err)
+	keys := s.List()
+	a.Len(keys, 1)
+	a.Equal(ScopeAdmin, keys[0].Scope)
+	a.Empty(keys[0].Hash)
+	a.Contains(out.String(), keys[0].ID+".")
+	a.Contains(hook.LastEntry().Message, keys[0].ID)
+	a.NotContains(hook.LastEntry().Message, keys[0].ID+".")
+
+	// keys are stored hashed and survive a reload
+	created, err := s.Create("till", ScopeWrite)
+	a.NoError(err)
+	dat, err := os.ReadFile(path)
+	a.NoError(err)
+	a.NotContains(string(dat), created.Key)
+	a.Contains(string(dat), hashAPIKey(created.Key))
+
+	hook.Reset()
+	out.Reset()
+	s, err = LoadAPIKeys(path, &out, logger)
+	a.NoError(err)
+	a.Len(s.List(), 2)
+	a.Nil(hook.LastEntry())
+	a.Empty(out.String())
+	a.NotNil(s.authenticate(created.Key))
+
+	a.NoError(os.WriteFile(path, []byte(`{`), 0600))
+	_, err = LoadAPIKeys(path, io.Discard, logger)
+	a.Error(err)
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	a := assert.New(t)
+	logger, _ := test.NewNullLogger()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	s, err := LoadAPIKeys(path, io.Discard, logger)
+	a.NoError(err)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	_, err = s.Create("", ScopeRead)
+	a.ErrorIs(err, ErrInvalidAPIKey)
+	_, err = s.Create("till", "owner")
+	a.ErrorIs(err, ErrInvalidAPIKey)
+
+	created, err := s.Create("till", ScopeRead)
+	a.NoError(err)
+	a.Nil(s.authenticate("nope"))
+	k := s.authenticate(created.Key)
+	a.NotNil(k)
+	a.Equal(now, *k.LastUsedAt)
+
+	// last-used times are written out by Flush
+	a.NoError(s.Flush())
+	reloaded, err := LoadAPIKeys(path, io.Discard, logger)
+	a.NoError(err)
+	for _, rk := range reloaded.List() {
+		if rk.ID == created.ID {
+			a.Equal(now, *rk.LastUsedAt)
+		}
+	}
+
+	rotated, err := s.Rotate(created.ID)
+	a.NoError(err)
+	a.Equal(created.ID, rotated.ID)
+	a.NotEqual(created.Key, rotated.Key)
+	a.Nil(s.authenticate(created.Key))
+	a.NotNil(s.authenticate(rotated.Key))
+
+	a.NoError(s.Revoke(created.ID))
+	a.Nil(s.authenticate(rotated.Key))
+	a.ErrorIs(s.Revoke(created.ID), ErrAPIKeyNotFound)
+	_, err = s.Rotate(created.ID)
+	a.ErrorIs(err, ErrAPIKeyNotFound)
+	_, err = s.Rotate("missing")
+	a.ErrorIs(err, ErrAPIKeyNotFound)
+
+	var nilStore *APIKeyStore
+	a.NoError(nilStore.Flush())
+}
+
+func TestHandler_APIKeys(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	h.apiKeys, err = LoadAPIKeys(filepath.Join(t.TempDir(), "keys.json"), io.Discard, logger)
+	a.NoError(err)
+	admin, err := h.apiKeys.Create("admin", ScopeAdmin)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	do := func(method, path, key, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		a.NoError(err)
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		resp.Body.Close()
+		return resp, buf.String()
+	}
+
+	rr, body := do("POST", "/api/v1/keys", admin.Key, `{"name": "reader", "scope": "read"}`)
+	a.Equal(201, rr.StatusCode)
+	var reader CreatedAPIKey
+	a.NoError(json.Unmarshal([]byte(body), &reader))
+	a.NotEmpty(reader.Key)
+	rr, _ = do("POST", "/api/v1/keys", admin.Key, `{"name": "bad", "scope": "owner"}`)
+	a.Equal(400, rr.StatusCode)
+
+	item := `[{"produce_name": "Kiwi", "produce_code": "KIWI-0000-0000-0001", "produce_unit_price": 1}]`
+	tests := []struct {
+		method, path, key string
+		status            int
+	}{
+		{"GET", "/ping", "", 200},
+		{"GET", "/api/v1/produce", "", 401},
+		{"GET", "/api/v1/produce", "wrong", 401},
+		{"GET", "/api/v1/produce", reader.Key, 200},
+		{"POST", "/api/v1/produce", reader.Key, 403},
+		{"GET", "/api/v1/keys", reader.Key, 403},
+		{"POST", "/api/v1/produce", admin.Key, 200},
+		{"GET", "/api/v1/keys", admin.Key, 200},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.method == "POST" {
+			body = item
+		}
+		rr, _ = do(tt.method, tt.path, tt.key, body)
+		a.Equal(tt.status, rr.StatusCode, tt.method+" "+tt.path)
+	}
+
+	// listing never shows keys or hashes, and tracks when each key was last used
+	_, body = do("GET", "/api/v1/keys", admin.Key, "")
+	a.NotContains(body, reader.Key)
+	a.NotContains(body, `"hash"`)
+	var keys []APIKey
+	a.NoError(json.Unmarshal([]byte(body), &keys))
+	for _, k := range keys {
+		if k.ID == reader.ID {
+			a.NotNil(k.LastUsedAt)
+		}
+	}
+
+	rr, body = do("POST", "/api/v1/keys/"+reader.ID+"/rotate", admin.Key, "")
+	a.Equal(200, rr.StatusCode)
+	var rotated CreatedAPIKey
+	a.NoError(json.Unmarshal([]byte(body), &rotated))
+	rr, _ = do("GET", "/api/v1/produce", reader.Key, "")
+	a.Equal(401, rr.StatusCode)
+	rr, _ = do("GET", "/api/v1/produce", rotated.Key, "")
+	a.Equal(200, rr.StatusCode)
+
+	rr, _ = do("DELETE", "/api/v1/keys/"+reader.ID, admin.Key, "")
+	a.Equal(204, rr.StatusCode)
+	rr, _ = do("DELETE", "/api/v1/keys/"+reader.ID, admin.Key, "")
+	a.Equal(404, rr.StatusCode)
+	rr, _ = do("GET", "/api/v1/produce", rotated.Key, "")
+	a.Equal(401, rr.StatusCode)
+
+	// anonymous reads can be allowed, writes still need a key
+	h.updateSettings(func(s *liveSettings) { s.anonymousRead = true })
+	rr, _ = do("GET", "/api/v1/produce", "", "")
+	a.Equal(200, rr.StatusCode)
+	rr, _ = do("POST", "/api/v1/produce", "", item)
+	a.Equal(401, rr.StatusCode)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Role controls which routes a caller may use.  Each role includes the ones below it.
+type Role string
+
+const (
+	// RoleViewer may read the catalogue
+	RoleViewer Role = "viewer"
+	// RoleEditor may also add and change produce, categories, tags, suppliers and stores
+	RoleEditor Role = "editor"
+	// RoleAdmin may also delete them and manage api keys
+	RoleAdmin Role = "admin"
+)
+
+// roleRank orders the roles from least to most access.  Unknown roles rank 0 and grant nothing.
+var roleRank = map[Role]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// allows reports whether the role includes required
+func (r Role) allows(required Role) bool {
+	return roleRank[r] > 0 && roleRank[r] >= roleRank[required]
+}
+
+// authFailureLimit is how many failed authentications a client ip address may make, ten at once
+// then one a minute, before its requests with a credential get a 429 without being checked
+var authFailureLimit = RateLimit{Rate: 1.0 / 60, Burst: 10}
+
+// scopeRoles maps api key scopes to the role they grant
+var scopeRoles = map[Scope]Role{ScopeRead: RoleViewer, ScopeWrite: RoleEditor, ScopeAdmin: RoleAdmin}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	// Subject is the sub claim of a bearer token, the id of an api key, or the common name of a
+	// client certificate
+	Subject string
+	Role    Role
+	// Source is how the caller authenticated, jwt, apikey or mtls
+	Source string
+}
+
+// principalCtxKey is the context key the auth middleware stores the caller under
+type principalCtxKey struct{}
+
+// principalFromContext returns the caller of the request, or nil for anonymous requests
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalCtxKey{}).(*Principal)
+	return p
+}
+
+// principalID returns a string identifying the caller of the request, empty for anonymous requests
+func principalID(ctx context.Context) string {
+	if p := principalFromContext(ctx); p != nil {
+		return p.Source + ":" + p.Subject
+	}
+	return ""
+}
+
+// Problem is an RFC 7807 problem details response body
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// writeProblem writes an application/problem+json response with the status and detail
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail})
+}
+
+// authEnabled reports whether callers have to authenticate, which is when api keys, bearer
+// tokens or client certificates are configured
+func (h *Handler) authEnabled() bool {
+	return h.apiKeys != nil || h.jwt != nil || h.clientCerts != nil
+}
+
+// unauthorized writes a 401 problem, inviting a bearer token when they are accepted
+func (h *Handler) unauthorized(w http.ResponseWriter, detail string) {
+	if h.jwt != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="big-produce"`)
+	}
+	writeProblem(w, http.StatusUnauthorized, detail)
+}
+
+// authMW identifies the caller from an Authorization: Bearer token, an X-API-Key header or, when
+// neither is sent, the connection's client certificate and stores them on the request context.
+// A credential that can't be verified gets a 401, and a peer ip address that has sent too many of
+// those gets a 429 for any credential until it has waited, see authFailureLimit and peerIP.  Requests
+// without one carry on anonymously and requireRole decides whether they are allowed.
+func (h *Handler) authMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth, key := r.Header.Get("Authorization"), r.Header.Get(APIKeyHeader)
+		if (auth != "" || key != "") && h.authThrottled(w, r) {
+			return
+		}
+
+		var p *Principal
+		if auth != "" {
+			scheme, token, _ := strings.Cut(auth, " ")
+			if !strings.EqualFold(scheme, "bearer") || h.jwt == nil {
+				h.authFailed(w, r, "unsupported authorization scheme")
+				return
+			}
+			var err error
+			if p, err = h.jwt.Verify(strings.TrimSpace(token)); err != nil {
+				h.logger.Debugf("rejected bearer token: %s", err)
+				h.authFailed(w, r, err.Error())
+				return
+			}
+		} else if key != "" {
+			k := h.apiKeys.authenticate(key)
+			if k == nil {
+				h.authFailed(w, r, "invalid api key")
+				return
+			}
+			p = &Principal{Subject: k.ID, Role: scopeRoles[k.Scope], Source: "apikey"}
+		} else if h.clientCerts != nil {
+			// the tls handshake has already verified the certificate against the client CAs
+			p = h.clientCerts.principal(r.TLS)
+		}
+
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalCtxKey{}, p))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authThrottled writes a 429 and returns true when the peer ip address has used up its failed
+// authentications, see authFailureLimit
+func (h *Handler) authThrottled(w http.ResponseWriter, r *http.Request) bool {
+	empty, retryAfter := h.authFailures.empty(peerIP(r))
+	if empty {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeProblem(w, http.StatusTooManyRequests, "too many failed authentications, retry later")
+	}
+	return empty
+}
+
+// authFailed counts a failed authentication against the peer ip address and writes a 401
+func (h *Handler) authFailed(w http.ResponseWriter, r *http.Request, detail string) {
+	h.authFailures.allow(peerIP(r))
+	h.unauthorized(w, detail)
+}
+
+// requireRole rejects anonymous callers with a 401 and callers without the role with a 403.
+// Anonymous callers may use viewer routes when anonymous reads are allowed.  Every request is let
+// through when authentication is off.
+func (h *Handler) requireRole(role Role) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !h.authEnabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p := principalFromContext(r.Context())
+			switch {
+			case p == nil && !(h.settings().anonymousRead && role == RoleViewer):
+				h.unauthorized(w, "authentication required")
+			case p != nil && !p.Role.allows(role):
+				writeProblem(w, http.StatusForbidden, fmt.Sprintf("the %s role is required", role))
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRole_allows(t *testing.T) {
+	a := assert.New(t)
+	a.True(RoleAdmin.allows(RoleEditor))
+	a.True(RoleEditor.allows(RoleEditor))
+	a.False(RoleViewer.allows(RoleEditor))
+	a.False(Role("").allows(RoleViewer))
+	a.False(Role("owner").allows(RoleViewer))
+}
+
+func TestHandler_RoleBasedAccess(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	secret := []byte("sso-secret")
+	h.jwt, err = NewJWTVerifier(JWTConfig{HS256Secret: string(secret)})
+	a.NoError(err)
+	h.apiKeys, err = LoadAPIKeys(filepath.Join(t.TempDir(), "keys.json"), io.Discard, logger)
+	a.NoError(err)
+	writer, err := h.apiKeys.Create("till", ScopeWrite)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	token := func(role string) string {
+		claims := map[string]interface{}{"sub": role + "-user", "exp": time.Now().Add(time.Hour).Unix(), "roles": role}
+		return "Bearer " + signJWT(t, map[string]interface{}{"alg": "HS256"}, claims, secret)
+	}
+	do := func(method, path, auth, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		a.NoError(err)
+		switch {
+		case auth == writer.Key:
+			req.Header.Set(APIKeyHeader, auth)
+		case auth != "":
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		return resp
+	}
+
+	item := func(code string) string {
+		return `[{"produce_name": "Kiwi", "produce_code": "` + code + `", "produce_unit_price": 1}]`
+	}
+	tests := []struct {
+		name         string
+		method, path string
+		auth, body   string
+		status       int
+	}{
+		{"anonymous", "GET", "/api/v1/produce", "", "", 401},
+		{"bad token", "GET", "/api/v1/produce", "Bearer abc.def.ghi", "", 401},
+		{"basic auth", "GET", "/api/v1/produce", "Basic dXNlcjpwYXNz", "", 401},
+		{"no role", "GET", "/api/v1/produce", token("owner"), "", 403},
+		{"viewer reads", "GET", "/api/v1/produce", token("viewer"), "", 200},
+		{"viewer adds", "POST", "/api/v1/produce", token("viewer"), item("KIWI-0000-0000-0001"), 403},
+		{"editor adds", "POST", "/api/v1/produce", token("editor"), item("KIWI-0000-0000-0001"), 200},
+		{"editor deletes", "DELETE", "/api/v1/produce/KIWI-0000-0000-0001", token("editor"), "", 403},
+		{"admin deletes", "DELETE", "/api/v1/produce/KIWI-0000-0000-0001", token("admin"), "", 204},
+		{"editor bulk deletes", "POST", "/api/v1/produce/bulk-delete", token("editor"), `["A12T-4GH7-QPL9-3N4M"]`, 403},
+		{"editor category", "POST", "/api/v1/categories", token("editor"), `{"id": "fruit", "name": "Fruit"}`, 201},
+		{"editor deletes category", "DELETE", "/api/v1/categories/fruit", token("editor"), "", 403},
+		{"editor manages keys", "GET", "/api/v1/keys", token("editor"), "", 403},
+		{"admin manages keys", "GET", "/api/v1/keys", token("admin"), "", 200},
+		{"write key adds", "POST", "/api/v1/produce", writer.Key, item("KIWI-0000-0000-0002"), 200},
+		{"write key deletes", "DELETE", "/api/v1/produce/KIWI-0000-0000-0002", writer.Key, "", 403},
+	}
+	for _, tt := range tests {
+		resp := do(tt.method, tt.path, tt.auth, tt.body)
+		resp.Body.Close()
+		a.Equal(tt.status, resp.StatusCode, tt.name)
+	}
+
+	// rejections are problem details, and 401s invite a bearer token
+	resp := do("POST", "/api/v1/produce", "", item("KIWI-0000-0000-0004"))
+	defer resp.Body.Close()
+	a.Equal("application/problem+json", resp.Header.Get("Content-Type"))
+	a.Contains(resp.Header.Get("WWW-Authenticate"), "Bearer")
+	var p Problem
+	a.NoError(json.NewDecoder(resp.Body).Decode(&p))
+	a.Equal(Problem{Type: "about:blank", Title: "Unauthorized", Status: 401, Detail: "authentication required"}, p)
+
+	resp = do("DELETE", "/api/v1/produce/A12T-4GH7-QPL9-3N4M", token("viewer"), "")
+	defer resp.Body.Close()
+	a.NoError(json.NewDecoder(resp.Body).Decode(&p))
+	a.Equal(403, p.Status)
+	a.Equal("the admin role is required", p.Detail)
+}
+
+func TestHandler_AuthFailureLimit(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	var err error
+	h.apiKeys, err = LoadAPIKeys(filepath.Join(t.TempDir(), "keys.json"), io.Discard, logger)
+	a.NoError(err)
+	reader, err := h.apiKeys.Create("till", ScopeRead)
+	a.NoError(err)
+	now := time.Now()
+	h.authFailures.now = func() time.Time { return now }
+	router := LoadRouter(h)
+
+	// get sends the request from the peer address with a different forwarded address each time,
+	// which must not let a client escape the limit
+	forwarded := 0
+	get := func(key, peerIP string) *http.Response {
+		req := httptest.NewRequest("GET", "/api/v1/produce", nil)
+		req.RemoteAddr = peerIP + ":40000"
+		req.Header.Set(APIKeyHeader, key)
+		forwarded++
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.168.0.%d", forwarded))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	for i := 0; i < authFailureLimit.Burst; i++ {
+		a.Equal(401, get("guess", "10.0.0.1").StatusCode)
+	}
+	// once the failures are used up even the right key isn't checked, other clients are unaffected
+	rr := get(reader.Key, "10.0.0.1")
+	a.Equal(429, rr.StatusCode)
+	a.Equal("60", rr.Header.Get("Retry-After"))
+	a.Equal(200, get(reader.Key, "10.0.0.2").StatusCode)
+
+	now = now.Add(time.Minute)
+	a.Equal(200, get(reader.Key, "10.0.0.1").StatusCode)
+	a.Equal(401, get("guess", "10.0.0.1").StatusCode)
+	a.Equal(429, get("guess", "10.0.0.1").StatusCode)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPLU indicates the PLU is not a valid IFPS price look-up number
+var ErrInvalidPLU = errors.New("item plu is invalid")
+
+// ErrInvalidGTIN indicates the GTIN is not 8, 12, 13 or 14 digits or its check digit doesn't match
+var ErrInvalidGTIN = errors.New("item gtin is invalid")
+
+// ErrDuplicatePLU will be used when an item is trying to be added with a PLU already used by another item
+var ErrDuplicatePLU = errors.New("item plu already exists")
+
+// ErrDuplicateGTIN will be used when an item is trying to be added with a GTIN already used by another item
+var ErrDuplicateGTIN = errors.New("item gtin already exists")
+
+// ParsePLU validates an IFPS price look-up number.  Conventional PLUs are four digits in the
+// 3000-4999 range.  A five digit PLU is a conventional PLU prefixed with a 9 for organic
+// produce, or an 8 for the retired genetically modified prefix.
+// PLUs have no check digit so the range is all that can be verified.
+func ParsePLU(s string) (string, error) {
+	if !isDigits(s) {
+		return "", ErrInvalidPLU
+	}
+	base := s
+	switch len(s) {
+	case 4:
+	case 5:
+		if s[0] != '9' && s[0] != '8' {
+			return "", ErrInvalidPLU
+		}
+		base = s[1:]
+	default:
+		return "", ErrInvalidPLU
+	}
+	if n, _ := strconv.Atoi(base); n < 3000 || n > 4999 {
+		return "", ErrInvalidPLU
+	}
+	return s, nil
+}
+
+// ParseGTIN validates a GTIN-8, UPC-A (GTIN-12), EAN-13 (GTIN-13) or GTIN-14 barcode number and
+// returns it as a fourteen digit GTIN padded with leading zeros.  Padding means the UPC-A and
+// EAN-13 forms of the same barcode resolve to the same item.
+func ParseGTIN(s string) (string, error) {
+	if !isDigits(s) {
+		return "", ErrInvalidGTIN
+	}
+	switch len(s) {
+	case 8, 12, 13, 14:
+	default:
+		return "", ErrInvalidGTIN
+	}
+
+	gtin := strings.Repeat("0", 14-len(s)) + s
+	if gtinCheckDigit(gtin[:13]) != gtin[13] {
+		return "", ErrInvalidGTIN
+	}
+	return gtin, nil
+}
+
+// gtinCheckDigit computes the GS1 mod 10 check digit for the payload digits.  Working from the
+// right, digits are weighted 3, 1, 3, 1...
+func gtinCheckDigit(payload string) byte {
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		d := int(payload[i] - '0')
+		if (len(payload)-1-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// isDigits reports whether s is non-empty and made only of ascii digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePLU(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{in: "4011", want: "4011"},
+		{in: "3000", want: "3000"},
+		{in: "4999", want: "4999"},
+		{in: "94011", want: "94011"},
+		{in: "84011", want: "84011"},
+		{in: "2999", wantErr: ErrInvalidPLU},
+		{in: "5000", wantErr: ErrInvalidPLU},
+		{in: "74011", wantErr: ErrInvalidPLU},
+		{in: "92999", wantErr: ErrInvalidPLU},
+		{in: "401", wantErr: ErrInvalidPLU},
+		{in: "4011a", wantErr: ErrInvalidPLU},
+		{in: "+401", wantErr: ErrInvalidPLU},
+		{in: "", wantErr: ErrInvalidPLU},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePLU(tt.in)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("ParsePLU() = %v, %v want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseGTIN(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{in: "96385074", want: "00000096385074"},
+		{in: "036000291452", want: "00036000291452"},
+		{in: "0036000291452", want: "00036000291452"},
+		{in: "4006381333931", want: "04006381333931"},
+		{in: "14006381333938", want: "14006381333938"},
+		{in: "036000291453", wantErr: ErrInvalidGTIN},
+		{in: "4006381333932", wantErr: ErrInvalidGTIN},
+		{in: "0360002914", wantErr: ErrInvalidGTIN},
+		{in: "03600029145x", wantErr: ErrInvalidGTIN},
+		{in: "", wantErr: ErrInvalidGTIN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseGTIN(tt.in)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("ParseGTIN() = %v, %v want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDB_identifierIndexes(t *testing.T) {
+	a := assert.New(t)
+	db := NewDB(logrus.New())
+
+	banana := &ProduceItem{Name: "Banana", Code: "BANA-NANA-0000-0001", UnitPrice: 0.25, PLU: "4011", GTIN: "036000291452"}
+	a.NoError(db.Add(banana))
+	a.Equal("00036000291452", banana.GTIN)
+
+	// identifiers belong to one item only
+	a.Equal(ErrDuplicatePLU, db.Add(&ProduceItem{Name: "Plantain", Code: "PLAN-TAIN-0000-0001", UnitPrice: 0.5, PLU: "4011"}))
+	a.Equal(ErrDuplicateGTIN, db.Add(&ProduceItem{Name: "Plantain", Code: "PLAN-TAIN-0000-0001", UnitPrice: 0.5, GTIN: "0036000291452"}))
+	a.Equal(ErrDuplicatePLU, db.Validate(&ProduceItem{Name: "Plantain", Code: "PLAN-TAIN-0000-0001", UnitPrice: 0.5, PLU: "4011"}))
+	a.Equal(ErrInvalidPLU, db.Add(&ProduceItem{Name: "Plantain", Code: "PLAN-TAIN-0000-0001", UnitPrice: 0.5, PLU: "11"}))
+
+	// either barcode form finds the item
+	p, err := db.GetByGTIN("0036000291452")
+	a.NoError(err)
+	a.Equal(banana.Code, p.Code)
+	p, err = db.GetByPLU("4011")
+	a.NoError(err)
+	a.Equal(banana.Code, p.Code)
+
+	// updating the item moves its PLU
+	outcome, err := db.Upsert(&ProduceItem{Name: "Banana", Code: "BANA-NANA-0000-0001", UnitPrice: 0.25, PLU: "94011", GTIN: "036000291452"})
+	a.NoError(err)
+	a.Equal(UpsertUpdated, outcome)
+	_, err = db.GetByPLU("4011")
+	a.Equal(ErrNotFound, err)
+	_, err = db.GetByPLU("94011")
+	a.NoError(err)
+
+	// deleting the item frees its identifiers
+	a.NoError(db.Delete(banana.Code))
+	_, err = db.GetByGTIN("036000291452")
+	a.Equal(ErrNotFound, err)
+	a.NoError(db.Add(&ProduceItem{Name: "Plantain", Code: "PLAN-TAIN-0000-0001", UnitPrice: 0.5, PLU: "94011", GTIN: "036000291452"}))
+
+	_, err = db.GetByGTIN("036000291453")
+	a.Equal(ErrInvalidGTIN, err)
+}
+
+func TestHandler_LookupProduce(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	ts := httptest.NewServer(LoadRouter(NewHandler(NewDB(logger), runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	payload := `[{"produce_name":"Banana","produce_code":"BANA-NANA-0000-0001","produce_unit_price":0.25,"plu":"4011","gtin":"036000291452"}]`
+	rr, body := testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(payload))
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, `"status":"201: added"`)
+
+	payload = `[{"produce_name":"Plantain","produce_code":"PLAN-TAIN-0000-0001","produce_unit_price":0.50,"plu":"4011"},
+		{"produce_name":"Apple","produce_code":"APPL-E000-0000-0001","produce_unit_price":0.50,"gtin":"036000291453"}]`
+	rr, body = testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(payload))
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, `"status":"409: item plu already exists"`)
+	a.Contains(body, `"status":"400: item gtin is invalid"`)
+
+	rr, body = testRequest(t, ts, "GET", "/api/v1/produce/lookup?plu=4011", nil)
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, `"produce_code":"BANA-NANA-0000-0001"`)
+
+	rr, body = testRequest(t, ts, "GET", "/api/v1/produce/lookup?gtin=0036000291452", nil)
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, `"gtin":"00036000291452"`)
+
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce/lookup?plu=4012", nil)
+	a.Equal(404, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce/lookup?plu=12", nil)
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce/lookup", nil)
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce/lookup?plu=4011&gtin=036000291452", nil)
+	a.Equal(400, rr.StatusCode)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// BulkDeleteRequest is the payload accepted by BulkDeleteProduce.  Exactly one of Codes or
+// Filter must be provided.
+type BulkDeleteRequest struct {
+	// Codes is the list of produce codes to delete
+	Codes []string `json:"codes,omitempty"`
+	// Filter selects the produce items to delete
+	Filter *ProduceFilter `json:"filter,omitempty"`
+	// Atomic requires every code to exist.  If any code is not found nothing is deleted.
+	Atomic bool `json:"atomic,omitempty"`
+}
+
+// DeleteResult is used to track the status of deleting a single produce code
+type DeleteResult struct {
+	// Index is the zero-based position of the code in the request, or in the filter matches
+	Index int `json:"index"`
+	// Code is the produce code to be deleted.  Valid codes are shown in their canonical form.
+	Code ProduceCode `json:"produce_code"`
+	// StatusCode is a http status code indicating the status of deleting the item
+	StatusCode int `json:"status_code"`
+	// Status is a string representation of the status of deleting the item.  It contains
+	// a string value of the status code and a string description
+	Status string `json:"status"`
+}
+
+// DeleteResults is used to track the status of deleting multiple items in one handler call
+type DeleteResults struct {
+	// Results contains all results for deleting multiple produce items from the db.
+	Results []DeleteResult `json:"results"`
+}
+
+// BulkDeleteProduce removes many produce items from the database in one call.  It accepts a
+// BulkDeleteRequest with either a list of codes or a filter.  Each code gets its own result with
+// a 204 if it was deleted or a 404 if it was not found, in the same order as the request.
+// Codes are deleted concurrently utilizing the maxProcs variable, just like AddProduce.
+// Invalid codes get a 400.  When atomic is set either every code is deleted or none are; if any
+// code is invalid or missing it gets a 400 or 404 and every other code gets a 424 to show it was not deleted.
+func (h *Handler) BulkDeleteProduce(w http.ResponseWriter, r *http.Request) {
+
+	var req BulkDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+
+	var codes []string
+	switch {
+	case req.Filter != nil && len(req.Codes) > 0:
+		http.Error(w, "provide either codes or a filter, not both", http.StatusBadRequest)
+		return
+	case req.Filter != nil:
+		if req.Filter.IsEmpty() {
+			http.Error(w, "filter must have at least one criteria", http.StatusBadRequest)
+			return
+		}
+		for _, p := range h.db(r).Find(*req.Filter) {
+			codes = append(codes, p.Code.String())
+		}
+	case len(req.Codes) == 0:
+		http.Error(w, "provide either codes or a filter", http.StatusBadRequest)
+		return
+	default:
+		codes = req.Codes
+	}
+
+	// invalid codes are rejected up front and skipped by the rest of the pipeline
+	rs := DeleteResults{Results: make([]DeleteResult, len(codes))}
+	for i, c := range codes {
+		rs.Results[i] = DeleteResult{Index: i, Code: ProduceCode(c)}
+		if code, err := ParseProduceCode(c); err != nil {
+			rs.Results[i].StatusCode = http.StatusBadRequest
+			rs.Results[i].Status = fmt.Sprintf("%d: %s", http.StatusBadRequest, err.Error())
+		} else {
+			rs.Results[i].Code = code
+		}
+	}
+
+	if req.Atomic {
+		h.deleteAll(h.db(r), rs.Results)
+	} else {
+		rs.Results = h.runDeletePipeline(h.db(r), rs.Results)
+		sort.Slice(rs.Results, func(i, j int) bool { return rs.Results[i].Index < rs.Results[j].Index })
+	}
+	if rs.Results == nil {
+		rs.Results = []DeleteResult{}
+	}
+
+	d, err := json.Marshal(rs)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, "error generating json data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	w.Write(d)
+}
+
+// deleteAll deletes every code in a single DB.DeleteAll call and fills in the results.
+// Nothing is deleted if any of the codes were rejected as invalid.
+func (h *Handler) deleteAll(db *DB, results []DeleteResult) {
+
+	var codes []ProduceCode
+	failed := false
+	for _, res := range results {
+		if res.StatusCode != 0 {
+			failed = true
+			continue
+		}
+		codes = append(codes, res.Code)
+	}
+
+	var missing []ProduceCode
+	var err error
+	if !failed {
+		missing, err = db.DeleteAll(codes)
+		failed = err != nil
+	}
+
+	notFound := map[ProduceCode]bool{}
+	for _, c := range missing {
+		notFound[c] = true
+	}
+
+	for i := range results {
+		res := &results[i]
+		switch {
+		case res.StatusCode != 0:
+		case !failed:
+			res.StatusCode = http.StatusNoContent
+			res.Status = "204: deleted"
+		case notFound[res.Code]:
+			res.StatusCode = http.StatusNotFound
+			res.Status = fmt.Sprintf("%d: %s", http.StatusNotFound, ErrNotFound.Error())
+		default:
+			res.StatusCode = http.StatusFailedDependency
+			res.Status = "424: not deleted, atomic batch failed"
+		}
+	}
+}
+
+// runDeletePipeline deletes the codes using maxProcs concurrent workers.  Results that already
+// have a StatusCode are passed through untouched.  The results are in completion order, not request order.
+func (h *Handler) runDeletePipeline(db *DB, pending []DeleteResult) []DeleteResult {
+
+	done := make(chan interface{})
+	defer close(done)
+
+	// generator - puts each result on a channel
+	codeStream := make(chan DeleteResult)
+	go func() {
+		defer close(codeStream)
+		for _, res := range pending {
+			select {
+			case <-done:
+				return
+			case codeStream <- res:
+			}
+		}
+	}()
+
+	// delete - removes the code from the database
+	deleteStage := func(incomingStream <-chan DeleteResult) <-chan DeleteResult {
+		deletedStream := make(chan DeleteResult)
+		go func() {
+			defer close(deletedStream)
+			for i := range incomingStream {
+				if i.StatusCode == 0 {
+					if err := db.Delete(i.Code); err != nil {
+						i.StatusCode = statusForError(err)
+						i.Status = fmt.Sprintf("%d: %s", i.StatusCode, err.Error())
+					} else {
+						i.StatusCode = http.StatusNoContent
+						i.Status = "204: deleted"
+					}
+				}
+				select {
+				case <-done:
+					return
+				case deletedStream <- i:
+				}
+			}
+		}()
+		return deletedStream
+	}
+
+	workers := make([]<-chan DeleteResult, h.maxProcs)
+	for i := 0; i < h.maxProcs; i++ {
+		workers[i] = deleteStage(codeStream)
+	}
+
+	var results []DeleteResult
+	for x := range fanIn(done, workers...) {
+		results = append(results, x)
+	}
+	return results
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_BulkDeleteProduce(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	bulkDelete := func(payload string) (int, []DeleteResult) {
+		rr, body := testRequest(t, ts, "POST", "/api/v1/produce/bulk-delete", bytes.NewBufferString(payload))
+		var dr DeleteResults
+		json.Unmarshal([]byte(body), &dr)
+		return rr.StatusCode, dr.Results
+	}
+	statuses := func(results []DeleteResult) []int {
+		var s []int
+		for _, r := range results {
+			s = append(s, r.StatusCode)
+		}
+		return s
+	}
+
+	// atomic delete with a missing code deletes nothing
+	code, results := bulkDelete(`{"codes":["A12T-4GH7-QPL9-3N4M","FFFF-FFFF-FFFF-FFFF"],"atomic":true}`)
+	a.Equal(200, code)
+	a.Equal([]int{424, 404}, statuses(results))
+	a.Len(db.List(), 4)
+
+	// non-atomic delete removes what it can
+	code, results = bulkDelete(`{"codes":["A12T-4GH7-QPL9-3N4M","FFFF-FFFF-FFFF-FFFF","e5t6-9ui3-th15-qr88"]}`)
+	a.Equal(200, code)
+	a.Equal([]int{204, 404, 204}, statuses(results))
+	a.Equal(ProduceCode("E5T6-9UI3-TH15-QR88"), results[2].Code)
+	a.Len(db.List(), 2)
+
+	// filter by price range
+	code, results = bulkDelete(`{"filter":{"min_price":3.00,"max_price":4.00},"atomic":true}`)
+	a.Equal(200, code)
+	a.Len(results, 1)
+	a.Equal(ProduceCode("TQ4C-VV6T-75ZX-1RMR"), results[0].Code)
+	a.Equal(204, results[0].StatusCode)
+
+	// filter by name
+	code, results = bulkDelete(`{"filter":{"name":"PEPPER"}}`)
+	a.Equal(200, code)
+	a.Equal([]int{204}, statuses(results))
+	a.Empty(db.List())
+
+	// nothing left to match
+	code, results = bulkDelete(`{"filter":{"name":"pepper"}}`)
+	a.Equal(200, code)
+	a.Empty(results)
+
+	// bad requests
+	for _, payload := range []string{`{}`, `{"filter":{}}`, `{"codes":["A12T-4GH7-QPL9-3N4M"],"filter":{"name":"x"}}`, `[`} {
+		code, _ = bulkDelete(payload)
+		a.Equal(400, code, payload)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ErrInvalidCategory indicates a category id, name or parent is not valid, or an item references a
+// category that does not exist
+var ErrInvalidCategory = errors.New("category is invalid")
+
+// ErrCategoryNotFound will be used when the specified category is not found
+var ErrCategoryNotFound = errors.New("category not found")
+
+// ErrDuplicateCategory will be used when a category is trying to be added with an id that already exists
+var ErrDuplicateCategory = errors.New("category already exists")
+
+// ErrCategoryInUse will be used when deleting a category that still has subcategories or items
+// assigned to it without cascading the delete
+var ErrCategoryInUse = errors.New("category has subcategories or items")
+
+// Category groups produce items, e.g. citrus or leafy-greens.  Categories form a hierarchy through
+// ParentID and an item in a category is also in every category above it.
+type Category struct {
+	// ID is the lower case slug that identifies the category, e.g. leafy-greens
+	ID string `json:"id"`
+	// Name is the display name, checked against the same policy as produce names
+	Name string `json:"name"`
+	// ParentID is the id of the category this one sits under, empty for a top level category
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+// validateCategory checks the id, name and parent id of the category and stores them normalized
+func (d *DB) validateCategory(c *Category) error {
+	var err error
+	if c.ID, err = parseSlug(c.ID, ErrInvalidCategory); err != nil {
+		return err
+	}
+	if c.Name, err = d.ParseName(c.Name); err != nil {
+		return err
+	}
+	if c.ParentID != "" {
+		if c.ParentID, err = parseSlug(c.ParentID, ErrInvalidCategory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddCategory creates a new category.  The parent, if set, must already exist.
+// If a category exists with the same id a ErrDuplicateCategory is returned
+func (d *DB) AddCategory(c *Category) error {
+
+	if err := d.validateCategory(c); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.taxonomy.categories[c.ID] != nil {
+		return ErrDuplicateCategory
+	}
+	if c.ParentID != "" && d.taxonomy.categories[c.ParentID] == nil {
+		return ErrInvalidCategory
+	}
+	stored := *c
+	d.taxonomy.categories[c.ID] = &stored
+	return nil
+}
+
+// UpdateCategory renames the category with the same id and moves it to a new parent.  A category
+// can't be moved below itself.
+// If the category is not found a ErrCategoryNotFound is returned
+func (d *DB) UpdateCategory(c *Category) error {
+
+	if err := d.validateCategory(c); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.taxonomy.categories[c.ID] == nil {
+		return ErrCategoryNotFound
+	}
+	if c.ParentID != "" {
+		if d.taxonomy.categories[c.ParentID] == nil || d.taxonomy.subtree(c.ID)[c.ParentID] {
+			return ErrInvalidCategory
+		}
+	}
+	stored := *c
+	d.taxonomy.categories[c.ID] = &stored
+	return nil
+}
+
+// GetCategory returns the category with the passed id
+// If the category is not found a ErrCategoryNotFound is returned
+func (d *DB) GetCategory(id string) (*Category, error) {
+	id, err := parseSlug(id, ErrCategoryNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	c := d.taxonomy.categories[id]
+	if c == nil {
+		return nil, ErrCategoryNotFound
+	}
+	stored := *c
+	return &stored, nil
+}
+
+// ListCategories returns every category sorted by id
+func (d *DB) ListCategories() []*Category {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	cs := make([]*Category, 0, len(d.taxonomy.categories))
+	for _, c := range d.taxonomy.categories {
+		stored := *c
+		cs = append(cs, &stored)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID < cs[j].ID })
+	return cs
+}
+
+// DeleteCategory removes the category with the passed id.  By default a category with subcategories
+// or items assigned to it is not removed and a ErrCategoryInUse is returned.  When cascade is set the
+// category and every category below it are removed, and the items are taken out of them.  Items
+// themselves are never deleted.
+// If the category is not found a ErrCategoryNotFound is returned
+func (d *DB) DeleteCategory(id string, cascade bool) error {
+	id, err := parseSlug(id, ErrCategoryNotFound)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.taxonomy.categories[id] == nil {
+		return ErrCategoryNotFound
+	}
+
+	subtree := d.taxonomy.subtree(id)
+	if !cascade {
+		if len(subtree) > 1 || len(d.taxonomy.categoryItems[id]) > 0 {
+			return ErrCategoryInUse
+		}
+		delete(d.taxonomy.categories, id)
+		return nil
+	}
+
+	codes := map[ProduceCode]bool{}
+	for c := range subtree {
+		for code := range d.taxonomy.categoryItems[c] {
+			codes[code] = true
+		}
+	}
+	d.unassign(codes, func(p *ProduceItem) { p.Categories = without(p.Categories, subtree) })
+	for c := range subtree {
+		delete(d.taxonomy.categories, c)
+	}
+	return nil
+}
+
+// ListCategories returns a json array of every category, sorted by id
+func (h *Handler) ListCategories(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, r, http.StatusOK, h.db(r).ListCategories())
+}
+
+// GetCategory returns the category with the id in the path, or a 404 if it is not found
+func (h *Handler) GetCategory(w http.ResponseWriter, r *http.Request) {
+	c, err := h.db(r).GetCategory(chi.URLParam(r, "id"))
+	h.writeItem(w, r, c, err)
+}
+
+// AddCategory creates the category in the json body, e.g. {"id": "citrus", "name": "Citrus",
+// "parent_id": "fruit"}, and returns it with a 201.  A category with the same id gets a 409 and an
+// invalid category or unknown parent a 400.
+func (h *Handler) AddCategory(w http.ResponseWriter, r *http.Request) {
+	var c Category
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db(r).AddCategory(&c); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	h.writeJSON(w, r, http.StatusCreated, c)
+}
+
+// UpdateCategory replaces the name and parent of the category with the id in the path with those in
+// the json body.  Moving a category below itself or to an unknown parent gets a 400.
+func (h *Handler) UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	var c Category
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ID = chi.URLParam(r, "id")
+	err := h.db(r).UpdateCategory(&c)
+	h.writeItem(w, r, c, err)
+}
+
+// DeleteCategory removes the category with the id in the path and returns a 204.  A category with
+// subcategories or items gets a 409 unless ?cascade=true is passed, see DB.DeleteCategory.
+func (h *Handler) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	cascade, err := queryBool(r, "cascade")
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db(r).DeleteCategory(chi.URLParam(r, "id"), cascade); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Categories(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	a.NoError(db.AddCategory(&Category{ID: "Fruit", Name: "Fruit"}))
+	a.NoError(db.AddCategory(&Category{ID: "stone-fruit", Name: "Stone  Fruit", ParentID: "fruit"}))
+	a.ErrorIs(db.AddCategory(&Category{ID: "fruit", Name: "Fruit"}), ErrDuplicateCategory)
+	a.ErrorIs(db.AddCategory(&Category{ID: "citrus", Name: "Citrus", ParentID: "nope"}), ErrInvalidCategory)
+	a.ErrorIs(db.AddCategory(&Category{ID: "leafy greens", Name: "Leafy Greens"}), ErrInvalidCategory)
+	a.ErrorIs(db.AddCategory(&Category{ID: "leafy-greens", Name: ""}), ErrInvalidName)
+
+	c, err := db.GetCategory("STONE-FRUIT")
+	a.NoError(err)
+	a.Equal(&Category{ID: "stone-fruit", Name: "Stone Fruit", ParentID: "fruit"}, c)
+	_, err = db.GetCategory("citrus")
+	a.ErrorIs(err, ErrCategoryNotFound)
+
+	a.Equal([]string{"fruit", "stone-fruit"}, categoryIDs(db.ListCategories()))
+
+	// a category can't be moved below itself
+	a.ErrorIs(db.UpdateCategory(&Category{ID: "fruit", Name: "Fruit", ParentID: "stone-fruit"}), ErrInvalidCategory)
+	a.ErrorIs(db.UpdateCategory(&Category{ID: "fruit", Name: "Fruit", ParentID: "fruit"}), ErrInvalidCategory)
+	a.ErrorIs(db.UpdateCategory(&Category{ID: "citrus", Name: "Citrus"}), ErrCategoryNotFound)
+	a.NoError(db.UpdateCategory(&Category{ID: "stone-fruit", Name: "Drupes", ParentID: "fruit"}))
+	c, _ = db.GetCategory("stone-fruit")
+	a.Equal("Drupes", c.Name)
+
+	// deletes are restricted while the category has subcategories or items
+	_, err = db.SetCategories("E5T6-9UI3-TH15-QR88", []string{"stone-fruit"})
+	a.NoError(err)
+	a.ErrorIs(db.DeleteCategory("fruit", false), ErrCategoryInUse)
+	a.ErrorIs(db.DeleteCategory("stone-fruit", false), ErrCategoryInUse)
+	a.ErrorIs(db.DeleteCategory("citrus", false), ErrCategoryNotFound)
+
+	// cascading removes the subtree and takes the items out of it, leaving the items in place
+	a.NoError(db.DeleteCategory("fruit", true))
+	a.Empty(db.ListCategories())
+	p, err := db.Get("E5T6-9UI3-TH15-QR88")
+	a.NoError(err)
+	a.Nil(p.Categories)
+
+	a.NoError(db.AddCategory(&Category{ID: "citrus", Name: "Citrus"}))
+	a.NoError(db.DeleteCategory("citrus", false))
+}
+
+func categoryIDs(cs []*Category) []string {
+	ids := make([]string, len(cs))
+	for i, c := range cs {
+		ids[i] = c.ID
+	}
+	return ids
+}
+
+func TestHandler_Categories(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "POST", "/api/v1/categories", bytes.NewBufferString(`{"id": "fruit", "name": "Fruit"}`))
+	a.Equal(201, rr.StatusCode)
+	a.JSONEq(`{"id": "fruit", "name": "Fruit"}`, body)
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/categories", bytes.NewBufferString(`{"id": "fruit", "name": "Fruit"}`))
+	a.Equal(409, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/categories", bytes.NewBufferString(`{"id": "citrus", "name": "Citrus", "parent_id": "veg"}`))
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/categories", bytes.NewBufferString(`{"id": "citrus", "name": "Citrus", "parent_id": "fruit"}`))
+	a.Equal(201, rr.StatusCode)
+
+	rr, body = testRequest(t, ts, "GET", "/api/v1/categories", nil)
+	a.Equal(200, rr.StatusCode)
+	var cs []*Category
+	a.NoError(json.Unmarshal([]byte(body), &cs))
+	a.Equal([]string{"citrus", "fruit"}, categoryIDs(cs))
+
+	rr, body = testRequest(t, ts, "PUT", "/api/v1/categories/citrus", bytes.NewBufferString(`{"name": "Citrus Fruit", "parent_id": "fruit"}`))
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"id": "citrus", "name": "Citrus Fruit", "parent_id": "fruit"}`, body)
+	rr, body = testRequest(t, ts, "GET", "/api/v1/categories/citrus", nil)
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"id": "citrus", "name": "Citrus Fruit", "parent_id": "fruit"}`, body)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/categories/veg", nil)
+	a.Equal(404, rr.StatusCode)
+
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/categories/fruit", nil)
+	a.Equal(409, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/categories/fruit?cascade=x", nil)
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/categories/fruit?cascade=true", nil)
+	a.Equal(204, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/categories/citrus", nil)
+	a.Equal(404, rr.StatusCode)
+}
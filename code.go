@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// ProduceCode is a produce code in its canonical form: four groups of four alphanumeric
+// characters separated by hyphens, in upper case, with an optional check character as a fifth
+// character of the last group.  e.g. A12T-4GH7-QPL9-3N4M or A12T-4GH7-QPL9-3N4MX
+// Use ParseProduceCode to build a ProduceCode from client input.
+type ProduceCode string
+
+// produceCodeRegex matches exactly one produce code and nothing else.  It is checked against the
+// code before it is upper cased so non-ascii letters can't sneak in through case mapping.
+var produceCodeRegex = regexp.MustCompile(`^[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4,5}$`)
+
+// ParseProduceCode validates s and returns the canonical, upper case, ProduceCode.
+// ErrInvalidCode is returned when s is not exactly in the xxxx-xxxx-xxxx-xxxx format, with an
+// optional check character after the last group, and ErrInvalidCheckChar when the check character
+// doesn't match.
+func ParseProduceCode(s string) (ProduceCode, error) {
+	if !produceCodeRegex.MatchString(s) {
+		return "", ErrInvalidCode
+	}
+	code := ProduceCode(strings.ToUpper(s))
+	if code.HasCheckChar() && !code.HasValidCheckChar() {
+		return "", ErrInvalidCheckChar
+	}
+	return code, nil
+}
+
+// String returns the code as a string
+func (c ProduceCode) String() string {
+	return string(c)
+}
+
+// produceCodeCtxKey is the context key produceCodeMW stores the parsed path code under
+type produceCodeCtxKey struct{}
+
+// withProduceCode returns a copy of ctx holding the produce code
+func withProduceCode(ctx context.Context, c ProduceCode) context.Context {
+	return context.WithValue(ctx, produceCodeCtxKey{}, c)
+}
+
+// produceCodeFromContext returns the produce code stored by produceCodeMW, or an empty code
+func produceCodeFromContext(ctx context.Context) ProduceCode {
+	c, _ := ctx.Value(produceCodeCtxKey{}).(ProduceCode)
+	return c
+}
+
+// ErrInvalidCheckChar indicates a produce code's check character is missing when required, or
+// doesn't match the check character computed from the rest of the code.  It wraps ErrInvalidCode.
+var ErrInvalidCheckChar = fmt.Errorf("%w: check character does not match", ErrInvalidCode)
+
+// codeAlphabet is the set of characters a canonical produce code is made from.  The position of a
+// character in the alphabet is its value when computing check characters.
+const codeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// checkChar computes the Luhn mod 36 check character for the payload characters of a code.
+// Every single character typo and most adjacent transpositions change the check character.
+func checkChar(payload string) byte {
+	n := len(codeAlphabet)
+	factor := 2
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(codeAlphabet, payload[i])
+		sum += addend/n + addend%n
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+	}
+	return codeAlphabet[(n-sum%n)%n]
+}
+
+// HasCheckChar reports whether the code has a check character, a fifth character in its last group
+func (c ProduceCode) HasCheckChar() bool {
+	return len(strings.ReplaceAll(string(c), "-", "")) == 17
+}
+
+// HasValidCheckChar reports whether the code has a check character and it matches the sixteen
+// characters before it.  The code must already be canonical, see ParseProduceCode.
+func (c ProduceCode) HasValidCheckChar() bool {
+	chars := strings.ReplaceAll(string(c), "-", "")
+	if len(chars) != 17 {
+		return false
+	}
+	return checkChar(chars[:16]) == chars[16]
+}
+
+// GenerateProduceCode returns a random canonical produce code with a valid check character
+func GenerateProduceCode() (ProduceCode, error) {
+	chars := make([]byte, 17)
+	for i := 0; i < 16; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		chars[i] = codeAlphabet[n.Int64()]
+	}
+	chars[16] = checkChar(string(chars[:16]))
+
+	return ProduceCode(fmt.Sprintf("%s-%s-%s-%s", chars[0:4], chars[4:8], chars[8:12], chars[12:17])), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProduceCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    ProduceCode
+		wantErr error
+	}{
+		{name: "upper", in: "A12T-4GH7-QPL9-3N4M", want: "A12T-4GH7-QPL9-3N4M"},
+		{name: "lower", in: "a12t-4gh7-qpl9-3n4m", want: "A12T-4GH7-QPL9-3N4M"},
+		{name: "mixed", in: "a12T-4Gh7-qPL9-3n4M", want: "A12T-4GH7-QPL9-3N4M"},
+		{name: "leading garbage", in: "xxA12T-4GH7-QPL9-3N4M", wantErr: ErrInvalidCode},
+		{name: "trailing garbage", in: "A12T-4GH7-QPL9-3N4Mxxx", wantErr: ErrInvalidCode},
+		{name: "surrounding space", in: " A12T-4GH7-QPL9-3N4M ", wantErr: ErrInvalidCode},
+		{name: "short group", in: "A12T-4GH7-QPL9-3N4", wantErr: ErrInvalidCode},
+		{name: "no dashes", in: "A12T4GH7QPL93N4M", wantErr: ErrInvalidCode},
+		{name: "special chars", in: "@12T-4GH7-QPL9-3N4M", wantErr: ErrInvalidCode},
+		{name: "non-ascii letter", in: "ı12T-4GH7-QPL9-3N4M", wantErr: ErrInvalidCode},
+		{name: "empty", in: "", wantErr: ErrInvalidCode},
+		{name: "check char", in: "a12t-4gh7-qpl9-3n4m5", want: "A12T-4GH7-QPL9-3N4M5"},
+		{name: "bad check char", in: "A12T-4GH7-QPL9-3N4M6", wantErr: ErrInvalidCheckChar},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProduceCode(tt.in)
+			if err != tt.wantErr {
+				t.Errorf("ParseProduceCode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseProduceCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_produceCodeMW(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	// lower case codes are found and displayed in upper case
+	rr, body := testRequest(t, ts, "GET", "/api/v1/produce/a12t-4gh7-qpl9-3n4m", nil)
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, `"produce_code":"A12T-4GH7-QPL9-3N4M"`)
+
+	// codes with extra characters are rejected before the db is searched
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce/xxA12T-4GH7-QPL9-3N4Mxxx", nil)
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/produce/A12T-4GH7-QPL9-3N4Mx", nil)
+	a.Equal(400, rr.StatusCode)
+	// a valid check character makes it a different code
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce/A12T-4GH7-QPL9-3N4M5", nil)
+	a.Equal(404, rr.StatusCode)
+	a.Len(db.List(), 4)
+
+	// added codes are stored in upper case
+	payload := `[{"produce_name":"Kiwi","produce_code":"k1w1-4gh7-qpl9-3n4m","produce_unit_price":0.50}]`
+	rr, body = testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(payload))
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, `"produce_code":"K1W1-4GH7-QPL9-3N4M"`)
+	p, err := db.Get("K1W1-4GH7-QPL9-3N4M")
+	a.NoError(err)
+	a.Equal(ProduceCode("K1W1-4GH7-QPL9-3N4M"), p.Code)
+
+	// bulk delete rejects invalid codes individually
+	rr, body = testRequest(t, ts, "POST", "/api/v1/produce/bulk-delete", bytes.NewBufferString(`{"codes":["K1W1-4GH7-QPL9-3N4Mxx","k1w1-4gh7-qpl9-3n4m"]}`))
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, fmt.Sprintf(`"status":"400: %s"`, ErrInvalidCode))
+	a.Contains(body, `"produce_code":"K1W1-4GH7-QPL9-3N4M","status_code":204`)
+}
+
+func TestGenerateProduceCode(t *testing.T) {
+	a := assert.New(t)
+	for i := 0; i < 100; i++ {
+		code, err := GenerateProduceCode()
+		a.NoError(err)
+		parsed, err := ParseProduceCode(code.String())
+		a.NoError(err)
+		a.Equal(code, parsed)
+		a.True(code.HasValidCheckChar(), code)
+	}
+}
+
+func TestProduceCode_HasValidCheckChar(t *testing.T) {
+	a := assert.New(t)
+
+	code, err := GenerateProduceCode()
+	a.NoError(err)
+
+	// every single character typo is caught
+	for i, c := range []byte(code) {
+		if c == '-' {
+			continue
+		}
+		for _, typo := range []byte(codeAlphabet) {
+			if typo == c {
+				continue
+			}
+			mistyped := []byte(code)
+			mistyped[i] = typo
+			a.False(ProduceCode(mistyped).HasValidCheckChar(), string(mistyped))
+		}
+	}
+
+	a.True(ProduceCode("0000-0000-0000-00000").HasValidCheckChar())
+	a.False(ProduceCode("0000-0000-0000-00001").HasValidCheckChar())
+	a.False(ProduceCode("0000-0000-0000-0000").HasValidCheckChar())
+	a.False(ProduceCode("0000-0000").HasValidCheckChar())
+	a.True(ProduceCode("0000-0000-0000-00001").HasCheckChar())
+	a.False(ProduceCode("0000-0000-0000-0000").HasCheckChar())
+}
+
+func TestHandler_GenerateCodes(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	ts := httptest.NewServer(LoadRouter(NewHandler(NewDB(logger), runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "POST", "/api/v1/produce/codes", nil)
+	a.Equal(200, rr.StatusCode)
+	var gr GenerateCodesResponse
+	a.NoError(json.Unmarshal([]byte(body), &gr))
+	a.Len(gr.Codes, 1)
+
+	rr, body = testRequest(t, ts, "POST", "/api/v1/produce/codes", bytes.NewBufferString(`{"count":25}`))
+	a.Equal(200, rr.StatusCode)
+	gr = GenerateCodesResponse{}
+	a.NoError(json.Unmarshal([]byte(body), &gr))
+	a.Len(gr.Codes, 25)
+	seen := map[ProduceCode]bool{}
+	for _, c := range gr.Codes {
+		a.True(c.HasValidCheckChar())
+		seen[c] = true
+	}
+	a.Len(seen, 25)
+
+	for _, payload := range []string{`{"count":0}`, `{"count":101}`, `{"count":"ten"}`} {
+		rr, _ = testRequest(t, ts, "POST", "/api/v1/produce/codes", bytes.NewBufferString(payload))
+		a.Equal(400, rr.StatusCode, payload)
+	}
+}
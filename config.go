@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration read and written as a string such as 30s or 10m
+type Duration time.Duration
+
+// MarshalYAML writes the duration as a string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalYAML reads a duration string
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	parsed, err := time.ParseDuration(n.Value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config holds every setting of the server.  LoadConfig fills it from, lowest precedence first,
+// the defaults, a YAML or JSON config file, env variables and command line flags.
+type Config struct {
+	// File is the config file the config was read from, if any
+	File string `yaml:"-"`
+
+	// Addresses to listen on, see parseListenAddr.  Every interface when empty.
+	Addresses AddressList `yaml:"address"`
+	Port      int         `yaml:"port"`
+	MaxProcs  int         `yaml:"max_procs"`
+	// LogLevel is 1=PanicLevel,2=FatalLevel,3=ErrorLevel,4=WarnLevel,5=InfoLevel,6=DebugLevel,7=TraceLevel
+	LogLevel int `yaml:"log_level"`
+
+	CodeCheckChar   bool     `yaml:"code_check_char"`
+	NamePunctuation string   `yaml:"name_punctuation"`
+	NameMaxLength   int      `yaml:"name_max_length"`
+	UniqueNames     bool     `yaml:"unique_names"`
+	IdempotencyTTL  Duration `yaml:"idempotency_ttl"`
+	TenantsFile     string   `yaml:"tenants_file"`
+
+	APIKeyFile    string    `yaml:"apikey_file"`
+	AnonymousRead bool      `yaml:"anonymous_read"`
+	JWT           JWTConfig `yaml:"jwt"`
+	TLS           TLSConfig `yaml:"tls"`
+
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins"`
+	CORSMaxAge         Duration `yaml:"cors_max_age"`
+
+	RateLimits   string `yaml:"rate_limits"`
+	MaxBulkItems int    `yaml:"max_bulk_items"`
+	MaxBodyBytes int64  `yaml:"max_body_bytes"`
+
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout"`
+	ReadTimeout       Duration `yaml:"read_timeout"`
+	WriteTimeout      Duration `yaml:"write_timeout"`
+	IdleTimeout       Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout"`
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:               8088,
+		MaxProcs:           runtime.NumCPU(),
+		LogLevel:           3,
+		NameMaxLength:      DefaultNamePolicy().MaxLength,
+		IdempotencyTTL:     Duration(defaultIdempotencyTTL),
+		CORSAllowedOrigins: []string{"*"},
+		CORSMaxAge:         Duration(defaultCORSMaxAge),
+		MaxBodyBytes:       defaultMaxBodyBytes,
+		ReadHeaderTimeout:  Duration(defaultReadHeaderTimeout),
+		ReadTimeout:        Duration(defaultReadTimeout),
+		WriteTimeout:       Duration(defaultWriteTimeout),
+		IdleTimeout:        Duration(defaultIdleTimeout),
+		ShutdownTimeout:    Duration(defaultShutdownTimeout),
+	}
+}
+
+// setting is a config field that can be set from an env variable and a command line flag
+type setting struct {
+	// key is the field's name in the config file, with nested keys joined by dots
+	key   string
+	env   string
+	usage string
+	// isBool settings can be passed as a bare flag, e.g. --unique-names
+	isBool bool
+	set    func(c *Config, v string) error
+}
+
+// flag returns the command line flag name of the setting, the key with dashes
+func (s setting) flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+func stringSetting(key, env, usage string, field func(c *Config) *string) setting {
+	return setting{key: key, env: env, usage: usage, set: func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intSetting(key, env, usage string, field func(c *Config) *int) setting {
+	return setting{key: key, env: env, usage: usage, set: func(c *Config, v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", v)
+		}
+		*field(c) = i
+		return nil
+	}}
+}
+
+func boolSetting(key, env, usage string, field func(c *Config) *bool) setting {
+	return setting{key: key, env: env, usage: usage, isBool: true, set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func listSetting(key, env, usage string, field func(c *Config) *[]string) setting {
+	return setting{key: key, env: env, usage: usage, set: func(c *Config, v string) error {
+		*field(c) = splitList(v)
+		return nil
+	}}
+}
+
+func durationSetting(key, env, usage string, field func(c *Config) *Duration) setting {
+	return setting{key: key, env: env, usage: usage, set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 30s or 10m", v)
+		}
+		*field(c) = Duration(d)
+		return nil
+	}}
+}
+
+// settings lists every config field that can be set by env variable and flag
+var settings = []setting{
+	listSetting("address", "ADDRESS", "comma separated IPv4 or IPv6 addresses, hostnames, host:ports or unix:/socket/paths to listen on, every interface when empty", func(c *Config) *[]string { return (*[]string)(&c.Addresses) }),
+	intSetting("port", "PORT", "port to listen on for addresses without one", func(c *Config) *int { return &c.Port }),
+	intSetting("max_procs", "MAXPROCS", "concurrent pipelines for bulk requests, at most the number of cpus", func(c *Config) *int { return &c.MaxProcs }),
+	intSetting("log_level", "LOGLEVEL", "log level from 1 (panic) to 7 (trace)", func(c *Config) *int { return &c.LogLevel }),
+	boolSetting("code_check_char", "CODE_CHECK_CHAR", "reject new codes without a check character", func(c *Config) *bool { return &c.CodeCheckChar }),
+	stringSetting("name_punctuation", "NAME_PUNCTUATION", "punctuation allowed in produce names", func(c *Config) *string { return &c.NamePunctuation }),
+	intSetting("name_max_length", "NAME_MAX_LENGTH", "longest produce name allowed", func(c *Config) *int { return &c.NameMaxLength }),
+	boolSetting("unique_names", "UNIQUE_NAMES", "stop two items having the same name", func(c *Config) *bool { return &c.UniqueNames }),
+	durationSetting("idempotency_ttl", "IDEMPOTENCY_TTL", "how long idempotent responses are replayed", func(c *Config) *Duration { return &c.IdempotencyTTL }),
+	stringSetting("tenants_file", "TENANTS_FILE", "partner seller tenants file", func(c *Config) *string { return &c.TenantsFile }),
+	stringSetting("apikey_file", "APIKEY_FILE", "api key file, turns on api key authentication", func(c *Config) *string { return &c.APIKeyFile }),
+	boolSetting("anonymous_read", "ANONYMOUS_READ", "let callers without credentials read when authentication is on", func(c *Config) *bool { return &c.AnonymousRead }),
+	stringSetting("jwt.hs256_secret", "JWT_HS256_SECRET", "shared secret for HS256 bearer tokens", func(c *Config) *string { return &c.JWT.HS256Secret }),
+	stringSetting("jwt.jwks_file", "JWT_JWKS_FILE", "json web key set file for RS256 bearer tokens", func(c *Config) *string { return &c.JWT.JWKSFile }),
+	stringSetting("jwt.issuer", "JWT_ISSUER", "required iss claim of bearer tokens", func(c *Config) *string { return &c.JWT.Issuer }),
+	stringSetting("jwt.audience", "JWT_AUDIENCE", "required aud claim of bearer tokens", func(c *Config) *string { return &c.JWT.Audience }),
+	stringSetting("jwt.role_claim", "JWT_ROLE_CLAIM", "bearer token claim holding roles", func(c *Config) *string { return &c.JWT.RoleClaim }),
+	stringSetting("jwt.role_map", "JWT_ROLE_MAP", "maps token role claims to roles, only mapped claims grant a role when set, e.g. admins=admin", func(c *Config) *string { return &c.JWT.RoleMap }),
+	stringSetting("tls.cert_file", "TLS_CERT_FILE", "PEM certificate chain file, turns on tls", func(c *Config) *string { return &c.TLS.CertFile }),
+	stringSetting("tls.key_file", "TLS_KEY_FILE", "PEM private key file of the certificate", func(c *Config) *string { return &c.TLS.KeyFile }),
+	stringSetting("tls.client_ca_file", "TLS_CLIENT_CA_FILE", "PEM bundle of CAs client certificates are verified against, turns on mutual tls", func(c *Config) *string { return &c.TLS.ClientCAFile }),
+	stringSetting("tls.client_auth", "TLS_CLIENT_AUTH", "require or optional client certificates", func(c *Config) *string { return &c.TLS.ClientAuth }),
+	stringSetting("tls.client_role_map", "TLS_CLIENT_ROLE_MAP", "maps client certificate common names (cn:) and organizational units (ou:) to roles, e.g. ou:store-systems=editor", func(c *Config) *string { return &c.TLS.ClientRoleMap }),
+	listSetting("cors_allowed_origins", "CORS_ALLOWED_ORIGINS", "comma separated origins browsers may call from, * for any", func(c *Config) *[]string { return &c.CORSAllowedOrigins }),
+	durationSetting("cors_max_age", "CORS_MAX_AGE", "how long browsers may cache preflight responses", func(c *Config) *Duration { return &c.CORSMaxAge }),
+	stringSetting("rate_limits", "RATE_LIMITS", "per route rate limits, e.g. *=20/s:40", func(c *Config) *string { return &c.RateLimits }),
+	intSetting("max_bulk_items", "MAX_BULK_ITEMS", "most items in one add request, no limit when 0", func(c *Config) *int { return &c.MaxBulkItems }),
+	{key: "max_body_bytes", env: "MAX_BODY_BYTES", usage: "largest request body accepted in bytes", set: func(c *Config, v string) error {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", v)
+		}
+		c.MaxBodyBytes = i
+		return nil
+	}},
+	durationSetting("read_header_timeout", "READ_HEADER_TIMEOUT", "time allowed to read request headers", func(c *Config) *Duration { return &c.ReadHeaderTimeout }),
+	durationSetting("read_timeout", "READ_TIMEOUT", "time allowed to read a request", func(c *Config) *Duration { return &c.ReadTimeout }),
+	durationSetting("write_timeout", "WRITE_TIMEOUT", "time allowed to handle a request and write the response", func(c *Config) *Duration { return &c.WriteTimeout }),
+	durationSetting("idle_timeout", "IDLE_TIMEOUT", "time keep-alive connections are kept open", func(c *Config) *Duration { return &c.IdleTimeout }),
+	durationSetting("shutdown_timeout", "SHUTDOWN_TIMEOUT", "time in-flight requests have to finish on shutdown", func(c *Config) *Duration { return &c.ShutdownTimeout }),
+}
+
+// LoadConfig builds the config from the command line args and env variables, looked up with
+// lookupEnv.  The config file is named by the --config flag or CONFIG_FILE env variable.  Env
+// variables override the file and flags override both.  printConfig is set when --print-config
+// is passed.  Values that can't be parsed, and a config that fails Validate, return an error.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (c Config, printConfig bool, err error) {
+	c = DefaultConfig()
+
+	fs := flag.NewFlagSet("big-produce", flag.ContinueOnError)
+	configFile, _ := lookupEnv("CONFIG_FILE")
+	fs.StringVar(&configFile, "config", configFile, "YAML or JSON config file (env CONFIG_FILE)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective config as YAML and exit")
+
+	// flags are applied after the file and env variables, in the order given
+	var flagged []func() error
+	for _, s := range settings {
+		s := s
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		apply := func(v string) error {
+			flagged = append(flagged, func() error {
+				if err := s.set(&c, v); err != nil {
+					return fmt.Errorf("--%s: %w", s.flag(), err)
+				}
+				return nil
+			})
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.flag(), usage, apply)
+		} else {
+			fs.Func(s.flag(), usage, apply)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, false, err
+	}
+	if fs.NArg() > 0 {
+		return c, false, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	if configFile != "" {
+		c.File = configFile
+		if err := c.loadFile(configFile); err != nil {
+			return c, false, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := s.set(&c, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	for _, apply := range flagged {
+		errs = append(errs, apply())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return c, false, err
+	}
+
+	return c, printConfig, c.Validate()
+}
+
+// loadFile reads the YAML or JSON config file over c.  Keys that aren't settings are an error so
+// typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(dat))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks every setting is in range and returns an error listing each one that isn't
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if _, err := c.ListenAddrs(); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.Port > 0 && c.Port <= 65535, "port %d is not between 1 and 65535", c.Port)
+	check(c.MaxProcs > 0 && c.MaxProcs <= runtime.NumCPU(), "max_procs %d is not between 1 and the %d cpus", c.MaxProcs, runtime.NumCPU())
+	check(c.LogLevel >= 1 && c.LogLevel <= 7, "log_level %d is not between 1 and 7", c.LogLevel)
+	check(c.NameMaxLength > 0, "name_max_length %d must be positive", c.NameMaxLength)
+	check(len(c.CORSAllowedOrigins) > 0, "cors_allowed_origins must not be empty")
+	for _, origin := range c.CORSAllowedOrigins {
+		check(origin == "*" || strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"),
+			"cors_allowed_origins %q is not *, or an http or https origin", origin)
+	}
+	check(c.CORSMaxAge >= 0, "cors_max_age %s must not be negative", time.Duration(c.CORSMaxAge))
+	check(c.MaxBulkItems >= 0, "max_bulk_items %d must not be negative", c.MaxBulkItems)
+	check(c.MaxBodyBytes > 0, "max_body_bytes %d must be positive", c.MaxBodyBytes)
+	for _, d := range []struct {
+		key string
+		d   Duration
+	}{
+		{"idempotency_ttl", c.IdempotencyTTL},
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	} {
+		check(d.d > 0, "%s %s must be positive", d.key, time.Duration(d.d))
+	}
+	if _, err := ParseRateLimits(c.RateLimits); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limits: %w", err))
+	}
+	if _, err := parseRoleMap(c.JWT.RoleMap); err != nil {
+		errs = append(errs, fmt.Errorf("jwt.role_map: %w", err))
+	}
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(c.TLS.ClientCAFile == "" || c.TLS.Enabled(), "tls.client_ca_file needs tls.cert_file and tls.key_file")
+	check(c.TLS.ClientAuth == "" || c.TLS.ClientAuth == ClientAuthRequire || c.TLS.ClientAuth == ClientAuthOptional,
+		"tls.client_auth %q is not %s or %s", c.TLS.ClientAuth, ClientAuthRequire, ClientAuthOptional)
+	if _, err := parseClientRoleMap(c.TLS.ClientRoleMap); err != nil {
+		errs = append(errs, fmt.Errorf("tls.client_role_map: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// ListenAddrs returns the addresses the server listens on, and an error listing every address
+// that can't be parsed or is given twice
+func (c Config) ListenAddrs() ([]ListenAddr, error) {
+	addresses := c.Addresses
+	if len(addresses) == 0 {
+		addresses = AddressList{""}
+	}
+	var addrs []ListenAddr
+	var errs []error
+	seen := map[ListenAddr]bool{}
+	for _, s := range addresses {
+		a, err := parseListenAddr(s, c.Port)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case seen[a]:
+			errs = append(errs, fmt.Errorf("address %q is listened on twice", s))
+		default:
+			seen[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, errors.Join(errs...)
+}
+
+// NamePolicy returns the policy produce names are checked against
+func (c Config) NamePolicy() NamePolicy {
+	np := DefaultNamePolicy()
+	if c.NamePunctuation != "" {
+		np.AllowedPunctuation = c.NamePunctuation
+	}
+	np.MaxLength = c.NameMaxLength
+	return np
+}
+
+// String returns the config as YAML, with secrets masked, for --print-config
+func (c Config) String() string {
+	if c.JWT.HS256Secret != "" {
+		c.JWT.HS256Secret = "********"
+	}
+	dat, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(dat)
+}
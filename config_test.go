@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// envMap returns a lookupEnv func over the map
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+}
+
+// writeConfigFile writes the config file contents to a temp file with the extension
+func writeConfigFile(t *testing.T, ext, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config"+ext)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// listenAddrs returns the config's listen addresses, failing the test if they don't parse
+func listenAddrs(t *testing.T, c Config) []ListenAddr {
+	t.Helper()
+	addrs, err := c.ListenAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addrs
+}
+
+func TestLoadConfig_defaults(t *testing.T) {
+	a := assert.New(t)
+
+	c, printConfig, err := LoadConfig(nil, envMap(nil))
+	a.NoError(err)
+	a.False(printConfig)
+	a.Equal(DefaultConfig(), c)
+	a.Equal([]ListenAddr{{Network: "tcp", Address: ":8088"}}, listenAddrs(t, c))
+	a.Equal(runtime.NumCPU(), c.MaxProcs)
+	a.Equal(DefaultNamePolicy(), c.NamePolicy())
+}
+
+func TestLoadConfig_precedence(t *testing.T) {
+	a := assert.New(t)
+	file := writeConfigFile(t, ".yaml", `
+address: 127.0.0.1
+port: 9000
+log_level: 4
+unique_names: true
+idempotency_ttl: 1h
+jwt:
+  issuer: https://sso.example.com
+  role_map: produce-admins=admin
+`)
+
+	// the file overrides the defaults
+	c, _, err := LoadConfig([]string{"--config", file}, envMap(nil))
+	a.NoError(err)
+	a.Equal([]ListenAddr{{Network: "tcp", Address: "127.0.0.1:9000"}}, listenAddrs(t, c))
+	a.Equal(4, c.LogLevel)
+	a.True(c.UniqueNames)
+	a.Equal(Duration(time.Hour), c.IdempotencyTTL)
+	a.Equal("https://sso.example.com", c.JWT.Issuer)
+	a.Equal(Duration(defaultWriteTimeout), c.WriteTimeout)
+
+	// env variables override the file, which can also be named by CONFIG_FILE
+	env := map[string]string{"CONFIG_FILE": file, "PORT": "9100", "UNIQUE_NAMES": "false", "JWT_ISSUER": "https://login.example.com"}
+	c, _, err = LoadConfig(nil, envMap(env))
+	a.NoError(err)
+	a.Equal([]ListenAddr{{Network: "tcp", Address: "127.0.0.1:9100"}}, listenAddrs(t, c))
+	a.False(c.UniqueNames)
+	a.Equal("https://login.example.com", c.JWT.Issuer)
+	a.Equal(4, c.LogLevel)
+
+	// flags override both, and bool flags can be bare
+	c, printConfig, err := LoadConfig([]string{"--port=9200", "--unique-names", "--jwt-issuer", "https://id.example.com", "--print-config"}, envMap(env))
+	a.NoError(err)
+	a.True(printConfig)
+	a.Equal(9200, c.Port)
+	a.True(c.UniqueNames)
+	a.Equal("https://id.example.com", c.JWT.Issuer)
+}
+
+func TestLoadConfig_json(t *testing.T) {
+	a := assert.New(t)
+	file := writeConfigFile(t, ".json", `{"port": 9300, "write_timeout": "2m", "rate_limits": "*=20/s", "jwt": {"audience": "big-produce"}}`)
+
+	c, _, err := LoadConfig([]string{"-config=" + file}, envMap(nil))
+	a.NoError(err)
+	a.Equal(9300, c.Port)
+	a.Equal(Duration(2*time.Minute), c.WriteTimeout)
+	a.Equal("*=20/s", c.RateLimits)
+	a.Equal("big-produce", c.JWT.Audience)
+}
+
+func TestLoadConfig_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want []string
+	}{
+		{name: "bad env int", env: map[string]string{"MAXPROCS": "many"}, want: []string{`MAXPROCS: "many" is not a whole number`}},
+		{name: "bad env bool", env: map[string]string{"UNIQUE_NAMES": "yes please"}, want: []string{"UNIQUE_NAMES"}},
+		{name: "bad env duration", env: map[string]string{"IDEMPOTENCY_TTL": "ten minutes"}, want: []string{"IDEMPOTENCY_TTL"}},
+		{name: "bad flag", args: []string{"--port", "http"}, want: []string{"--port"}},
+		{name: "unknown flag", args: []string{"--colour"}, want: []string{"colour"}},
+		{name: "stray argument", args: []string{"serve"}, want: []string{"unexpected arguments"}},
+		{name: "missing file", args: []string{"--config", "/nonexistent/config.yaml"}, want: []string{"no such file"}},
+		{name: "unknown key", file: "prot: 9000\n", want: []string{"field prot not found"}},
+		{name: "bad file duration", file: "read_timeout: soon\n", want: []string{"config file"}},
+		{name: "every error is reported", env: map[string]string{"PORT": "0", "LOGLEVEL": "9", "MAXPROCS": "-1"}, want: []string{"port 0", "log_level 9", "max_procs -1"}},
+		{name: "address", env: map[string]string{"ADDRESS": "256.256.256.256"}, want: []string{"address"}},
+		{name: "every bad address is reported", file: "address: [999.1.1.1abc, \"[localhost]\", \"127.0.0.1:http\", \"unix:\"]\n", want: []string{"999.1.1.1abc", "[localhost]", "127.0.0.1:http", `"unix:"`}},
+		{name: "address given twice", env: map[string]string{"ADDRESS": "127.0.0.1:8088,127.0.0.1", "PORT": "8088"}, want: []string{"listened on twice"}},
+		{name: "too many procs", args: []string{"--max-procs", "100000"}, want: []string{"max_procs 100000"}},
+		{name: "timeouts", env: map[string]string{"WRITE_TIMEOUT": "0s", "SHUTDOWN_TIMEOUT": "-1s"}, want: []string{"write_timeout 0s", "shutdown_timeout -1s"}},
+		{name: "sizes", env: map[string]string{"MAX_BODY_BYTES": "0", "MAX_BULK_ITEMS": "-1", "NAME_MAX_LENGTH": "0"}, want: []string{"max_body_bytes", "max_bulk_items", "name_max_length"}},
+		{name: "rate limits", env: map[string]string{"RATE_LIMITS": "*=fast"}, want: []string{"rate_limits"}},
+		{name: "role map", env: map[string]string{"JWT_ROLE_MAP": "staff=owner"}, want: []string{"jwt.role_map"}},
+		{name: "tls", env: map[string]string{"TLS_KEY_FILE": "server.key", "TLS_CLIENT_AUTH": "sometimes", "TLS_CLIENT_ROLE_MAP": "tills=owner"}, want: []string{"tls.cert_file and tls.key_file", "tls.client_auth", "tls.client_role_map"}},
+		{name: "client ca without tls", env: map[string]string{"TLS_CLIENT_CA_FILE": "ca.crt"}, want: []string{"tls.client_ca_file"}},
+		{name: "cors", env: map[string]string{"CORS_ALLOWED_ORIGINS": "shop.example.com", "CORS_MAX_AGE": "-1s"}, want: []string{"cors_allowed_origins", "cors_max_age"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "--config", writeConfigFile(t, ".yaml", tt.file))
+			}
+			_, _, err := LoadConfig(args, envMap(tt.env))
+			if !assert.Error(t, err) {
+				return
+			}
+			for _, want := range tt.want {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestConfig_String(t *testing.T) {
+	a := assert.New(t)
+	c := DefaultConfig()
+	c.JWT.HS256Secret = "sso-secret"
+
+	out := c.String()
+	a.NotContains(out, "sso-secret")
+	a.Contains(out, "hs256_secret: '********'")
+	a.Contains(out, "write_timeout: 1m0s")
+	a.Contains(out, "port: 8088")
+
+	// the printed config can be read back
+	file := writeConfigFile(t, ".yaml", strings.Replace(out, "'********'", "other-secret", 1))
+	back, _, err := LoadConfig([]string{"--config", file}, envMap(nil))
+	a.NoError(err)
+	a.Equal(DefaultConfig().WriteTimeout, back.WriteTimeout)
+	a.Equal("other-secret", back.JWT.HS256Secret)
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"sync"
+	"sort"
+	"strconv"
+	"sync/atomic"
 
-	"github.com/go-chi/chi/v5"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,23 +18,160 @@ type Handler struct {
 	DB       *DB
 	maxProcs int
 	logger   *logrus.Logger
+	// stages are custom AddProduce pipeline stages run after the built-in validation
+	stages []AddStage
+	// idempotency caches responses for requests sent with an Idempotency-Key header
+	idempotency *IdempotencyCache
+	// tenants holds the partner seller catalogues.  DB is the shared catalogue served to requests
+	// that don't select a tenant.
+	tenants *TenantRegistry
+	// apiKeys authenticates requests by X-API-Key header, jwt by Authorization: Bearer token and
+	// clientCerts by verified tls client certificate.  Authentication is off when all are nil.
+	apiKeys     *APIKeyStore
+	jwt         *JWTVerifier
+	clientCerts *ClientCertAuth
+	// authFailures limits how many failed authentications each client ip address may make
+	authFailures *RateLimiter
+	// live holds the settings a config reload can change, see applyConfig
+	live atomic.Pointer[liveSettings]
+	// maxBodyBytes caps the size of request bodies.  No cap when 0.
+	maxBodyBytes int64
 }
 
 // NewHandler returns a pointer to a handler
 func NewHandler(db *DB, maxProcs int, logger *logrus.Logger) *Handler {
-	return &Handler{DB: db, maxProcs: maxProcs, logger: logger}
+	h := &Handler{DB: db, maxProcs: maxProcs, logger: logger, idempotency: NewIdempotencyCache(defaultIdempotencyTTL), authFailures: NewRateLimiter(authFailureLimit)}
+	h.live.Store(&liveSettings{cors: newCORS([]string{"*"}, defaultCORSMaxAge)})
+	return h
 }
 
+// redactedHeaders carry credentials so their values are left out of the log
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", APIKeyHeader, TenantHeader}
+
 // handlerErrorLogger - a helper to format debugging log output for handler functions
 func handlerErrorLogger(r *http.Request, err error, logger *logrus.Logger) {
-	logger.Errorf("host:%sr, url:%s. headers:%v, method:%s, reqAddr:%s, err: %s", r.Host, r.URL, r.Header, r.Method, r.RemoteAddr, err.Error())
+	logger.Errorf("host:%sr, url:%s. headers:%v, method:%s, reqAddr:%s, err: %s", r.Host, r.URL, redactHeaders(r.Header), r.Method, r.RemoteAddr, err.Error())
+
+}
 
+// redactHeaders returns a copy of the headers with the values of redactedHeaders replaced
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, k := range redactedHeaders {
+		if redacted.Get(k) != "" {
+			redacted.Set(k, "REDACTED")
+		}
+	}
+	return redacted
+}
+
+// statusForError maps database errors to the http status code returned to the client.
+// Unknown errors are treated as internal server errors.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrCategoryNotFound), errors.Is(err, ErrTagNotFound),
+		errors.Is(err, ErrSupplierNotFound), errors.Is(err, ErrStoreNotFound), errors.Is(err, ErrAPIKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateItem), errors.Is(err, ErrDuplicatePLU), errors.Is(err, ErrDuplicateGTIN),
+		errors.Is(err, ErrDuplicateName), errors.Is(err, ErrDuplicateCategory), errors.Is(err, ErrDuplicateTag),
+		errors.Is(err, ErrCategoryInUse), errors.Is(err, ErrTagInUse), errors.Is(err, ErrDuplicateSupplier),
+		errors.Is(err, ErrSupplierInUse), errors.Is(err, ErrDuplicateStore):
+		return http.StatusConflict
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidCode), errors.Is(err, ErrInvalidName), errors.Is(err, ErrInvalidUnitPrice),
+		errors.Is(err, ErrInvalidPLU), errors.Is(err, ErrInvalidGTIN), errors.Is(err, ErrInvalidCategory),
+		errors.Is(err, ErrInvalidTag), errors.Is(err, ErrInvalidSupplier), errors.Is(err, ErrInvalidSupply),
+		errors.Is(err, ErrInvalidStore), errors.Is(err, ErrInvalidOverride), errors.Is(err, ErrInvalidAPIKey):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// queryBool parses an optional boolean query parameter.  A missing parameter is false.
+func queryBool(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return b, nil
+}
+
+// queryLimit parses the optional limit query parameter, which must be between 1 and max.
+// A missing parameter is def.
+func queryLimit(r *http.Request, def, max int) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > max {
+		return 0, fmt.Errorf("limit must be a number between 1 and %d", max)
+	}
+	return limit, nil
+}
+
+// queryLang parses the optional lang query parameter used to pick localized produce names
+func queryLang(r *http.Request) (string, error) {
+	v := r.URL.Query().Get("lang")
+	if v == "" {
+		return "", nil
+	}
+	lang, err := parseLangTag(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid value for lang: %q", v)
+	}
+	return lang, nil
 }
 
 // GetAllProduce will return a json string with all items from the database
+// Passing lang, e.g. ?lang=es, returns each name in that language where the item has one.
+// Passing category, e.g. ?category=citrus, returns only items in that category or any category
+// below it, and passing tag, e.g. ?tag=organic&tag=seasonal, only items carrying every tag.
+// An unknown category or tag gets a 400.
 func (h *Handler) GetAllProduce(w http.ResponseWriter, r *http.Request) {
 
-	p := h.DB.List()
+	lang, err := queryLang(r)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f := ProduceFilter{Category: r.URL.Query().Get("category"), Tags: r.URL.Query()["tag"]}
+	if f.Category != "" {
+		if _, err := h.db(r).GetCategory(f.Category); err != nil {
+			handlerErrorLogger(r, err, h.logger)
+			http.Error(w, "unknown category", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, t := range f.Tags {
+		if _, err := h.db(r).GetTag(t); err != nil {
+			handlerErrorLogger(r, err, h.logger)
+			http.Error(w, "unknown tag", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var p []*ProduceItem
+	if f.IsEmpty() {
+		p = h.db(r).List()
+	} else {
+		p = h.db(r).Find(f)
+	}
+	if lang != "" {
+		localized := make([]*ProduceItem, len(p))
+		for i := range p {
+			localized[i] = localize(p[i], lang)
+		}
+		p = localized
+	}
 
 	dat, err := json.Marshal(p)
 	if err != nil {
@@ -49,11 +189,19 @@ func (h *Handler) GetAllProduce(w http.ResponseWriter, r *http.Request) {
 // GetProduce requires a path variable for the produce code.   The code is searched
 // against the database.  If the item is found a json representation of that object is returned.
 // If no item is found with  that id a 404 error is returned with "item not found" text.
-// If the code is empty a 400 bad request is returned with "verify Produce code" text.
+// If the code is empty or invalid a 400 bad request is returned by produceCodeMW.
+// Passing lang, e.g. ?lang=es, returns the name in that language if the item has one.
 func (h *Handler) GetProduce(w http.ResponseWriter, r *http.Request) {
-	code := chi.URLParam(r, "code")
+	code := produceCodeFromContext(r.Context())
 
-	p, err := h.DB.Get(code)
+	lang, err := queryLang(r)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := h.db(r).Get(code)
 	if err != nil {
 		handlerErrorLogger(r, err, h.logger)
 
@@ -67,7 +215,52 @@ func (h *Handler) GetProduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dat, err := json.Marshal(p)
+	dat, err := json.Marshal(localize(p, lang))
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, "error generating json data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// LookupProduce resolves a scanned identifier to a produce item.  Exactly one of the plu or gtin
+// query parameters is required, e.g. ?plu=4011 or ?gtin=012345678905.  A json representation of the
+// item is returned if found, a 404 if no item carries the identifier and a 400 if it is invalid.
+// Passing lang, e.g. ?lang=es, returns the name in that language if the item has one.
+func (h *Handler) LookupProduce(w http.ResponseWriter, r *http.Request) {
+	plu := r.URL.Query().Get("plu")
+	gtin := r.URL.Query().Get("gtin")
+
+	lang, err := queryLang(r)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var p *ProduceItem
+	switch {
+	case plu != "" && gtin != "":
+		http.Error(w, "provide either plu or gtin, not both", http.StatusBadRequest)
+		return
+	case plu != "":
+		p, err = h.db(r).GetByPLU(plu)
+	case gtin != "":
+		p, err = h.db(r).GetByGTIN(gtin)
+	default:
+		http.Error(w, "provide either plu or gtin", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	dat, err := json.Marshal(localize(p, lang))
 	if err != nil {
 		handlerErrorLogger(r, err, h.logger)
 		http.Error(w, "error generating json data", http.StatusInternalServerError)
@@ -82,9 +275,9 @@ func (h *Handler) GetProduce(w http.ResponseWriter, r *http.Request) {
 // A path variable for the produce code is required.  If the item is not found a 404 is returned.  if the code
 // provided isn't valid a 400 bad request is returned.   If the item is deleted a 204 is returned.
 func (h *Handler) DeleteProduce(w http.ResponseWriter, r *http.Request) {
-	code := chi.URLParam(r, "code")
+	code := produceCodeFromContext(r.Context())
 
-	if err := h.DB.Delete(code); err != nil {
+	if err := h.db(r).Delete(code); err != nil {
 
 		handlerErrorLogger(r, err, h.logger)
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -95,8 +288,58 @@ func (h *Handler) DeleteProduce(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// maxGeneratedCodes is the most codes GenerateCodes will return in one call
+const maxGeneratedCodes = 100
+
+// GenerateCodesRequest is the optional payload accepted by GenerateCodes
+type GenerateCodesRequest struct {
+	// Count is the number of codes to generate.  Defaults to one.
+	Count int `json:"count"`
+}
+
+// GenerateCodesResponse holds the codes generated by GenerateCodes
+type GenerateCodesResponse struct {
+	Codes []ProduceCode `json:"codes"`
+}
+
+// GenerateCodes allocates new produce codes so clients don't have to invent them.  The generated codes
+// carry a valid check character and don't collide with any item currently in the database.  The number
+// of codes is set with an optional json body of {"count": n}, up to 100 at a time.
+func (h *Handler) GenerateCodes(w http.ResponseWriter, r *http.Request) {
+
+	req := GenerateCodesRequest{Count: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Count < 1 || req.Count > maxGeneratedCodes {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxGeneratedCodes), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.db(r).GenerateCodes(req.Count)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, "error generating codes", http.StatusInternalServerError)
+		return
+	}
+
+	dat, err := json.Marshal(GenerateCodesResponse{Codes: codes})
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, "error generating json data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
 // AddResult is used to track the status of a ProduceItem to the database
 type AddResult struct {
+	// Index is the zero-based position of the ProduceItem in the request payload
+	Index int `json:"index"`
 	// Produce is the ProduceItem to be added
 	Produce ProduceItem `json:"produce"`
 	// StatusCode is a http status code indicating the status of adding the ProduceItem
@@ -113,224 +356,92 @@ type AddResults struct {
 }
 
 // AddProduce adds ProduceItems to the database.   It accepts an array of ProduceItems in json format.
-// Prior to adding each item to the database the ProduceItems are checked to validate their name, code, and
-// unit prices.  The database is also checked to ensure an existing record does not exist for an item
-// with the same code.  The items are added to the database concurrently utilizing the maxProcs variable
-// as the number of concurrent items to process.   The pipeline was created in a way to easily insert or remove
-// new functions if needed.   The fan-in function is somewhat boilerplate code used to consolidate all channels
-// back down to one slice.
+// Each ProduceItem is run through the add pipeline (see checkStages) which validates the code, name, and
+// unit price, runs any custom stages registered with UseStages, and only then attempts to add the item to
+// the database.  The items are checked concurrently utilizing the maxProcs variable as the number of
+// concurrent pipelines, then written one at a time in request order, so when the request has the same
+// code twice the earlier item is written first.
+// Results are returned in the same order as the request payload once every item is done.  Passing
+// unordered=true as a query parameter instead writes each item and streams its result as soon as
+// its checks are done, so large requests show progress, an item isn't held back by slower ones
+// before it, and the results don't have to be held until the end.  Clashing items in an unordered
+// request are settled in the order their checks finish.
+// Passing dry_run=true runs the same checks as ValidateProduce without writing to the database.
+// The on_conflict query parameter controls what happens to items whose code already exists:
+// error (the default) rejects them with a 409, skip leaves the existing item alone and reports a
+// 200 skipped status, and update replaces the whole existing item reporting a 200 updated or unchanged
+// status.  Fields left out of an update, such as categories, tags, PLU, GTIN or localized names, are
+// cleared.
+// Requests with more items than MAX_BULK_ITEMS allows, or a body larger than MAX_BODY_BYTES, get a
+// 413 and nothing is added.
 func (h *Handler) AddProduce(w http.ResponseWriter, r *http.Request) {
 
-	var pi []ProduceItem
-
-	err := json.NewDecoder(r.Body).Decode(&pi)
+	dryRun, err := queryBool(r, "dry_run")
 	if err != nil {
 		handlerErrorLogger(r, err, h.logger)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	h.addProduce(w, r, dryRun)
+}
 
-	// generator - takes the produceItems from the Post request and puts them on a channel.
-	gen := func(done <-chan interface{}, produceItems ...ProduceItem) <-chan AddResult {
-		resultStream := make(chan AddResult)
-		go func() {
-			defer close(resultStream)
-
-			for _, pi := range produceItems {
-				result := AddResult{
-					Produce:    pi,
-					StatusCode: 0,
-					Status:     "",
-				}
-				select {
-				case <-done:
-					return
-				case resultStream <- result:
-				}
-			}
-		}()
-		return resultStream
-	} // end gen func
-
-	// verify produce name
-	verifyName := func(done <-chan interface{}, incomingStream <-chan AddResult) <-chan AddResult {
-		verifiedNameStream := make(chan AddResult)
-
-		go func() {
-			defer close(verifiedNameStream)
-
-			for i := range incomingStream {
-
-				if i.StatusCode == 0 {
-					if !NameIsValid(i.Produce.Name, h.logger) {
-						i.StatusCode = 400
-						i.Status = "400: ErrInvalidName"
-					}
-				}
-
-				select {
-
-				case <-done:
-					return
-
-				case verifiedNameStream <- i:
-				}
-			}
-		}()
-		return verifiedNameStream
-	} // end verifyName func
-
-	// verify produce code
-	verifyCode := func(done <-chan interface{}, incomingStream <-chan AddResult) <-chan AddResult {
-		verifiedCodeStream := make(chan AddResult)
-
-		go func() {
-			defer close(verifiedCodeStream)
-
-			for i := range incomingStream {
-
-				if i.StatusCode == 0 {
-					if !CodeIsValid(i.Produce.Code, h.logger) {
-						h.logger.Error("code is not valid: ", CodeIsValid(i.Produce.Code, h.logger))
-						i.StatusCode = 400
-						i.Status = "400: ErrInvalidCode"
-					}
-				}
-
-				select {
-				case <-done:
-					return
-				case verifiedCodeStream <- i:
-
-				}
-			}
-		}()
-		return verifiedCodeStream
-	} // end verifyCode func
-
-	// verify produce unit price
-	verifyPrice := func(done <-chan interface{}, incomingStream <-chan AddResult) <-chan AddResult {
-		verifiedPriceStream := make(chan AddResult)
-
-		go func() {
-			defer close(verifiedPriceStream)
-
-			for i := range incomingStream {
-
-				if i.StatusCode == 0 {
-					if !PriceIsValid(i.Produce.UnitPrice, h.logger) {
-						i.StatusCode = 400
-						i.Status = "400: ErrInvalidPrice"
-					}
-				}
-
-				select {
-
-				case <-done:
-					return
-
-				case verifiedPriceStream <- i:
-				}
-			}
-		}()
-		return verifiedPriceStream
-	} // end verifyPrice func
-
-	// pipeline stage that attempts to add the incoming ProduceItem to the database.
-	// if any errors are returned from the Add function,
-	add := func(done <-chan interface{}, incomingStream <-chan AddResult) <-chan AddResult {
-		completedWorkStream := make(chan AddResult)
-
-		go func() {
-			defer close(completedWorkStream)
-
-			for i := range incomingStream {
-
-				if i.StatusCode == 0 {
-					if err := h.DB.Add(&i.Produce); err != nil {
-						if errors.Is(err, ErrInvalidCode) {
-							i.StatusCode = 400
-							i.Status = "400 " + err.Error()
-						} else if errors.Is(err, ErrDuplicateItem) {
-
-							i.StatusCode = 409
-							i.Status = "409: " + ErrDuplicateItem.Error()
-						} else if errors.Is(err, ErrInvalidName) {
-
-							i.StatusCode = 400
-							i.Status = "400: " + ErrInvalidName.Error()
-
-						} else {
-							i.StatusCode = 500
-							i.Status = "500: " + err.Error()
-						}
-
-					} else {
-						i.StatusCode = 201
-						i.Status = "201: added"
-					}
-				}
-				select {
-
-				case <-done:
-					return
-
-				case completedWorkStream <- i:
-				}
-			}
-		}()
-		return completedWorkStream
-	} // end add func
-
-	// fan-in implementation to consolidate the result channels
-	fanIn := func(done <-chan interface{}, channels ...<-chan AddResult) <-chan AddResult {
-		var wg sync.WaitGroup
-		mplexStream := make(chan AddResult)
-
-		mplex := func(c <-chan AddResult) {
-			defer wg.Done()
-			for i := range c {
-				select {
-				case <-done:
-					return
-				case mplexStream <- i:
-				}
-			}
-		}
-		wg.Add(len(channels))
-		for _, c := range channels {
-			go mplex(c)
-		}
+// ValidateProduce accepts the same payload as AddProduce and runs the full validation pipeline,
+// including the duplicate code, name, PLU and GTIN checks and the item quota, against both the
+// database and the items earlier in the payload, but never writes to the database.  Items that
+// would be added have a 201 status code in the results.
+// The on_conflict query parameter is honored just as it is by AddProduce.
+func (h *Handler) ValidateProduce(w http.ResponseWriter, r *http.Request) {
+	h.addProduce(w, r, true)
+}
 
-		go func() {
-			wg.Wait()
-			close(mplexStream)
-		}()
+// addProduce is the shared implementation of AddProduce and ValidateProduce
+func (h *Handler) addProduce(w http.ResponseWriter, r *http.Request, dryRun bool) {
 
-		return mplexStream
-	} // end fan-in
+	unordered, err := queryBool(r, "unordered")
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// setup for pipeline
-	done := make(chan interface{})
-	defer close(done)
-	resultsStream := gen(done, pi...)
+	policy, err := parseConflictPolicy(r.URL.Query().Get("on_conflict"))
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// create a slice of channels equal in length to the number of maxProcs
-	produceProcessors := make([]<-chan AddResult, h.maxProcs)
+	var pi []ProduceItem
 
-	// iterate over maxProcs creating pipelines at each iteration
-	for i := 0; i < h.maxProcs; i++ {
-		produceProcessors[i] = verifyName(done, verifyCode(done, verifyPrice(done, add(done, resultsStream))))
+	err = json.NewDecoder(r.Body).Decode(&pi)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	if max := h.settings().maxBulkItems; max > 0 && len(pi) > max {
+		err = fmt.Errorf("%d items sent, at most %d may be added per request", len(pi), max)
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
 	}
 
-	// rs will hold the final consolidated results from all channels
-	rs := AddResults{}
+	db := h.db(r)
+	checks, write := h.checkStages(db), h.addItem(db, policy)
+	if dryRun {
+		write = h.dryRunItem(db, policy)
+	}
 
-	// fanIn used to consolidate all the results to rs
-	for x := range fanIn(done, produceProcessors...) {
-		rs.Results = append(rs.Results, x)
+	if unordered {
+		h.streamAddResults(w, r, checks, write, pi)
+		return
 	}
 
+	// put the results back in request order
+	var rs AddResults
+	rs.Results = h.runAddPipeline(checks, write, pi)
+	sort.Slice(rs.Results, func(i, j int) bool { return rs.Results[i].Index < rs.Results[j].Index })
+
 	// marshal results and return
 	d, err := json.Marshal(rs)
 	if err != nil {
@@ -344,3 +455,29 @@ func (h *Handler) AddProduce(w http.ResponseWriter, r *http.Request) {
 	w.Write(d)
 
 }
+
+// streamAddResults writes the AddResults of the unordered AddProduce response, sending and flushing
+// each result as soon as it comes out of the pipeline.  As the status is sent before the first
+// result a result that fails to marshal is logged and left out.
+func (h *Handler) streamAddResults(w http.ResponseWriter, r *http.Request, checks []AddStage, write func(i *AddResult), pi []ProduceItem) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	io.WriteString(w, `{"results":[`)
+
+	sep := ""
+	h.streamAddPipeline(checks, write, pi, false, func(x AddResult) {
+		d, err := json.Marshal(x)
+		if err != nil {
+			handlerErrorLogger(r, err, h.logger)
+			return
+		}
+		io.WriteString(w, sep)
+		w.Write(d)
+		sep = ","
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	io.WriteString(w, "]}")
+}
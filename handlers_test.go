@@ -3,14 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandler_GetAllProduce(t *testing.T) {
@@ -174,7 +180,7 @@ func Test_Handlers(t *testing.T) {
 					t.Fail()
 				}
 			case "@12T-4GH7-QPL9-3N4M":
-				if x.Status != "400 item code is invalid" && x.StatusCode == 400 {
+				if x.Status != "400: item code is invalid" && x.StatusCode == 400 {
 					t.Logf("%s  ::  %s", x.Status, x.Produce.Code)
 					t.Fail()
 				}
@@ -227,3 +233,367 @@ func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io
 
 	return resp, string(respBody)
 }
+
+func Test_handlerErrorLogger(t *testing.T) {
+	a := assert.New(t)
+	logger, hook := test.NewNullLogger()
+	r := httptest.NewRequest("GET", "/api/v1/produce", nil)
+	r.Header.Set("Authorization", "Bearer secret-token")
+	r.Header.Set(APIKeyHeader, "secret-key")
+	r.Header.Set(TenantHeader, "secret-tenant")
+	r.Header.Set("Accept", "application/json")
+
+	handlerErrorLogger(r, errors.New("boom"), logger)
+	msg := hook.LastEntry().Message
+	a.NotContains(msg, "secret")
+	a.Contains(msg, "application/json")
+	a.Contains(msg, "REDACTED")
+	a.Equal("secret-key", r.Header.Get(APIKeyHeader))
+}
+
+func TestHandler_AddProduceOrder(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	// build a payload large enough that the workers will finish out of order, including a
+	// repeated code so the two rows can only be told apart by index
+	var items []ProduceItem
+	for i := 0; i < 50; i++ {
+		items = append(items, ProduceItem{Name: "item", Code: ProduceCode(fmt.Sprintf("%04d-AAAA-BBBB-CCCC", i)), UnitPrice: 1.00})
+	}
+	items = append(items, ProduceItem{Name: "item", Code: "0000-AAAA-BBBB-CCCC", UnitPrice: 1.00})
+	payload, err := json.Marshal(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr, body := testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBuffer(payload))
+	if rr.StatusCode != 200 {
+		t.Fatalf("%s  ::   %s", rr.Status, body)
+	}
+	var ar AddResults
+	if err := json.Unmarshal([]byte(body), &ar); err != nil {
+		t.Fatal(err)
+	}
+	if len(ar.Results) != len(items) {
+		t.Fatalf("expected %d results got %d", len(items), len(ar.Results))
+	}
+	for i, x := range ar.Results {
+		if x.Index != i || x.Produce.Code != items[i].Code {
+			t.Errorf("result %d: got index %d code %s", i, x.Index, x.Produce.Code)
+		}
+	}
+
+	// the items are written in request order so the first of the repeated rows is added
+	if ar.Results[0].StatusCode != 201 || ar.Results[len(items)-1].StatusCode != 409 {
+		t.Errorf("expected the first repeated row to be added and the second to conflict")
+	}
+
+	// unordered still returns every index exactly once
+	rr, body = testRequest(t, ts, "POST", "/api/v1/produce?unordered=true", bytes.NewBuffer(payload))
+	if rr.StatusCode != 200 {
+		t.Fatalf("%s  ::   %s", rr.Status, body)
+	}
+	ar = AddResults{}
+	if err := json.Unmarshal([]byte(body), &ar); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int]bool{}
+	for _, x := range ar.Results {
+		seen[x.Index] = true
+	}
+	if len(seen) != len(items) {
+		t.Errorf("expected %d distinct indexes got %d", len(items), len(seen))
+	}
+
+	if rr, body := testRequest(t, ts, "POST", "/api/v1/produce?unordered=maybe", bytes.NewBuffer(payload)); rr.StatusCode != 400 {
+		t.Logf("%s  ::   %s", rr.Status, body)
+		t.Fail()
+	}
+}
+
+func TestHandler_AddProduceUnorderedStreams(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+
+	// hold the second item in the pipeline until the first result has been read
+	release := make(chan struct{})
+	h.UseStages(NewValidationStage(http.StatusInternalServerError, func(p ProduceItem) error {
+		if p.Name == "Slow" {
+			<-release
+		}
+		return nil
+	}))
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	payload := `[
+		{"produce_name":"Fast","produce_code":"FAST-0000-0000-0001","produce_unit_price":1.00},
+		{"produce_name":"Slow","produce_code":"SLOW-0000-0000-0001","produce_unit_price":1.00}]`
+	first := make(chan AddResult)
+	var dec *json.Decoder
+	go func() {
+		defer close(first)
+		resp, err := http.Post(ts.URL+"/api/v1/produce?unordered=true", "application/json", strings.NewReader(payload))
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		dec = json.NewDecoder(resp.Body)
+		for i := 0; i < 3; i++ {
+			if _, err := dec.Token(); err != nil {
+				return
+			}
+		}
+		var x AddResult
+		if dec.Decode(&x) == nil {
+			first <- x
+		}
+	}()
+	select {
+	case x := <-first:
+		if x.Index != 0 || x.StatusCode != 201 {
+			t.Errorf("expected the fast item first, got %d %q", x.Index, x.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the first result wasn't sent before the last item was done")
+	}
+	close(release)
+	<-first
+	if dec == nil {
+		t.Fatal("the request failed")
+	}
+
+	var x AddResult
+	if err := dec.Decode(&x); err != nil || x.Index != 1 || x.StatusCode != 201 {
+		t.Errorf("expected the slow item second, got %d %q %v", x.Index, x.Status, err)
+	}
+}
+
+func TestHandler_ValidateProduce(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	payload := `[
+		{"produce_name":"Kiwi","produce_code":"K1W1-4GH7-QPL9-3N4M","produce_unit_price":0.555},
+		{"produce_name":"Peach","produce_code":"E5T6-9UI3-TH15-QR88","produce_unit_price":2.99},
+		{"produce_name":"Kiwi Again","produce_code":"k1w1-4gh7-qpl9-3n4m","produce_unit_price":0.50},
+		{"produce_name":"Inv@lidName","produce_code":"A13T-4GH7-QPL9-3N4M","produce_unit_price":3.46}]`
+	expected := []struct {
+		code   int
+		status string
+	}{
+		{201, "201: would be added"},
+		{409, "409: item already exists"},
+		{409, "409: item already exists"},
+		{400, "400: item name is invalid"},
+	}
+
+	for _, path := range []string{"/api/v1/produce/validate", "/api/v1/produce?dry_run=true"} {
+		rr, body := testRequest(t, ts, "POST", path, bytes.NewBuffer([]byte(payload)))
+		if rr.StatusCode != 200 {
+			t.Fatalf("%s: %s  ::   %s", path, rr.Status, body)
+		}
+		var ar AddResults
+		if err := json.Unmarshal([]byte(body), &ar); err != nil {
+			t.Fatal(err)
+		}
+		if len(ar.Results) != len(expected) {
+			t.Fatalf("%s: expected %d results got %d", path, len(expected), len(ar.Results))
+		}
+		for i, e := range expected {
+			if ar.Results[i].StatusCode != e.code || ar.Results[i].Status != e.status {
+				t.Errorf("%s: index %d got %d %q", path, i, ar.Results[i].StatusCode, ar.Results[i].Status)
+			}
+		}
+		if ar.Results[0].Produce.UnitPrice != 0.56 {
+			t.Errorf("%s: expected unit price to be rounded got %v", path, ar.Results[0].Produce.UnitPrice)
+		}
+	}
+
+	// nothing was written
+	if len(db.List()) != 4 {
+		t.Errorf("expected the database to be untouched, got %d items", len(db.List()))
+	}
+}
+
+func TestHandler_ValidateProduceMatchesAdd(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetUniqueNames(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMaxItems(7); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	// items that only clash with each other, on PLU, on name and on the quota
+	payload := `[
+		{"produce_name":"Banana","produce_code":"BANA-0000-0000-0001","produce_unit_price":0.25,"plu":"4011"},
+		{"produce_name":"Plantain","produce_code":"PLAN-0000-0000-0001","produce_unit_price":0.45,"plu":"4011"},
+		{"produce_name":"Mango","produce_code":"MANG-0000-0000-0001","produce_unit_price":1.50},
+		{"produce_name":"mango","produce_code":"MANG-0000-0000-0002","produce_unit_price":1.50},
+		{"produce_name":"Papaya","produce_code":"PAPA-0000-0000-0001","produce_unit_price":2.50},
+		{"produce_name":"Guava","produce_code":"GUAV-0000-0000-0001","produce_unit_price":0.75}]`
+	statuses := func(path string) []string {
+		rr, body := testRequest(t, ts, "POST", path, bytes.NewBufferString(payload))
+		if rr.StatusCode != 200 {
+			t.Fatalf("%s: %s  ::   %s", path, rr.Status, body)
+		}
+		var ar AddResults
+		if err := json.Unmarshal([]byte(body), &ar); err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, x := range ar.Results {
+			s = append(s, strings.Replace(x.Status, "would be ", "", 1))
+		}
+		return s
+	}
+
+	dryRun := statuses("/api/v1/produce?dry_run=true")
+	if db.Count() != 4 {
+		t.Errorf("expected the dry run to leave the database alone, it holds %d items", db.Count())
+	}
+	added := statuses("/api/v1/produce")
+	if strings.Join(dryRun, "|") != strings.Join(added, "|") {
+		t.Errorf("dry run reported\n%v\nbut adding reported\n%v", dryRun, added)
+	}
+	for i, want := range []string{"201", "409", "201", "409", "201", "403"} {
+		if !strings.HasPrefix(added[i], want) {
+			t.Errorf("index %d got %q want %s", i, added[i], want)
+		}
+	}
+}
+
+func TestHandler_AddProduceOnConflict(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	payload := `[
+		{"produce_name":"Lettuce","produce_code":"A12T-4GH7-QPL9-3N4M","produce_unit_price":3.46},
+		{"produce_name":"Peach","produce_code":"E5T6-9UI3-TH15-QR88","produce_unit_price":3.10},
+		{"produce_name":"Kiwi","produce_code":"K1W1-4GH7-QPL9-3N4M","produce_unit_price":0.50}]`
+
+	tests := []struct {
+		path     string
+		statuses []string
+		peach    float64
+	}{
+		{"/api/v1/produce?on_conflict=error&dry_run=true", []string{"409: item already exists", "409: item already exists", "201: would be added"}, 2.99},
+		{"/api/v1/produce/validate?on_conflict=skip", []string{"200: would be skipped", "200: would be skipped", "201: would be added"}, 2.99},
+		{"/api/v1/produce/validate?on_conflict=update", []string{"200: unchanged", "200: would be updated", "201: would be added"}, 2.99},
+		{"/api/v1/produce?on_conflict=skip", []string{"200: skipped", "200: skipped", "201: added"}, 2.99},
+		{"/api/v1/produce?on_conflict=update", []string{"200: unchanged", "200: updated", "200: unchanged"}, 3.10},
+	}
+	for _, tt := range tests {
+		rr, body := testRequest(t, ts, "POST", tt.path, bytes.NewBuffer([]byte(payload)))
+		if rr.StatusCode != 200 {
+			t.Fatalf("%s: %s  ::   %s", tt.path, rr.Status, body)
+		}
+		var ar AddResults
+		if err := json.Unmarshal([]byte(body), &ar); err != nil {
+			t.Fatal(err)
+		}
+		for i, status := range tt.statuses {
+			if ar.Results[i].Status != status {
+				t.Errorf("%s: index %d got %q want %q", tt.path, i, ar.Results[i].Status, status)
+			}
+		}
+		if p, _ := db.Get("E5T6-9UI3-TH15-QR88"); p.UnitPrice != tt.peach {
+			t.Errorf("%s: expected peach unit price %v got %v", tt.path, tt.peach, p.UnitPrice)
+		}
+	}
+
+	// the same code twice is written in request order, so the last one wins
+	twice := `[
+		{"produce_name":"Peach","produce_code":"E5T6-9UI3-TH15-QR88","produce_unit_price":3.20},
+		{"produce_name":"Peach","produce_code":"E5T6-9UI3-TH15-QR88","produce_unit_price":3.30}]`
+	for i := 0; i < 10; i++ {
+		if rr, body := testRequest(t, ts, "POST", "/api/v1/produce?on_conflict=update", bytes.NewBufferString(twice)); rr.StatusCode != 200 {
+			t.Fatalf("%s  ::   %s", rr.Status, body)
+		}
+		if p, _ := db.Get("E5T6-9UI3-TH15-QR88"); p.UnitPrice != 3.30 {
+			t.Errorf("expected the later peach to win, got unit price %v", p.UnitPrice)
+		}
+	}
+
+	if rr, body := testRequest(t, ts, "POST", "/api/v1/produce?on_conflict=replace", bytes.NewBuffer([]byte(payload))); rr.StatusCode != 400 {
+		t.Logf("%s  ::   %s", rr.Status, body)
+		t.Fail()
+	}
+}
+
+func TestHandler_AddProduceUniqueNames(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetUniqueNames(true); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	payload := `[{"produce_name":"gala apple","produce_code":"GALA-0000-0000-0001","produce_unit_price":1.00}]`
+	rr, body := testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(payload))
+	if rr.StatusCode != 200 || !strings.Contains(body, `"status_code":409,"status":"409: item name already exists"`) {
+		t.Errorf("%s  ::   %s", rr.Status, body)
+	}
+}
+
+func TestHandler_AddProduceMaxBulkItems(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	h.updateSettings(func(s *liveSettings) { s.maxBulkItems = 1 })
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	payload := `[{"produce_name":"Kiwi","produce_code":"KIWI-0000-0000-0001","produce_unit_price":1.00},
+		{"produce_name":"Plum","produce_code":"PLUM-0000-0000-0001","produce_unit_price":1.00}]`
+	for _, path := range []string{"/api/v1/produce", "/api/v1/produce/validate"} {
+		rr, body := testRequest(t, ts, "POST", path, bytes.NewBufferString(payload))
+		if rr.StatusCode != 413 || !strings.Contains(body, "at most 1 may be added") {
+			t.Errorf("%s %s  ::   %s", path, rr.Status, body)
+		}
+	}
+	if _, err := db.Get("KIWI-0000-0000-0001"); err == nil {
+		t.Error("items from a rejected request were added")
+	}
+
+	payload = `[{"produce_name":"Kiwi","produce_code":"KIWI-0000-0000-0001","produce_unit_price":1.00}]`
+	if rr, body := testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(payload)); rr.StatusCode != 200 {
+		t.Errorf("%s  ::   %s", rr.Status, body)
+	}
+}
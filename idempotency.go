@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// IdempotencyKeyHeader is the request header clients use to make POST and DELETE requests safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayHeader is set on responses that were replayed from the cache
+const IdempotentReplayHeader = "Idempotent-Replayed"
+
+// defaultIdempotencyTTL is how long responses are cached when no window is configured
+const defaultIdempotencyTTL = 10 * time.Minute
+
+// idempotencyMaxEntries is how many responses are cached at once.  When the cache is full the
+// response closest to expiring is dropped to make room.
+const idempotencyMaxEntries = 100000
+
+// IdempotencyCache caches the full response to POST and DELETE requests sent with an Idempotency-Key
+// header.  A retry with the same key and body within the ttl window gets the cached response instead
+// of running the handler again.  Reusing a key with a different body is rejected with a 422.
+type IdempotencyCache struct {
+	// ttl is how long a response is kept after the original request completes
+	ttl time.Duration
+	// entries holds the cached responses keyed by tenant, principal, method, path, query and
+	// idempotency key
+	entries map[string]*idempotentResponse
+	// expiring holds the keys of completed entries in the order they expire.  Every entry has the
+	// same ttl so this is the order they completed in.
+	expiring []expiringKey
+	// maxEntries is how many entries, completed or in progress, are kept at once
+	maxEntries int
+	// mtx is a mutex used to lock and unlock entries to ensure concurrent safety.
+	mtx *sync.Mutex
+	// now returns the current time and can be swapped out in tests
+	now func() time.Time
+}
+
+// idempotentResponse is a single cached response
+type idempotentResponse struct {
+	// bodyHash is the sha256 of the original request body
+	bodyHash [sha256.Size]byte
+	// done is false while the original request is still being handled
+	done bool
+	// expires is when the entry can be dropped from the cache
+	expires    time.Time
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// expiringKey is a completed entry's cache key and when it expires
+type expiringKey struct {
+	key     string
+	expires time.Time
+}
+
+// NewIdempotencyCache returns an empty cache that keeps responses for the ttl window
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		ttl:        ttl,
+		entries:    map[string]*idempotentResponse{},
+		maxEntries: idempotencyMaxEntries,
+		mtx:        &sync.Mutex{},
+		now:        time.Now,
+	}
+}
+
+// Middleware replays cached responses for retried POST and DELETE requests.  Requests without an
+// Idempotency-Key header, and all other methods, are passed straight through.  When the cache is
+// full of requests still in progress new keys get a 503.
+// Responses that aren't cacheable and requests whose handler panics are not cached so the client can
+// retry them.
+func (c *IdempotencyCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), decodeErrorStatus(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		// the tenant is part of the key so tenants selected by header can't replay each other's
+		// responses, and the query so a dry run and a real run don't replay each other's
+		cacheKey := tenantID(r.Context()) + " " + principalID(r.Context()) + " " + r.Method + " " + r.URL.RequestURI() + " " + key
+
+		c.mtx.Lock()
+		c.purgeExpired()
+		if cached, ok := c.entries[cacheKey]; ok {
+			c.mtx.Unlock()
+			switch {
+			case cached.bodyHash != hash:
+				http.Error(w, "Idempotency-Key has already been used with a different payload", http.StatusUnprocessableEntity)
+			case !cached.done:
+				http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				for k, v := range cached.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set(IdempotentReplayHeader, "true")
+				w.WriteHeader(cached.statusCode)
+				w.Write(cached.body)
+			}
+			return
+		}
+		if len(c.entries) >= c.maxEntries && !c.evictOldest() {
+			c.mtx.Unlock()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many idempotent requests in progress, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		entry := &idempotentResponse{bodyHash: hash}
+		c.entries[cacheKey] = entry
+		c.mtx.Unlock()
+
+		// run the request, keeping a copy of everything written to the client
+		var buf bytes.Buffer
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(&buf)
+		// a handler that panics never completes its entry, drop it so the request can be retried
+		defer func() {
+			if p := recover(); p != nil {
+				c.mtx.Lock()
+				delete(c.entries, cacheKey)
+				c.mtx.Unlock()
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(ww, r)
+
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if !cacheable(ww.Status()) {
+			delete(c.entries, cacheKey)
+			return
+		}
+		entry.done = true
+		entry.expires = c.now().Add(c.ttl)
+		entry.statusCode = ww.Status()
+		if entry.statusCode == 0 {
+			entry.statusCode = http.StatusOK
+		}
+		entry.header = w.Header().Clone()
+		entry.body = buf.Bytes()
+		c.expiring = append(c.expiring, expiringKey{key: cacheKey, expires: entry.expires})
+	})
+}
+
+// cacheable reports whether a response with the status is kept for replay.  Server errors, and
+// rejections by the rate limiter or for the caller's credentials, don't say whether the request was
+// carried out, so a retry runs it again once the client has waited or fixed its credentials.
+func cacheable(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return status < http.StatusInternalServerError
+}
+
+// purgeExpired drops completed entries whose window has passed.  Only the expired entries at the
+// front of expiring are looked at.  The caller must hold mtx.
+func (c *IdempotencyCache) purgeExpired() {
+	now := c.now()
+	for len(c.expiring) > 0 && now.After(c.expiring[0].expires) {
+		c.evictOldest()
+	}
+}
+
+// evictOldest drops the completed entry closest to expiring, returning false when every entry is
+// still in progress.  The caller must hold mtx.
+func (c *IdempotencyCache) evictOldest() bool {
+	if len(c.expiring) == 0 {
+		return false
+	}
+	delete(c.entries, c.expiring[0].key)
+	c.expiring[0] = expiringKey{}
+	c.expiring = c.expiring[1:]
+	return true
+}
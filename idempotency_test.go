@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyCache_Middleware(t *testing.T) {
+	a := assert.New(t)
+
+	calls := 0
+	status := http.StatusCreated
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	c := NewIdempotencyCache(time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	mw := c.Middleware(next)
+
+	send := func(method, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/produce", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, req)
+		return w
+	}
+
+	// first request runs the handler
+	w := send(http.MethodPost, "key-1", "[1]")
+	a.Equal(http.StatusCreated, w.Code)
+	a.Equal(1, calls)
+	a.Empty(w.Header().Get(IdempotentReplayHeader))
+
+	// retry with the same key and body is replayed
+	w = send(http.MethodPost, "key-1", "[1]")
+	a.Equal(http.StatusCreated, w.Code)
+	a.Equal(`{"ok":true}`, w.Body.String())
+	a.Equal("application/json", w.Header().Get("content-type"))
+	a.Equal("true", w.Header().Get(IdempotentReplayHeader))
+	a.Equal(1, calls)
+
+	// same key with a different body is rejected
+	w = send(http.MethodPost, "key-1", "[2]")
+	a.Equal(http.StatusUnprocessableEntity, w.Code)
+	a.Equal(1, calls)
+
+	// no key, or a method that is already idempotent, is passed through
+	send(http.MethodPost, "", "[1]")
+	send(http.MethodGet, "key-1", "")
+	a.Equal(3, calls)
+
+	// once the window passes the key can be used again
+	now = now.Add(2 * time.Minute)
+	w = send(http.MethodPost, "key-1", "[2]")
+	a.Equal(http.StatusCreated, w.Code)
+	a.Equal(4, calls)
+
+	// server errors are not cached
+	status = http.StatusInternalServerError
+	send(http.MethodDelete, "key-2", "")
+	send(http.MethodDelete, "key-2", "")
+	a.Equal(6, calls)
+
+	// neither are rate limit or credential rejections
+	status = http.StatusTooManyRequests
+	send(http.MethodDelete, "key-4", "")
+	status = http.StatusForbidden
+	send(http.MethodDelete, "key-4", "")
+	a.Equal(8, calls)
+
+	// the query is part of the key, so a dry run isn't replayed for the real request
+	status = http.StatusCreated
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/produce?dry_run=true", bytes.NewBufferString("[3]"))
+	req.Header.Set(IdempotencyKeyHeader, "key-3")
+	mw.ServeHTTP(httptest.NewRecorder(), req)
+	w = send(http.MethodPost, "key-3", "[3]")
+	a.Empty(w.Header().Get(IdempotentReplayHeader))
+	a.Equal(10, calls)
+}
+
+func TestIdempotencyCache_MiddlewarePanic(t *testing.T) {
+	a := assert.New(t)
+
+	calls := 0
+	mw := NewIdempotencyCache(time.Minute).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	send := func() (w *httptest.ResponseRecorder, panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/produce", bytes.NewBufferString("[1]"))
+		req.Header.Set(IdempotencyKeyHeader, "key-1")
+		w = httptest.NewRecorder()
+		mw.ServeHTTP(w, req)
+		return w, false
+	}
+
+	// the panic is passed on and the retry runs the handler rather than being told it is in progress
+	_, panicked := send()
+	a.True(panicked)
+	w, panicked := send()
+	a.False(panicked)
+	a.Equal(http.StatusCreated, w.Code)
+	a.Equal(2, calls)
+}
+
+func TestIdempotencyCache_MaxEntries(t *testing.T) {
+	a := assert.New(t)
+
+	calls := 0
+	release := make(chan struct{})
+	c := NewIdempotencyCache(time.Minute)
+	c.maxEntries = 2
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mw := c.Middleware(next)
+	send := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString("[1]"))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, req)
+		return w
+	}
+
+	// a full cache drops the oldest response to make room
+	send("/fast", "key-1")
+	send("/fast", "key-2")
+	send("/fast", "key-3")
+	a.Len(c.entries, 2)
+	a.Equal("true", send("/fast", "key-3").Header().Get(IdempotentReplayHeader))
+	a.Empty(send("/fast", "key-1").Header().Get(IdempotentReplayHeader))
+	a.Equal(4, calls)
+
+	// when every entry is still in progress new keys are turned away
+	c = NewIdempotencyCache(time.Minute)
+	c.maxEntries = 1
+	mw = c.Middleware(next)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send("/slow", "key-4")
+	}()
+	for {
+		c.mtx.Lock()
+		n := len(c.entries)
+		c.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a.Equal(http.StatusServiceUnavailable, send("/fast", "key-5").Code)
+	close(release)
+	<-done
+	a.Equal(http.StatusCreated, send("/fast", "key-5").Code)
+}
+
+func TestIdempotencyCache_Router(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = 1
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	post := func(key, payload string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/produce", bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(IdempotencyKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		return resp, buf.String()
+	}
+
+	payload := `[{"produce_name":"Lettuce","produce_code":"A12T-4GH7-QPL9-3N4M","produce_unit_price":3.46}]`
+	_, first := post("abc", payload)
+	rr, retry := post("abc", payload)
+
+	// the retry gets the original 201 result rather than a 409
+	if first != retry || rr.Header.Get(IdempotentReplayHeader) != "true" {
+		t.Errorf("expected replayed response got %s", retry)
+	}
+}
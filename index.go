@@ -0,0 +1,75 @@
+package main
+
+// secondaryIndex is a lookup structure kept in sync with the items in the database.
+// Every write to DB.Produce goes through DB.insert, DB.replace and DB.remove which keep
+// all registered indexes up to date.  All methods are called with the DB mutex held.
+type secondaryIndex interface {
+	// check returns an error if p can't be stored because it conflicts with an item
+	// that has a different code.  Conflicts with the item p replaces are ignored.
+	check(p *ProduceItem) error
+	// insert adds p to the index
+	insert(p *ProduceItem)
+	// remove drops p from the index
+	remove(p *ProduceItem)
+}
+
+// cloneableIndex is a secondaryIndex that can be copied, see DB.sandbox.  Indexes whose check
+// never fails, such as the search indexes, don't implement it.
+type cloneableIndex interface {
+	secondaryIndex
+	// clone returns a copy of the index that shares no mutable state with it
+	clone() secondaryIndex
+}
+
+// uniqueIndex maps a key derived from each produce item to the item's code and rejects
+// a second item with the same key.  Items with an empty key are not indexed.
+type uniqueIndex struct {
+	// key returns the value to index the produce item under
+	key func(p *ProduceItem) string
+	// err is returned by check when the key is already taken
+	err error
+	// codes maps each key to the code of the item that owns it
+	codes map[string]ProduceCode
+}
+
+// newUniqueIndex returns an empty index over key that rejects duplicates with err
+func newUniqueIndex(key func(p *ProduceItem) string, err error) *uniqueIndex {
+	return &uniqueIndex{key: key, err: err, codes: map[string]ProduceCode{}}
+}
+
+func (u *uniqueIndex) check(p *ProduceItem) error {
+	k := u.key(p)
+	if k == "" {
+		return nil
+	}
+	if code, ok := u.codes[k]; ok && code != p.Code {
+		return u.err
+	}
+	return nil
+}
+
+func (u *uniqueIndex) insert(p *ProduceItem) {
+	if k := u.key(p); k != "" {
+		u.codes[k] = p.Code
+	}
+}
+
+func (u *uniqueIndex) remove(p *ProduceItem) {
+	if k := u.key(p); k != "" && u.codes[k] == p.Code {
+		delete(u.codes, k)
+	}
+}
+
+func (u *uniqueIndex) clone() secondaryIndex {
+	c := &uniqueIndex{key: u.key, err: u.err, codes: make(map[string]ProduceCode, len(u.codes))}
+	for k, code := range u.codes {
+		c.codes[k] = code
+	}
+	return c
+}
+
+// get returns the code of the item indexed under k
+func (u *uniqueIndex) get(k string) (ProduceCode, bool) {
+	code, ok := u.codes[k]
+	return code, ok
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for bearer tokens that are malformed, badly signed, expired, or
+// issued for someone else
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+// jwtLeeway allows for clock skew between the token issuer and this server
+const jwtLeeway = 30 * time.Second
+
+// JWTVerifier checks HS256 and RS256 signed json web tokens and maps their claims to a Principal.
+// HS256 tokens are checked against shared secrets and RS256 tokens against RSA public keys, both
+// looked up by the kid header.  A token may only use an algorithm a key is configured for.
+type JWTVerifier struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+	// issuer and audience, when set, must match the iss and aud claims
+	issuer   string
+	audience string
+	// roleClaim names the claim holding the caller's roles, a string or an array of strings
+	roleClaim string
+	// roleMap maps claim values to roles.  When it is empty claim values are used as role names,
+	// otherwise values that aren't mapped grant no role.
+	roleMap map[string]Role
+	now     func() time.Time
+}
+
+// JWTConfig holds the settings NewJWTVerifier builds a verifier from
+type JWTConfig struct {
+	// HS256Secret is a shared secret for HS256 tokens without a kid
+	HS256Secret string `yaml:"hs256_secret"`
+	// JWKSFile is the path of a json web key set of RSA public keys for RS256 tokens, and
+	// optionally oct secrets for HS256 tokens
+	JWKSFile string `yaml:"jwks_file"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// RoleClaim defaults to roles
+	RoleClaim string `yaml:"role_claim"`
+	// RoleMap maps claim values to roles, e.g. "produce-admins=admin,produce-staff=editor".  When
+	// set only mapped values grant a role.
+	RoleMap string `yaml:"role_map"`
+}
+
+// NewJWTVerifier builds a verifier from the config.  A config with neither a secret nor a JWKS
+// file turns bearer tokens off and returns a nil verifier.
+func NewJWTVerifier(c JWTConfig) (*JWTVerifier, error) {
+	if c.HS256Secret == "" && c.JWKSFile == "" {
+		return nil, nil
+	}
+
+	v := &JWTVerifier{
+		hmacKeys:  map[string][]byte{},
+		rsaKeys:   map[string]*rsa.PublicKey{},
+		issuer:    c.Issuer,
+		audience:  c.Audience,
+		roleClaim: c.RoleClaim,
+		now:       time.Now,
+	}
+	if v.roleClaim == "" {
+		v.roleClaim = "roles"
+	}
+	if c.HS256Secret != "" {
+		v.hmacKeys[""] = []byte(c.HS256Secret)
+	}
+	if c.JWKSFile != "" {
+		if err := v.loadJWKS(c.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if v.roleMap, err = parseRoleMap(c.RoleMap); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parseRoleMap reads comma separated claim=role pairs
+func parseRoleMap(s string) (map[string]Role, error) {
+	roleMap := map[string]Role{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		claim, role, ok := strings.Cut(pair, "=")
+		if !ok || roleRank[Role(strings.TrimSpace(role))] == 0 {
+			return nil, fmt.Errorf("invalid role mapping %q, expected claim=viewer|editor|admin", pair)
+		}
+		roleMap[strings.TrimSpace(claim)] = Role(strings.TrimSpace(role))
+	}
+	return roleMap, nil
+}
+
+// jwk is a single key in a json web key set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// N and E are the RSA modulus and exponent
+	N string `json:"n"`
+	E string `json:"e"`
+	// K is the oct secret
+	K string `json:"k"`
+}
+
+// minRSAKeyBits is the smallest RSA modulus accepted for RS256 keys
+const minRSAKeyBits = 2048
+
+// loadJWKS adds the signing keys in the json web key set file to the verifier
+func (v *JWTVerifier) loadJWKS(path string) error {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(dat, &set); err != nil {
+		return fmt.Errorf("reading jwks file %s: %w", path, err)
+	}
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return fmt.Errorf("jwks key %q has an invalid modulus", k.Kid)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return fmt.Errorf("jwks key %q has an invalid exponent", k.Kid)
+			}
+			key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			if bits := key.N.BitLen(); bits < minRSAKeyBits {
+				return fmt.Errorf("jwks key %q is %d bits, at least %d are required", k.Kid, bits, minRSAKeyBits)
+			}
+			v.rsaKeys[k.Kid] = key
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return fmt.Errorf("jwks key %q has an invalid secret", k.Kid)
+			}
+			v.hmacKeys[k.Kid] = secret
+		}
+	}
+	if len(v.rsaKeys) == 0 && len(v.hmacKeys) == 0 {
+		return fmt.Errorf("jwks file %s has no RSA or oct signing keys", path)
+	}
+	return nil
+}
+
+// jwtHeader is the decoded first part of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// lookupKey returns the key for kid from keys.  A token without a kid may use the only key
+// configured for its algorithm.
+func lookupKey[K any](keys map[string]K, kid string) (K, bool) {
+	if k, ok := keys[kid]; ok {
+		return k, true
+	}
+	var zero K
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, true
+		}
+	}
+	return zero, false
+}
+
+// Verify checks the signature and claims of the token and returns the caller it identifies by the
+// sub claim, which must be set.  Every failure returns an error wrapping ErrInvalidToken.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	switch header.Alg {
+	case "HS256":
+		secret, ok := lookupKey(v.hmacKeys, header.Kid)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown key", ErrInvalidToken)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	case "RS256":
+		key, ok := lookupKey(v.rsaKeys, header.Kid)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown key", ErrInvalidToken)
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidToken)
+	}
+	return &Principal{Subject: sub, Role: v.role(claims[v.roleClaim]), Source: "jwt"}, nil
+}
+
+// decodeJWTPart base64url decodes a token part and unmarshals the json into v
+func decodeJWTPart(part string, v interface{}) error {
+	dat, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(dat, v); err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	return nil
+}
+
+// checkClaims checks the token is in date and was issued by, and for, who the verifier expects.
+// Tokens must carry an exp claim.
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	now := v.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp", ErrInvalidToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+	if v.audience != "" && !claimContains(claims["aud"], v.audience) {
+		return fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	}
+	return nil
+}
+
+// claimContains reports whether a string or array of strings claim holds s
+func claimContains(claim interface{}, s string) bool {
+	for _, c := range claimStrings(claim) {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings returns a string or array of strings claim as a slice
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		var ss []string
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+// role returns the highest role granted by the role claim, or no role if none of its values
+// map to one.  Without a role map the values are taken as role names, with one only mapped values
+// count, so an identity provider group that happens to be called admin grants nothing.
+func (v *JWTVerifier) role(claim interface{}) Role {
+	var best Role
+	for _, c := range claimStrings(claim) {
+		r, ok := v.roleMap[c]
+		if !ok && len(v.roleMap) == 0 {
+			r = Role(c)
+		}
+		if roleRank[r] > roleRank[best] {
+			best = r
+		}
+	}
+	return best
+}
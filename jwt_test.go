@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signJWT returns a token with the header and claims, signed with an HS256 secret ([]byte) or an
+// RS256 key (*rsa.PrivateKey)
+func signJWT(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		dat, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(dat)
+	}
+	signed := enc(header) + "." + enc(claims)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeJWKS writes a json web key set holding the public half of key to a temp file
+func writeJWKS(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	set := map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	dat, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, dat, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	a := assert.New(t)
+
+	v, err := NewJWTVerifier(JWTConfig{})
+	a.NoError(err)
+	a.Nil(v)
+
+	_, err = NewJWTVerifier(JWTConfig{JWKSFile: filepath.Join(t.TempDir(), "missing.json")})
+	a.Error(err)
+
+	empty := filepath.Join(t.TempDir(), "jwks.json")
+	a.NoError(os.WriteFile(empty, []byte(`{"keys": []}`), 0o600))
+	_, err = NewJWTVerifier(JWTConfig{JWKSFile: empty})
+	a.Error(err)
+
+	// RSA keys under 2048 bits are rejected
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	a.NoError(err)
+	_, err = NewJWTVerifier(JWTConfig{JWKSFile: writeJWKS(t, "weak", weak)})
+	if a.Error(err) {
+		a.Contains(err.Error(), "1024 bits")
+	}
+
+	_, err = NewJWTVerifier(JWTConfig{HS256Secret: "s", RoleMap: "staff=owner"})
+	a.Error(err)
+	v, err = NewJWTVerifier(JWTConfig{HS256Secret: "s", RoleMap: "staff=editor, ops=admin"})
+	a.NoError(err)
+	a.Equal(map[string]Role{"staff": RoleEditor, "ops": RoleAdmin}, v.roleMap)
+	a.Equal("roles", v.roleClaim)
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewJWTVerifier(JWTConfig{
+		HS256Secret: string(secret),
+		JWKSFile:    writeJWKS(t, "sso-1", rsaKey),
+		Issuer:      "https://sso.example.com",
+		Audience:    "big-produce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	v.now = func() time.Time { return now }
+
+	hs := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs := map[string]interface{}{"alg": "RS256", "kid": "sso-1"}
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "jo", "iss": "https://sso.example.com", "aud": "big-produce",
+			"exp": now.Add(time.Hour).Unix(), "roles": []string{"editor"},
+		}
+		for k, val := range extra {
+			if val == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = val
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  *Principal
+	}{
+		{"hs256", signJWT(t, hs, claims(nil), secret), &Principal{Subject: "jo", Role: RoleEditor, Source: "jwt"}},
+		{"rs256", signJWT(t, rs, claims(nil), rsaKey), &Principal{Subject: "jo", Role: RoleEditor, Source: "jwt"}},
+		{"single role", signJWT(t, hs, claims(map[string]interface{}{"roles": "viewer"}), secret), &Principal{Subject: "jo", Role: RoleViewer, Source: "jwt"}},
+		{"unknown role", signJWT(t, hs, claims(map[string]interface{}{"roles": "owner"}), secret), &Principal{Subject: "jo", Source: "jwt"}},
+		{"audience list", signJWT(t, hs, claims(map[string]interface{}{"aud": []string{"other", "big-produce"}}), secret), &Principal{Subject: "jo", Role: RoleEditor, Source: "jwt"}},
+		{"within leeway", signJWT(t, hs, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}), secret), &Principal{Subject: "jo", Role: RoleEditor, Source: "jwt"}},
+		{"expired", signJWT(t, hs, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), secret), nil},
+		{"no exp", signJWT(t, hs, claims(map[string]interface{}{"exp": nil}), secret), nil},
+		{"no sub", signJWT(t, hs, claims(map[string]interface{}{"sub": nil}), secret), nil},
+		{"empty sub", signJWT(t, hs, claims(map[string]interface{}{"sub": ""}), secret), nil},
+		{"not yet valid", signJWT(t, hs, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), secret), nil},
+		{"wrong issuer", signJWT(t, hs, claims(map[string]interface{}{"iss": "https://evil.example.com"}), secret), nil},
+		{"wrong audience", signJWT(t, hs, claims(map[string]interface{}{"aud": "other"}), secret), nil},
+		{"wrong secret", signJWT(t, hs, claims(nil), []byte("guess")), nil},
+		{"wrong rsa key", signJWT(t, rs, claims(nil), otherKey), nil},
+		{"unknown kid", signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "sso-2"}, claims(nil), rsaKey), nil},
+		{"alg none", signJWT(t, map[string]interface{}{"alg": "none"}, claims(nil), secret), nil},
+		{"malformed", "not.a.token", nil},
+		{"two parts", "abc.def", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.Verify(tt.token)
+			if tt.want == nil {
+				assert.ErrorIs(t, err, ErrInvalidToken)
+				assert.Nil(t, p)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, p)
+		})
+	}
+
+	// with a role map only mapped claim values grant a role
+	mapped, err := NewJWTVerifier(JWTConfig{HS256Secret: string(secret), RoleMap: "produce-admins=admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped.now = v.now
+	p, err := mapped.Verify(signJWT(t, hs, claims(map[string]interface{}{"roles": []string{"viewer", "produce-admins"}}), secret))
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "jo", Role: RoleAdmin, Source: "jwt"}, p)
+	p, err = mapped.Verify(signJWT(t, hs, claims(map[string]interface{}{"roles": []string{"admin", "editor"}}), secret))
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "jo", Source: "jwt"}, p)
+
+	// an RS256 only verifier must not accept HS256 tokens signed with its public key
+	rsOnly, err := NewJWTVerifier(JWTConfig{JWKSFile: writeJWKS(t, "sso-1", rsaKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rsOnly.Verify(signJWT(t, hs, claims(nil), rsaKey.PublicKey.N.Bytes()))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// unixPrefix marks a listen address as a unix domain socket path
+const unixPrefix = "unix:"
+
+// AddressList is a list of listen addresses, read from a YAML sequence or a comma separated string
+type AddressList []string
+
+// UnmarshalYAML reads a sequence of addresses, or a single string of comma separated ones
+func (l *AddressList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.SequenceNode {
+		return n.Decode((*[]string)(l))
+	}
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	*l = splitList(s)
+	return nil
+}
+
+// splitList splits a comma separated list, dropping blank items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ListenAddr is a network and address to listen on, as passed to net.Listen
+type ListenAddr struct {
+	Network string
+	Address string
+}
+
+// String returns the address as it is written in the config
+func (a ListenAddr) String() string {
+	if a.Network == "unix" {
+		return unixPrefix + a.Address
+	}
+	return a.Address
+}
+
+// parseListenAddr reads a configured listen address.  It is one of
+//   - unix:/path/to/socket, a unix domain socket
+//   - host or host:port, where host is an IPv4 address, a hostname or empty for every interface
+//   - an IPv6 address, bare or in brackets, optionally [v6]:port
+//
+// Addresses without a port use the port given.
+func parseListenAddr(s string, port int) (ListenAddr, error) {
+	if path, ok := strings.CutPrefix(s, unixPrefix); ok {
+		if path == "" {
+			return ListenAddr{}, fmt.Errorf("address %q has no socket path", s)
+		}
+		return ListenAddr{Network: "unix", Address: path}, nil
+	}
+
+	host, portStr := s, strconv.Itoa(port)
+	switch {
+	case net.ParseIP(s) != nil:
+		// a bare IP address, the colons of an IPv6 one aren't a port
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		host = s[1 : len(s)-1]
+	case strings.Contains(s, ":"):
+		var err error
+		if host, portStr, err = net.SplitHostPort(s); err != nil {
+			return ListenAddr{}, fmt.Errorf("address %q is not host, host:port or an IPv6 address", s)
+		}
+		if p, err := strconv.Atoi(portStr); err != nil || p < 1 || p > 65535 {
+			return ListenAddr{}, fmt.Errorf("address %q has a port that is not between 1 and 65535", s)
+		}
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case strings.HasPrefix(s, "[") && (ip == nil || ip.To4() != nil):
+		return ListenAddr{}, fmt.Errorf("address %q has brackets around something other than an IPv6 address", s)
+	case host != "" && ip == nil && !validHostname(host):
+		return ListenAddr{}, fmt.Errorf("address %q is not an IP address or hostname", s)
+	}
+	return ListenAddr{Network: "tcp", Address: net.JoinHostPort(host, portStr)}, nil
+}
+
+// validHostname reports whether s is a hostname of dot separated letters, digits and hyphens.
+// The last label can't start with a digit, so mistyped IPv4 addresses such as 999.1.1.1 or
+// 10.0.0.1abc aren't taken for hostnames.
+func validHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	last := labels[len(labels)-1]
+	return last[0] < '0' || last[0] > '9'
+}
+
+// listenAll listens on every address.  A socket file nothing is accepting connections on, left
+// by an earlier run, is removed first.  If any address can't be listened on the ones already opened are closed and its error,
+// which names the address, is returned.
+func listenAll(addrs []ListenAddr) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, a := range addrs {
+		if a.Network == "unix" {
+			if fi, err := os.Stat(a.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				if conn, err := net.Dial("unix", a.Address); err == nil {
+					conn.Close()
+				} else {
+					os.Remove(a.Address)
+				}
+			}
+		}
+		ln, err := net.Listen(a.Network, a.Address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func Test_parseListenAddr(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		want    string
+		wantErr bool
+	}{
+		{in: "", network: "tcp", want: ":8088"},
+		{in: ":9000", network: "tcp", want: ":9000"},
+		{in: "127.0.0.1", network: "tcp", want: "127.0.0.1:8088"},
+		{in: "127.0.0.1:9000", network: "tcp", want: "127.0.0.1:9000"},
+		{in: "::1", network: "tcp", want: "[::1]:8088"},
+		{in: "::", network: "tcp", want: "[::]:8088"},
+		{in: "[::1]", network: "tcp", want: "[::1]:8088"},
+		{in: "[2001:db8::1]:9000", network: "tcp", want: "[2001:db8::1]:9000"},
+		{in: "localhost", network: "tcp", want: "localhost:8088"},
+		{in: "api.big-produce.example.com:9000", network: "tcp", want: "api.big-produce.example.com:9000"},
+		{in: "unix:/run/big-produce.sock", network: "unix", want: "/run/big-produce.sock"},
+		{in: "999.1.1.1abc", wantErr: true},
+		{in: "256.256.256.256", wantErr: true},
+		{in: "10.0.0", wantErr: true},
+		{in: "-bad.example.com", wantErr: true},
+		{in: "under_score.example.com", wantErr: true},
+		{in: "[localhost]", wantErr: true},
+		{in: "[127.0.0.1]:9000", wantErr: true},
+		{in: "127.0.0.1:http", wantErr: true},
+		{in: "127.0.0.1:70000", wantErr: true},
+		{in: "localhost:", wantErr: true},
+		{in: "::1:9000:extra", wantErr: true},
+		{in: "unix:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseListenAddr(tt.in, 8088)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, ListenAddr{Network: tt.network, Address: tt.want}, got)
+		})
+	}
+}
+
+func TestAddressList_UnmarshalYAML(t *testing.T) {
+	a := assert.New(t)
+	var c struct {
+		One  AddressList `yaml:"one"`
+		Many AddressList `yaml:"many"`
+	}
+	a.NoError(yaml.Unmarshal([]byte("one: 127.0.0.1, ::1\nmany: [localhost, \"unix:/tmp/s.sock\"]\n"), &c))
+	a.Equal(AddressList{"127.0.0.1", "::1"}, c.One)
+	a.Equal(AddressList{"localhost", "unix:/tmp/s.sock"}, c.Many)
+}
+
+func Test_listenAll(t *testing.T) {
+	a := assert.New(t)
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+	sock := filepath.Join(t.TempDir(), "big-produce.sock")
+	lns, err := listenAll([]ListenAddr{{Network: "tcp", Address: "127.0.0.1:0"}, {Network: "unix", Address: sock}})
+	if !a.NoError(err) {
+		return
+	}
+
+	logger := logrus.New()
+	logger.Level = 1
+	srv := &http.Server{Handler: LoadRouter(NewHandler(NewDB(logger), runtime.NumCPU(), logger))}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(ctx, srv, lns, defaultShutdownTimeout, func() error { return nil })
+	}()
+
+	// the same api is served on both
+	overUnix := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+	}}}
+	for client, url := range map[*http.Client]string{http.DefaultClient: "http://" + lns[0].Addr().String(), overUnix: "http://big-produce"} {
+		resp, err := client.Get(url + "/api/v1/produce")
+		if a.NoError(err) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			a.Equal(http.StatusOK, resp.StatusCode)
+		}
+	}
+	cancel()
+	a.NoError(<-stopped)
+
+	// a stale socket file is replaced, and an address in use is an error that closes the rest
+	stale, err := net.Listen("unix", sock)
+	a.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	lns, err = listenAll([]ListenAddr{{Network: "unix", Address: sock}})
+	a.NoError(err)
+	_, err = listenAll([]ListenAddr{{Network: "tcp", Address: "127.0.0.1:0"}, {Network: "unix", Address: sock}})
+	if a.Error(err) {
+		a.Contains(err.Error(), sock)
+	}
+	lns[0].Close()
+}
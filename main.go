@@ -1,59 +1,128 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"regexp"
-	"runtime"
-	"strconv"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
 
-	srv := getServer()
-	// start the server
-	if err := srv.ListenAndServe(); err != nil {
-		panic(err)
+	cfg, printConfig, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		fmt.Print(cfg)
+		return
 	}
 
-}
+	logger := loadLogger(cfg.LogLevel)
+	srv, h, err := getServer(cfg, logger)
+	if err != nil {
+		logger.Errorf("cannot start: %s", err)
+		os.Exit(1)
+	}
+	addrs, _ := cfg.ListenAddrs()
+	lns, err := listenAll(addrs)
+	if err != nil {
+		logger.Errorf("cannot listen: %s", err)
+		os.Exit(1)
+	}
+	for _, ln := range lns {
+		logger.Infof("listening on %s", ln.Addr())
+	}
 
-// getServer grabs the expected env variables, generates the logger instance,
-// the database, the router, and finally returns the server
-func getServer() http.Server {
-	// grab env vars for max procs and set maxProcs
-	maxProcsStr := os.Getenv("MAXPROCS")
-	maxProcs := loadMaxProcs(maxProcsStr)
+	// serve until SIGTERM or SIGINT, then let in-flight requests finish and flush before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 
-	// grab env var for log level and get a logger
-	logLevelStr := os.Getenv("LOGLEVEL")
-	logger := loadLogger(logLevelStr)
+	// reload the config on SIGHUP or when the config file changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go NewReloader(h, cfg, os.Args[1:], os.LookupEnv).Run(ctx, hup)
+	err = runServer(ctx, srv, lns, time.Duration(cfg.ShutdownTimeout), h.Flush)
+	stop()
+	if err != nil {
+		logger.Errorf("server stopped: %s", err)
+		os.Exit(1)
+	}
 
-	addr := getSrvAddress(os.Getenv("ADDRESS"), os.Getenv("PORT"))
+}
 
+// getServer generates the database, the router, and finally returns the server and its handler,
+// all set up from the validated config
+func getServer(cfg Config, logger *logrus.Logger) (*http.Server, *Handler, error) {
 	// setup db, handlers, and routes
 	var db *DB
 	var err error
 	if db, err = LoadDB(logger); err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	// the default records are loaded before the db is configured so they are not affected.
+	if err = configureDB(db, cfg); err != nil {
+		return nil, nil, err
+	}
+	// each tenant starts with an empty catalogue configured just like the shared one
+	tenants, err := LoadTenants(cfg.TenantsFile, func() (*DB, error) {
+		tdb := NewDB(logger)
+		return tdb, configureDB(tdb, cfg)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading tenants: %w", err)
+	}
+	h := NewHandler(db, cfg.MaxProcs, logger)
+	h.idempotency = NewIdempotencyCache(time.Duration(cfg.IdempotencyTTL))
+	h.tenants = tenants
+	if h.apiKeys, err = LoadAPIKeys(cfg.APIKeyFile, os.Stdout, logger); err != nil {
+		return nil, nil, fmt.Errorf("loading api keys: %w", err)
+	}
+	if h.jwt, err = NewJWTVerifier(cfg.JWT); err != nil {
+		return nil, nil, fmt.Errorf("setting up jwt: %w", err)
 	}
-	h := NewHandler(db, maxProcs, logger)
+	if h.clientCerts, err = NewClientCertAuth(cfg.TLS); err != nil {
+		return nil, nil, fmt.Errorf("setting up client certificates: %w", err)
+	}
+	tlsConfig, err := newTLSConfig(cfg.TLS, logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("setting up tls: %w", err)
+	}
+	if err = h.applyConfig(cfg); err != nil {
+		return nil, nil, err
+	}
+	h.maxBodyBytes = cfg.MaxBodyBytes
 	r := LoadRouter(h)
 
-	return http.Server{
-		Addr:        addr,
-		IdleTimeout: 5 * time.Second,
-		ErrorLog:    log.Default(),
-		Handler:     r,
-	}
+	return &http.Server{
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		TLSConfig:         tlsConfig,
+		ErrorLog:          log.Default(),
+		Handler:           r,
+	}, h, nil
+}
+
+// configureDB applies the code, name and uniqueness settings from the config to db
+func configureDB(db *DB, cfg Config) error {
+	db.SetRequireCheckChar(cfg.CodeCheckChar)
+	db.SetNamePolicy(cfg.NamePolicy())
+	return db.SetUniqueNames(cfg.UniqueNames)
 }
 
 // LoadDB grabs a new database and fills it with the required produce items
@@ -77,92 +146,147 @@ func LoadDB(l *logrus.Logger) (*DB, error) {
 	return db, nil
 }
 
-// loadLogger - logging level can be set by env var that is an int
-// with a value between 1 and 7.  If not set, value is defaulted to
-// 3, error level logging.
+// loadLogger returns a logger at the level, an int between 1 and 7, reporting callers.
 //
 //	1=PanicLevel,2=FatalLevel,3=ErrorLevel,4=WarnLevel,5=InfoLevel,6=DebugLevel,7=TraceLevel
 //
 // returns pointer to logger
-func loadLogger(logLevelStr string) *logrus.Logger {
-	logLevel, err := strconv.ParseUint(logLevelStr, 10, 32)
-	if err != nil {
-		logLevel = 3
-	}
+func loadLogger(logLevel int) *logrus.Logger {
 	logger := logrus.New()
 	logger.SetLevel(logrus.Level(logLevel))
 	logger.ReportCaller = true
 	return logger
 }
 
-// loadMaxProcs sets the number of procs to use for concurrency operations
-// if the env var is not specified it will be set to the runtime cpu count.
-// valid values must be > 0 and <= runtime.NumCPU, if not, it will be defaulted
-// to runtime.NumCPU
-// k8s and openshift labels can be used on a pod to set this value as well.
-func loadMaxProcs(maxProcsStr string) int {
-	maxProcs, err := strconv.Atoi(maxProcsStr)
-	if err != nil || maxProcs <= 0 || maxProcs > runtime.NumCPU() {
-		maxProcs = runtime.NumCPU()
-	}
-
-	return maxProcs
-
-}
-
-// getSrvAddress just takes in a string representing the desired address and port to run the
-// webserver on.
-// If address is empty or a malformed IP (IPV4) the default is blank ("")
-// If port is empty or non-numeric, default to port 8088
-func getSrvAddress(address string, port string) string {
-
-	var err error
-	var pi int
-
-	if pi, err = strconv.Atoi(port); err != nil {
-		pi = 8088
-	}
-	port = strconv.Itoa(pi)
-
-	ipRegex := regexp.MustCompile(`(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)(\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)){3}`)
-	if !ipRegex.MatchString(address) {
-		address = ""
-	}
-	return fmt.Sprintf("%s:%s", address, port)
-
-}
-
 // LoadRouter takes in a Handler pointer, sets up the middleware, and builds the routes.
 func LoadRouter(h *Handler) *chi.Mux {
 	r := chi.NewRouter()
 
-	cors := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Content-Type"},
-		AllowCredentials: true,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	})
-	r.Use(cors.Handler)
+	// cors options can be reloaded, see applyConfig
+	r.Use(h.corsMW)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	// the connection's own address is kept for throttling failed authentications, see peerIP
+	r.Use(peerAddrMW)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Heartbeat("/ping"))
+	r.Use(h.maxBodyMW)
+	r.Use(h.authMW)
 	setHeader("X-XSS-Protection", "1; mode=block")
 	setHeader("X-Frame-Options", "deny")
 
+	// the api is served for the shared catalogue and again below /tenants/{tenant} for partner sellers
+	r.Group(func(r chi.Router) {
+		r.Use(h.tenantMW)
+		h.apiRoutes(r)
+	})
+	r.Route("/tenants/{tenant}", func(r chi.Router) {
+		r.Use(h.tenantMW)
+		h.apiRoutes(r)
+	})
+
+	// api keys are only managed when key authentication is on
+	if h.apiKeys != nil {
+		r.Route("/api/v1/keys", func(r chi.Router) {
+			admin := h.routeMW(RoleAdmin)
+			r.With(admin).Get("/", h.ListAPIKeys)
+			r.With(admin).Post("/", h.CreateAPIKey)
+			r.With(admin).Post("/{id}/rotate", h.RotateAPIKey)
+			r.With(admin).Delete("/{id}", h.RevokeAPIKey)
+		})
+	}
+
+	return r
+}
+
+// apiRoutes builds the versioned api routes.  Handlers find the catalogue to use with h.db so
+// the same routes serve the shared catalogue and each tenant's.  Viewers may read, editors may also
+// add and change, and only admins may delete catalogue entries.
+func (h *Handler) apiRoutes(r chi.Router) {
+	viewer, editor, admin := h.routeMW(RoleViewer), h.routeMW(RoleEditor), h.routeMW(RoleAdmin)
+
+	r.With(viewer).Get("/api/v1/tenant", h.GetTenant)
+
 	r.Route("/api/v1/produce", func(r chi.Router) {
+		r.Use(h.idempotency.Middleware)
 		r.With(produceCodeMW).Route("/{code}", func(r chi.Router) {
-			r.Get("/", h.GetProduce)
-			r.Delete("/", h.DeleteProduce)
+			r.With(viewer).Get("/", h.GetProduce)
+			r.With(admin).Delete("/", h.DeleteProduce)
+			r.With(editor).Put("/categories", h.SetProduceCategories)
+			r.With(editor).Put("/tags", h.SetProduceTags)
+			r.With(viewer).Get("/suppliers", h.ListProduceSuppliers)
 		})
-		r.Get("/", h.GetAllProduce)
-		r.Post("/", h.AddProduce)
+		r.With(viewer).Get("/", h.GetAllProduce)
+		r.With(editor).Post("/", h.AddProduce)
+		r.With(viewer).Post("/validate", h.ValidateProduce)
+		r.With(admin).Post("/bulk-delete", h.BulkDeleteProduce)
+		r.With(editor).Post("/codes", h.GenerateCodes)
+		r.With(viewer).Get("/lookup", h.LookupProduce)
+		r.With(viewer).Get("/search", h.SearchProduce)
+		r.With(viewer).Get("/suggest", h.SuggestProduce)
 	})
 
-	return r
+	r.Route("/api/v1/categories", func(r chi.Router) {
+		r.Use(h.idempotency.Middleware)
+		r.With(viewer).Get("/", h.ListCategories)
+		r.With(editor).Post("/", h.AddCategory)
+		r.With(viewer).Get("/{id}", h.GetCategory)
+		r.With(editor).Put("/{id}", h.UpdateCategory)
+		r.With(admin).Delete("/{id}", h.DeleteCategory)
+	})
+
+	r.Route("/api/v1/tags", func(r chi.Router) {
+		r.Use(h.idempotency.Middleware)
+		r.With(viewer).Get("/", h.ListTags)
+		r.With(editor).Post("/", h.AddTag)
+		r.With(viewer).Get("/{id}", h.GetTag)
+		r.With(editor).Put("/{id}", h.UpdateTag)
+		r.With(admin).Delete("/{id}", h.DeleteTag)
+	})
+
+	r.Route("/api/v1/suppliers", func(r chi.Router) {
+		r.Use(h.idempotency.Middleware)
+		r.With(viewer).Get("/", h.ListSuppliers)
+		r.With(editor).Post("/", h.AddSupplier)
+		r.Route("/{id}", func(r chi.Router) {
+			r.With(viewer).Get("/", h.GetSupplier)
+			r.With(editor).Put("/", h.UpdateSupplier)
+			r.With(admin).Delete("/", h.DeleteSupplier)
+			r.With(viewer).Get("/produce", h.ListSupplierProduce)
+			r.With(editor, produceCodeMW).Put("/produce/{code}", h.SetSupplierProduce)
+			r.With(editor, produceCodeMW).Delete("/produce/{code}", h.DeleteSupplierProduce)
+		})
+	})
+
+	r.Route("/api/v1/stores", func(r chi.Router) {
+		r.Use(h.idempotency.Middleware)
+		r.With(viewer).Get("/", h.ListStores)
+		r.With(editor).Post("/", h.AddStore)
+		r.Route("/{id}", func(r chi.Router) {
+			r.With(viewer).Get("/", h.GetStore)
+			r.With(editor).Put("/", h.UpdateStore)
+			r.With(admin).Delete("/", h.DeleteStore)
+			r.With(viewer).Get("/produce", h.GetStoreProduce)
+			r.With(viewer, produceCodeMW).Get("/produce/{code}", h.GetStoreItem)
+			r.With(viewer).Get("/overrides", h.ListStoreOverrides)
+			r.With(editor, produceCodeMW).Put("/overrides/{code}", h.SetStoreOverride)
+			r.With(editor, produceCodeMW).Delete("/overrides/{code}", h.DeleteStoreOverride)
+		})
+	})
+
+	r.With(viewer).Get("/api/v1/reports/margins", h.GetMargins)
+}
+
+// routeMW counts a request against the caller's rate limit for the route, then checks they have
+// the role.  It is added to each route with With so the rate limit can see the route pattern.
+func (h *Handler) routeMW(role Role) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return h.rateLimitMW(h.requireRole(role)(next))
+	}
 }
 
+// produceCodeMW parses the code path variable and rejects invalid produce codes with a 400
+// before they reach the handler.  The canonical code is stored on the request context.
 func produceCodeMW(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		produceCode := chi.URLParam(r, "code")
@@ -172,7 +296,13 @@ func produceCodeMW(next http.Handler) http.Handler {
 			w.Write([]byte("empty produce code"))
 			return
 		}
-		next.ServeHTTP(w, r)
+		code, err := ParseProduceCode(produceCode)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withProduceCode(r.Context(), code)))
 	})
 }
 
@@ -4,9 +4,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"net/http"
-	"runtime"
-	"strconv"
 	"testing"
+	"time"
 )
 
 func Test_setHeader(t *testing.T) {
@@ -22,14 +21,24 @@ func Test_setHeader(t *testing.T) {
 	a.IsType(want, got)
 }
 
-//func Test_getServer(t *testing.T) {
-//	a := assert.New(t)
-//	got := getServer()
-//	a.IsType(http.Server{}, got)
-//	a.Equal(":8088", got.Addr)
-//	a.Equal(5*time.Second, got.IdleTimeout)
-//}
-//
+func Test_getServer(t *testing.T) {
+	a := assert.New(t)
+	cfg := DefaultConfig()
+	cfg.MaxBulkItems = 50
+	got, h, err := getServer(cfg, loadLogger(1))
+	a.NoError(err)
+	a.Equal(5*time.Second, got.IdleTimeout)
+	a.Equal(60*time.Second, got.WriteTimeout)
+	a.Equal(50, h.settings().maxBulkItems)
+	a.Nil(h.apiKeys)
+
+	// setup errors are returned rather than panicking
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = "missing.crt", "missing.key"
+	_, _, err = getServer(cfg, loadLogger(1))
+	if a.Error(err) {
+		a.Contains(err.Error(), "setting up tls")
+	}
+}
 
 func Test_loadDB(t *testing.T) {
 	a := assert.New(t)
@@ -38,16 +47,16 @@ func Test_loadDB(t *testing.T) {
 	a.NoError(err)
 
 	if item, err := db.Get("A12T-4GH7-QPL9-3N4M"); err != nil {
-		a.Failf("got:  %v    want:  A12T-4GH7-QPL9-3N4M", item.Code)
+		a.Failf("got:  %v    want:  A12T-4GH7-QPL9-3N4M", item.Code.String())
 	}
 	if item, err := db.Get("E5T6-9UI3-TH15-QR88"); err != nil {
-		a.Failf("got:  %v    want:  E5T6-9UI3-TH15-QR88", item.Code)
+		a.Failf("got:  %v    want:  E5T6-9UI3-TH15-QR88", item.Code.String())
 	}
 	if item, err := db.Get("YRT6-72AS-K736-L4AR"); err != nil {
-		a.Failf("got:  %v    want:  YRT6-72AS-K736-L4AR", item.Code)
+		a.Failf("got:  %v    want:  YRT6-72AS-K736-L4AR", item.Code.String())
 	}
 	if item, err := db.Get("TQ4C-VV6T-75ZX-1RMR"); err != nil {
-		a.Failf("got:  %v    want:  TQ4C-VV6T-75ZX-1RMR", item.Code)
+		a.Failf("got:  %v    want:  TQ4C-VV6T-75ZX-1RMR", item.Code.String())
 	}
 	if _, err := db.Get("this-isnt-inDB-fail"); err != nil {
 		a.Error(err)
@@ -58,74 +67,32 @@ func Test_loadLogger(t *testing.T) {
 
 	a := assert.New(t)
 
-	logger := loadLogger("1")
+	logger := loadLogger(1)
 	a.Equal(1, int(logger.Level))
 	a.Equal(true, logger.ReportCaller)
 
-	logger = loadLogger("2")
+	logger = loadLogger(2)
 	a.Equal(2, int(logger.Level))
 	a.Equal(true, logger.ReportCaller)
 
-	logger = loadLogger("3")
+	logger = loadLogger(3)
 	a.Equal(3, int(logger.Level))
 	a.Equal(true, logger.ReportCaller)
 
-	logger = loadLogger("4")
+	logger = loadLogger(4)
 	a.Equal(4, int(logger.Level))
 	a.Equal(true, logger.ReportCaller)
 
-	logger = loadLogger("5")
+	logger = loadLogger(5)
 	a.Equal(5, int(logger.Level))
 	a.Equal(true, logger.ReportCaller)
 
-	logger = loadLogger("6")
+	logger = loadLogger(6)
 	a.Equal(6, int(logger.Level))
 	a.Equal(true, logger.ReportCaller)
 
-	logger = loadLogger("7")
+	logger = loadLogger(7)
 	a.Equal(7, int(logger.Level))
 	a.Equal(true, logger.ReportCaller)
 
 }
-
-func Test_loadMaxProcs(t *testing.T) {
-	a := assert.New(t)
-	got := loadMaxProcs("1")
-	a.EqualValues(1, got)
-
-	got = loadMaxProcs("5")
-	a.Greater(got, 0)
-	a.LessOrEqual(got, 5)
-	// a.EqualValues(5, got)
-
-	got = loadMaxProcs("0")
-	a.EqualValues(runtime.NumCPU(), got)
-
-	got = loadMaxProcs("-10")
-	a.EqualValues(runtime.NumCPU(), got)
-
-	got = loadMaxProcs(strconv.Itoa(runtime.NumCPU() + 1))
-	a.EqualValues(runtime.NumCPU(), got)
-
-}
-
-func Test_getSrvAddress(t *testing.T) {
-
-	a := assert.New(t)
-
-	got := getSrvAddress("127.0.0.1", "1234")
-	a.Equal("127.0.0.1:1234", got)
-
-	got = getSrvAddress("127.0.0.1", "")
-	a.Equal("127.0.0.1:8088", got)
-
-	got = getSrvAddress("255.255.255.255", "1234")
-	a.Equal("255.255.255.255:1234", got)
-
-	got = getSrvAddress("256.256.256.256", "1234")
-	a.Equal(":1234", got)
-
-	got = getSrvAddress("", "")
-	a.Equal(":8088", got)
-
-}
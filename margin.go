@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"net/http"
+)
+
+// Margin compares what a supplier charges for a produce item with the item's unit price
+type Margin struct {
+	Code       ProduceCode `json:"produce_code"`
+	Name       string      `json:"produce_name"`
+	SupplierID string      `json:"supplier_id"`
+	UnitPrice  float64     `json:"produce_unit_price"`
+	CostPrice  float64     `json:"cost_price"`
+	// Margin is the unit price less the cost price, negative when the item is sold at a loss
+	Margin float64 `json:"margin"`
+	// MarginPercent is the margin as a percentage of the unit price.  It is omitted when the
+	// unit price is zero.
+	MarginPercent *float64 `json:"margin_percent,omitempty"`
+}
+
+// MarginReport is the response returned by GetMargins
+type MarginReport struct {
+	Margins []Margin `json:"margins"`
+}
+
+// Margins returns the margin of every supply, sorted by produce code then supplier id.  A non-empty
+// supplierID or code limits the report to that supplier or produce item.  Both must already be in
+// canonical form.
+func (d *DB) Margins(supplierID string, code ProduceCode) []Margin {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	sps := d.suppliers.list(func(sp Supply) bool {
+		return (supplierID == "" || sp.SupplierID == supplierID) && (code == "" || sp.Code == code)
+	})
+	margins := make([]Margin, 0, len(sps))
+	for _, sp := range sps {
+		idx := GetItemIndex(sp.Code, d.Produce, d.logger)
+		if idx == nil {
+			continue
+		}
+		p := d.Produce[*idx]
+		m := Margin{
+			Code:       sp.Code,
+			Name:       p.Name,
+			SupplierID: sp.SupplierID,
+			UnitPrice:  p.UnitPrice,
+			CostPrice:  sp.CostPrice,
+			Margin:     round(p.UnitPrice-sp.CostPrice, 2),
+		}
+		if p.UnitPrice > 0 {
+			pct := round(m.Margin/p.UnitPrice*100, 1)
+			m.MarginPercent = &pct
+		}
+		margins = append(margins, m)
+	}
+	return margins
+}
+
+// round rounds f to the number of decimal places
+func round(f float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(f*scale) / scale
+}
+
+// GetMargins reports the margin between each supplier's cost price and the unit price of the produce
+// they supply.  The optional supplier and code query parameters narrow the report, e.g.
+// ?supplier=sunny-acres or ?code=A12T-4GH7-QPL9-3N4M.  An unknown supplier or item gets a 404.
+func (h *Handler) GetMargins(w http.ResponseWriter, r *http.Request) {
+	supplierID := r.URL.Query().Get("supplier")
+	if supplierID != "" {
+		s, err := h.db(r).GetSupplier(supplierID)
+		if err != nil {
+			handlerErrorLogger(r, err, h.logger)
+			http.Error(w, err.Error(), statusForError(err))
+			return
+		}
+		supplierID = s.ID
+	}
+
+	var code ProduceCode
+	if c := r.URL.Query().Get("code"); c != "" {
+		p, err := h.db(r).Get(ProduceCode(c))
+		if err != nil {
+			handlerErrorLogger(r, err, h.logger)
+			http.Error(w, err.Error(), statusForError(err))
+			return
+		}
+		code = p.Code
+	}
+
+	h.writeJSON(w, r, http.StatusOK, MarginReport{Margins: h.db(r).Margins(supplierID, code)})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// supplierDB returns the default database with two suppliers of lettuce and one of peaches
+func supplierDB(t *testing.T) *DB {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+	a.NoError(db.AddSupplier(&Supplier{ID: "sunny-acres", Name: "Sunny Acres"}))
+	a.NoError(db.AddSupplier(&Supplier{ID: "valley-farms", Name: "Valley Farms"}))
+	a.NoError(db.SetSupply(&Supply{SupplierID: "sunny-acres", Code: "A12T-4GH7-QPL9-3N4M", CostPrice: 2.10}))
+	a.NoError(db.SetSupply(&Supply{SupplierID: "valley-farms", Code: "A12T-4GH7-QPL9-3N4M", CostPrice: 3.50}))
+	a.NoError(db.SetSupply(&Supply{SupplierID: "sunny-acres", Code: "E5T6-9UI3-TH15-QR88", CostPrice: 1.50}))
+	return db
+}
+
+func TestDB_Margins(t *testing.T) {
+	a := assert.New(t)
+	db := supplierDB(t)
+
+	pct := func(f float64) *float64 { return &f }
+	a.Equal([]Margin{
+		{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", SupplierID: "sunny-acres", UnitPrice: 3.46, CostPrice: 2.10, Margin: 1.36, MarginPercent: pct(39.3)},
+		{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", SupplierID: "valley-farms", UnitPrice: 3.46, CostPrice: 3.50, Margin: -0.04, MarginPercent: pct(-1.2)},
+		{Code: "E5T6-9UI3-TH15-QR88", Name: "Peach", SupplierID: "sunny-acres", UnitPrice: 2.99, CostPrice: 1.50, Margin: 1.49, MarginPercent: pct(49.8)},
+	}, db.Margins("", ""))
+	a.Len(db.Margins("sunny-acres", ""), 2)
+	a.Len(db.Margins("", "A12T-4GH7-QPL9-3N4M"), 2)
+	a.Len(db.Margins("valley-farms", "E5T6-9UI3-TH15-QR88"), 0)
+
+	// free items have no margin percentage
+	_, err := db.Upsert(&ProduceItem{Name: "Peach", Code: "E5T6-9UI3-TH15-QR88", UnitPrice: 0})
+	a.NoError(err)
+	m := db.Margins("", "E5T6-9UI3-TH15-QR88")
+	a.Equal(-1.5, m[0].Margin)
+	a.Nil(m[0].MarginPercent)
+}
+
+func TestHandler_GetMargins(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	ts := httptest.NewServer(LoadRouter(NewHandler(supplierDB(t), runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		count  int
+	}{
+		{"/api/v1/reports/margins", 200, 3},
+		{"/api/v1/reports/margins?supplier=Sunny-Acres", 200, 2},
+		{"/api/v1/reports/margins?code=a12t-4gh7-qpl9-3n4m", 200, 2},
+		{"/api/v1/reports/margins?supplier=valley-farms&code=E5T6-9UI3-TH15-QR88", 200, 0},
+		{"/api/v1/reports/margins?supplier=hill-top", 404, 0},
+		{"/api/v1/reports/margins?code=AAAA-0000-0000-0000", 404, 0},
+		{"/api/v1/reports/margins?code=nope", 400, 0},
+	}
+	for _, tt := range tests {
+		rr, body := testRequest(t, ts, "GET", tt.path, nil)
+		a.Equal(tt.status, rr.StatusCode, tt.path)
+		if tt.status != 200 {
+			continue
+		}
+		var mr MarginReport
+		a.NoError(json.Unmarshal([]byte(body), &mr))
+		a.Len(mr.Margins, tt.count, tt.path)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NamePolicy controls which produce names are accepted.  Names are normalized with NormalizeName
+// before the policy is applied, so the length limits count characters after normalization.
+type NamePolicy struct {
+	// AllowedPunctuation lists the characters allowed in a name on top of letters, digits and spaces
+	AllowedPunctuation string
+	// MinLength is the fewest characters a name may have
+	MinLength int
+	// MaxLength is the most characters a name may have
+	MaxLength int
+}
+
+// DefaultNamePolicy allows letters and digits from any script, spaces, and the punctuation
+// commonly found in produce names such as "Pak Choi (baby)", up to 64 characters.
+func DefaultNamePolicy() NamePolicy {
+	return NamePolicy{AllowedPunctuation: "()'&.,", MinLength: 1, MaxLength: 64}
+}
+
+// Validate normalizes the name and checks it against the policy.  The normalized name is
+// returned, or ErrInvalidName if the name breaks the policy.
+func (np NamePolicy) Validate(n string) (string, error) {
+	n = NormalizeName(n)
+
+	length := utf8.RuneCountInString(n)
+	if length < np.MinLength || length > np.MaxLength || length == 0 {
+		return "", ErrInvalidName
+	}
+	for _, r := range n {
+		switch {
+		case unicode.IsLetter(r), unicode.IsMark(r), unicode.IsDigit(r), r == ' ':
+		case strings.ContainsRune(np.AllowedPunctuation, r):
+		default:
+			return "", ErrInvalidName
+		}
+	}
+	return n, nil
+}
+
+// NormalizeName converts the name to Unicode normalization form C, trims leading and trailing
+// whitespace and collapses every other run of whitespace, tabs and newlines included, to a single space.
+func NormalizeName(n string) string {
+	return strings.Join(strings.Fields(norm.NFC.String(n)), " ")
+}
+
+// parseLangTag validates a BCP 47 language tag such as "es" or "pt-BR" and returns its canonical form
+func parseLangTag(s string) (string, error) {
+	tag, err := language.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return tag.String(), nil
+}
+
+// localize returns the produce item with its name in the language of the tag.  If the item has
+// no name for the exact tag, the name for the base language is tried ("es" for "es-MX").
+// The item is returned untouched if it has no name in the language.
+func localize(p *ProduceItem, lang string) *ProduceItem {
+	if lang == "" || len(p.LocalizedNames) == 0 {
+		return p
+	}
+
+	name, ok := p.LocalizedNames[lang]
+	if !ok {
+		base, _ := language.Make(lang).Base()
+		name, ok = p.LocalizedNames[base.String()]
+	}
+	if !ok {
+		return p
+	}
+
+	localized := *p
+	localized.Name = name
+	return &localized
+}
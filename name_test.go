@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeName(t *testing.T) {
+	a := assert.New(t)
+
+	// decomposed n + combining tilde is composed to a single character
+	a.Equal("Jalapeño", NormalizeName("Jalapeño"))
+	a.Equal("Green Pepper", NormalizeName("  Green \t\n Pepper  "))
+	a.Equal("", NormalizeName(" \t "))
+}
+
+func TestNamePolicy_Validate(t *testing.T) {
+	np := DefaultNamePolicy()
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{in: "Jalapeño", want: "Jalapeño"},
+		{in: "Pak Choi (baby)", want: "Pak Choi (baby)"},
+		{in: "Pomme de terre", want: "Pomme de terre"},
+		{in: "白菜", want: "白菜"},
+		{in: "Gala\tApple", want: "Gala Apple"},
+		{in: "Inv@lid", wantErr: ErrInvalidName},
+		{in: "Pak-Choi", wantErr: ErrInvalidName},
+		{in: "\t", wantErr: ErrInvalidName},
+		{in: strings.Repeat("a", 65), wantErr: ErrInvalidName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := np.Validate(tt.in)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("Validate() = %q, %v want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	custom := NamePolicy{AllowedPunctuation: "-", MinLength: 3, MaxLength: 10}
+	_, err := custom.Validate("Pak-Choi")
+	assert.NoError(t, err)
+	_, err = custom.Validate("Pak Choi (baby)")
+	assert.Equal(t, ErrInvalidName, err)
+	_, err = custom.Validate("ab")
+	assert.Equal(t, ErrInvalidName, err)
+}
+
+func TestDB_localizedNames(t *testing.T) {
+	a := assert.New(t)
+	db := NewDB(logrus.New())
+
+	p := &ProduceItem{Name: " Peach ", Code: "E5T6-9UI3-TH15-QR88", UnitPrice: 2.99,
+		LocalizedNames: map[string]string{"ES": "Melocotón", "pt-br": "Pêssego"}}
+	a.NoError(db.Add(p))
+	a.Equal("Peach", p.Name)
+	a.Equal(map[string]string{"es": "Melocotón", "pt-BR": "Pêssego"}, p.LocalizedNames)
+
+	a.Equal(ErrInvalidName, db.Add(&ProduceItem{Name: "Kiwi", Code: "K1W1-9UI3-TH15-QR88", UnitPrice: 1,
+		LocalizedNames: map[string]string{"es": "K!w!"}}))
+	a.Equal(ErrInvalidName, db.Add(&ProduceItem{Name: "Kiwi", Code: "K1W1-9UI3-TH15-QR88", UnitPrice: 1,
+		LocalizedNames: map[string]string{"not a language": "Kiwi"}}))
+
+	a.Equal("Melocotón", localize(p, "es").Name)
+	a.Equal("Melocotón", localize(p, "es-MX").Name)
+	a.Equal("Pêssego", localize(p, "pt-BR").Name)
+	a.Equal("Peach", localize(p, "fr").Name)
+	a.Equal("Peach", localize(p, "").Name)
+	// the stored item is untouched
+	a.Equal("Peach", p.Name)
+
+	db.SetNamePolicy(NamePolicy{AllowedPunctuation: "-", MinLength: 1, MaxLength: 64})
+	a.NoError(db.Add(&ProduceItem{Name: "Pak-Choi", Code: "PAKC-9UI3-TH15-QR88", UnitPrice: 1}))
+}
+
+func TestHandler_localizedNames(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	ts := httptest.NewServer(LoadRouter(NewHandler(NewDB(logger), runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	payload := `[{"produce_name":"Peach","produce_code":"E5T6-9UI3-TH15-QR88","produce_unit_price":2.99,"plu":"4044","localized_names":{"es":"Melocotón"}}]`
+	rr, _ := testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(payload))
+	a.Equal(200, rr.StatusCode)
+
+	for _, path := range []string{"/api/v1/produce?lang=es", "/api/v1/produce/E5T6-9UI3-TH15-QR88?lang=es-MX", "/api/v1/produce/lookup?plu=4044&lang=es"} {
+		rr, body := testRequest(t, ts, "GET", path, nil)
+		a.Equal(200, rr.StatusCode, path)
+		a.Contains(body, `"produce_name":"Melocotón"`, path)
+	}
+
+	_, body := testRequest(t, ts, "GET", "/api/v1/produce/E5T6-9UI3-TH15-QR88", nil)
+	a.Contains(body, `"produce_name":"Peach"`)
+
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce?lang=!!", nil)
+	a.Equal(400, rr.StatusCode)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// AddStage is a single stage of the AddProduce pipeline.  A stage reads every AddResult from
+// incomingStream and passes it on to the returned stream.  A stage rejects an item by setting
+// StatusCode and Status; results that already have a StatusCode set were rejected by an earlier
+// stage and must be passed on untouched.
+type AddStage func(done <-chan interface{}, incomingStream <-chan AddResult) <-chan AddResult
+
+// NewValidationStage builds an AddStage from a check func.  Any item the check returns an error for
+// is rejected with statusCode and a status of "<statusCode>: <error>".   This is the easiest way to
+// plug custom rules (profanity filters, supplier allow-lists, etc) into the pipeline with UseStages.
+func NewValidationStage(statusCode int, check func(p ProduceItem) error) AddStage {
+	return func(done <-chan interface{}, incomingStream <-chan AddResult) <-chan AddResult {
+		verifiedStream := make(chan AddResult)
+
+		go func() {
+			defer close(verifiedStream)
+
+			for i := range incomingStream {
+
+				if i.StatusCode == 0 {
+					if err := check(i.Produce); err != nil {
+						i.StatusCode = statusCode
+						i.Status = fmt.Sprintf("%d: %s", statusCode, err.Error())
+					}
+				}
+
+				select {
+				case <-done:
+					return
+				case verifiedStream <- i:
+				}
+			}
+		}()
+		return verifiedStream
+	}
+}
+
+// UseStages registers custom stages with the AddProduce pipeline.  Custom stages run in the order
+// given, after the built-in validation stages and before the item is added to the database.
+func (h *Handler) UseStages(stages ...AddStage) {
+	h.stages = append(h.stages, stages...)
+}
+
+// ConflictPolicy controls what AddProduce does with an item whose code already exists in the database
+type ConflictPolicy string
+
+const (
+	// ConflictError rejects the item with a 409.  This is the default.
+	ConflictError ConflictPolicy = "error"
+	// ConflictSkip leaves the existing item alone and reports the new one as skipped
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictUpdate replaces the whole existing item with the new one, see DB.Upsert
+	ConflictUpdate ConflictPolicy = "update"
+)
+
+// parseConflictPolicy parses the on_conflict query parameter.  An empty value is ConflictError.
+func parseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case "":
+		return ConflictError, nil
+	case ConflictError, ConflictSkip, ConflictUpdate:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid value for on_conflict: %q", s)
+	}
+}
+
+// checkStages returns the stages every item passes through before it is written, in the order
+// they are run: the built-in validation stages then any custom stages.  Only items that pass every
+// check reach the database.
+func (h *Handler) checkStages(db *DB) []AddStage {
+	stages := []AddStage{h.verifyCodeStage(db), h.verifyNameStage(db), h.verifyPriceStage(), h.verifyIdentifiersStage()}
+	return append(stages, h.stages...)
+}
+
+// verifyCodeStage rejects items whose produce code is invalid
+func (h *Handler) verifyCodeStage(db *DB) AddStage {
+	return NewValidationStage(http.StatusBadRequest, func(p ProduceItem) error {
+		_, err := db.ParseCode(string(p.Code))
+		return err
+	})
+}
+
+// verifyNameStage rejects items whose produce name is invalid
+func (h *Handler) verifyNameStage(db *DB) AddStage {
+	return NewValidationStage(http.StatusBadRequest, func(p ProduceItem) error {
+		_, err := db.ParseName(p.Name)
+		return err
+	})
+}
+
+// verifyPriceStage rejects items whose unit price is invalid
+func (h *Handler) verifyPriceStage() AddStage {
+	return NewValidationStage(http.StatusBadRequest, func(p ProduceItem) error {
+		if !PriceIsValid(p.UnitPrice, h.logger) {
+			return ErrInvalidUnitPrice
+		}
+		return nil
+	})
+}
+
+// verifyIdentifiersStage rejects items with an invalid PLU or GTIN
+func (h *Handler) verifyIdentifiersStage() AddStage {
+	return NewValidationStage(http.StatusBadRequest, func(p ProduceItem) error {
+		if p.PLU != "" {
+			if _, err := ParsePLU(p.PLU); err != nil {
+				return err
+			}
+		}
+		if p.GTIN != "" {
+			if _, err := ParseGTIN(p.GTIN); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addItem returns the write step of AddProduce.  It adds the item to the database, handling an
+// item that already exists according to the conflict policy, and translates any error from the
+// database to a status on the AddResult.
+func (h *Handler) addItem(db *DB, policy ConflictPolicy) func(i *AddResult) {
+	return func(i *AddResult) {
+		var outcome UpsertOutcome
+		var err error
+		if policy == ConflictUpdate {
+			outcome, err = db.Upsert(&i.Produce)
+		} else {
+			err = db.Add(&i.Produce)
+		}
+
+		switch {
+		case policy == ConflictSkip && errors.Is(err, ErrDuplicateItem):
+			i.StatusCode = http.StatusOK
+			i.Status = "200: skipped"
+		case err != nil:
+			i.StatusCode = statusForError(err)
+			i.Status = fmt.Sprintf("%d: %s", i.StatusCode, err.Error())
+		case outcome == UpsertUpdated:
+			i.StatusCode = http.StatusOK
+			i.Status = "200: updated"
+		case outcome == UpsertUnchanged:
+			i.StatusCode = http.StatusOK
+			i.Status = "200: unchanged"
+		default:
+			i.StatusCode = http.StatusCreated
+			i.Status = "201: added"
+		}
+	}
+}
+
+// dryRunItem returns the write step of dry runs.  It runs addItem against a sandbox of the
+// database, so each item is checked against the same indexes and quota as a real write and against
+// the items before it in the request, then reports what would have happened.
+func (h *Handler) dryRunItem(db *DB, policy ConflictPolicy) func(i *AddResult) {
+	add := h.addItem(db.sandbox(), policy)
+	return func(i *AddResult) {
+		add(i)
+		switch i.Status {
+		case "201: added":
+			i.Status = "201: would be added"
+		case "200: skipped":
+			i.Status = "200: would be skipped"
+		case "200: updated":
+			i.Status = "200: would be updated"
+		}
+	}
+}
+
+// runAddPipeline runs the produce items through streamAddPipeline, writing them in request order,
+// and returns the results in completion order, not request order.
+func (h *Handler) runAddPipeline(checks []AddStage, write func(i *AddResult), produceItems []ProduceItem) []AddResult {
+	var results []AddResult
+	h.streamAddPipeline(checks, write, produceItems, true, func(x AddResult) {
+		results = append(results, x)
+	})
+	return results
+}
+
+// streamAddPipeline pushes the produce items through maxProcs copies of the check stages, then
+// hands each item that passed them to write one at a time.  When ordered they are written in
+// request order, so items in the same request that clash, such as two with the same code, or a
+// later update of an earlier item, are settled the same way every time.  Otherwise each item is
+// written as soon as its checks are done and clashes are settled in the order the checks finish.
+// Each result is passed to emit as soon as it is done: items rejected by a check as they come out
+// of the checks, the rest once written.
+func (h *Handler) streamAddPipeline(checks []AddStage, write func(i *AddResult), produceItems []ProduceItem, ordered bool, emit func(x AddResult)) {
+
+	// setup for pipeline
+	done := make(chan interface{})
+	defer close(done)
+	resultsStream := generateAddResults(done, produceItems...)
+
+	// create a slice of channels equal in length to the number of maxProcs
+	produceProcessors := make([]<-chan AddResult, h.maxProcs)
+
+	// iterate over maxProcs creating pipelines at each iteration
+	for i := 0; i < h.maxProcs; i++ {
+		stream := resultsStream
+		for _, stage := range checks {
+			stream = stage(done, stream)
+		}
+		produceProcessors[i] = stream
+	}
+
+	// fanIn used to consolidate the checked items, which are held back until every earlier item
+	// has come through so they can be written in request order
+	pending := map[int]AddResult{}
+	next := 0
+	for x := range fanIn(done, produceProcessors...) {
+		if !ordered {
+			if x.StatusCode == 0 {
+				write(&x)
+			}
+			emit(x)
+			continue
+		}
+		if x.StatusCode != 0 {
+			emit(x)
+		}
+		pending[x.Index] = x
+		for r, ok := pending[next]; ok; r, ok = pending[next] {
+			delete(pending, next)
+			next++
+			if r.StatusCode == 0 {
+				write(&r)
+				emit(r)
+			}
+		}
+	}
+}
+
+// generateAddResults takes the produceItems from the Post request and puts them on a channel.
+func generateAddResults(done <-chan interface{}, produceItems ...ProduceItem) <-chan AddResult {
+	resultStream := make(chan AddResult)
+	go func() {
+		defer close(resultStream)
+
+		for idx, pi := range produceItems {
+			result := AddResult{
+				Index:   idx,
+				Produce: pi,
+			}
+			select {
+			case <-done:
+				return
+			case resultStream <- result:
+			}
+		}
+	}()
+	return resultStream
+}
+
+// fanIn is a fan-in implementation to consolidate the result channels
+func fanIn[T any](done <-chan interface{}, channels ...<-chan T) <-chan T {
+	var wg sync.WaitGroup
+	mplexStream := make(chan T)
+
+	mplex := func(c <-chan T) {
+		defer wg.Done()
+		for i := range c {
+			select {
+			case <-done:
+				return
+			case mplexStream <- i:
+			}
+		}
+	}
+	wg.Add(len(channels))
+	for _, c := range channels {
+		go mplex(c)
+	}
+
+	go func() {
+		wg.Wait()
+		close(mplexStream)
+	}()
+
+	return mplexStream
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_addPipeline(t *testing.T) {
+	a := assert.New(t)
+	h := NewHandler(NewDB(logrus.New()), runtime.NumCPU(), logrus.New())
+
+	items := []ProduceItem{
+		{Name: "Lettuce", Code: "A12T-4GH7-QPL9-3N4M", UnitPrice: 3.46},
+		{Name: "BadCode", Code: "@12T-4GH7-QPL9-3N4M", UnitPrice: 3.46},
+		{Name: "Inv@lidName", Code: "A13T-4GH7-QPL9-3N4M", UnitPrice: 3.46},
+		{Name: "BadPrice", Code: "A14T-4GH7-QPL9-3N4M", UnitPrice: -3.46},
+		{Name: "Lettuce", Code: "A12T-4GH7-QPL9-3N4M", UnitPrice: 3.46},
+		// invalid name and price, the code is checked first so it wins
+		{Name: "B@d", Code: "bad", UnitPrice: -1},
+	}
+
+	results := h.runAddPipeline(h.checkStages(h.DB), h.addItem(h.DB, ConflictError), items)
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+
+	expected := []struct {
+		code   int
+		status string
+	}{
+		{http.StatusCreated, "201: added"},
+		{http.StatusBadRequest, "400: item code is invalid"},
+		{http.StatusBadRequest, "400: item name is invalid"},
+		{http.StatusBadRequest, "400: item unit price is invalid"},
+		{http.StatusConflict, "409: item already exists"},
+		{http.StatusBadRequest, "400: item code is invalid"},
+	}
+	a.Len(results, len(expected))
+	for i, e := range expected {
+		a.Equal(e.code, results[i].StatusCode, "index %d", i)
+		a.Equal(e.status, results[i].Status, "index %d", i)
+	}
+
+	// only the valid item made it to the database
+	a.Len(h.DB.List(), 1)
+}
+
+func TestHandler_UseStages(t *testing.T) {
+	a := assert.New(t)
+	h := NewHandler(NewDB(logrus.New()), runtime.NumCPU(), logrus.New())
+
+	var seen []ProduceCode
+	profanity := NewValidationStage(http.StatusUnprocessableEntity, func(p ProduceItem) error {
+		if strings.Contains(strings.ToLower(p.Name), "darn") {
+			return errors.New("name is not allowed")
+		}
+		return nil
+	})
+	recorder := func(done <-chan interface{}, incomingStream <-chan AddResult) <-chan AddResult {
+		out := make(chan AddResult)
+		go func() {
+			defer close(out)
+			for i := range incomingStream {
+				seen = append(seen, i.Produce.Code)
+				select {
+				case <-done:
+					return
+				case out <- i:
+				}
+			}
+		}()
+		return out
+	}
+	h.UseStages(profanity, recorder)
+
+	items := []ProduceItem{
+		{Name: "Darn Peach", Code: "E5T6-9UI3-TH15-QR88", UnitPrice: 2.99},
+		{Name: "Peach", Code: "E5T6-9UI3-TH15-QR89", UnitPrice: 2.99},
+	}
+
+	// a single pipeline keeps the recorder free of data races
+	h.maxProcs = 1
+	results := h.runAddPipeline(h.checkStages(h.DB), h.addItem(h.DB, ConflictError), items)
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+
+	a.Equal(http.StatusUnprocessableEntity, results[0].StatusCode)
+	a.Equal("422: name is not allowed", results[0].Status)
+	a.Equal(http.StatusCreated, results[1].StatusCode)
+	a.Equal([]ProduceCode{"E5T6-9UI3-TH15-QR88", "E5T6-9UI3-TH15-QR89"}, seen)
+
+	_, err := h.DB.Get("E5T6-9UI3-TH15-QR88")
+	a.Equal(ErrNotFound, err)
+}
+
+func TestHandler_streamAddPipelineUnordered(t *testing.T) {
+	a := assert.New(t)
+	h := NewHandler(NewDB(logrus.New()), 2, logrus.New())
+
+	// the first item's checks can't finish until the second item has been written, which only
+	// happens when items are written as their checks finish.  The stage goes first so the pipeline
+	// holding the first item can't take the second.
+	written := make(chan struct{})
+	slow := NewValidationStage(http.StatusGatewayTimeout, func(p ProduceItem) error {
+		if p.Name != "Lettuce" {
+			return nil
+		}
+		select {
+		case <-written:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("the second item was not written first")
+		}
+	})
+	add := h.addItem(h.DB, ConflictError)
+	write := func(i *AddResult) {
+		add(i)
+		if i.Index == 1 {
+			close(written)
+		}
+	}
+
+	items := []ProduceItem{
+		{Name: "Lettuce", Code: "A12T-4GH7-QPL9-3N4M", UnitPrice: 3.46},
+		{Name: "Peach", Code: "E5T6-9UI3-TH15-QR88", UnitPrice: 2.99},
+	}
+	var indexes []int
+	h.streamAddPipeline(append([]AddStage{slow}, h.checkStages(h.DB)...), write, items, false, func(x AddResult) {
+		a.Equal(http.StatusCreated, x.StatusCode, x.Status)
+		indexes = append(indexes, x.Index)
+	})
+	a.Equal([]int{1, 0}, indexes)
+}
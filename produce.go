@@ -4,7 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"regexp"
+	"golang.org/x/text/cases"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,26 +19,102 @@ var ErrNotFound = errors.New("item not found")
 var ErrDuplicateItem = errors.New("item already exists")
 
 // ErrInvalidCode indicates the produce code doesn't meet the required formatting or character
-// constraints (0-9a-zA-Z-)  Required format is xxxx-xxxx-xxxx-xxxx
+// constraints (0-9a-zA-Z-)  Required format is xxxx-xxxx-xxxx-xxxx, with an optional check character
 var ErrInvalidCode = errors.New("item code is invalid")
 
 // ErrInvalidName indicates the produce name doesn't meet the required formatting or character
-// constraints of being alphanumeric with no other characters allowed (0-9a-zA-Z)
+// constraints of the name policy, see NamePolicy
 var ErrInvalidName = errors.New("item name is invalid")
 
+// ErrDuplicateName will be used when unique names are enforced and an item is trying to be added
+// with the same name as another item, ignoring case
+var ErrDuplicateName = errors.New("item name already exists")
+
 // ErrInvalidUnitPrice indicates the produce unit price is less than 0 (negative value).
 var ErrInvalidUnitPrice = errors.New("item unit price is invalid")
 
 // ProduceItem represents a single piece of Produce sold by the store.
 // The Produce includes name, Produce code, and unit price
 type ProduceItem struct {
-	// Name is alphanumeric and case-insensitive
+	// Name is alphanumeric and case-insensitive.  Letters from any script are allowed and the
+	// name is stored normalized, see NormalizeName.
 	Name string `json:"produce_name"`
 	// Code is a sixteen character (plus four dashes) long string with dashes separating each four character group.
-	// The codes are alphanumeric and case-insensitive.
-	Code string `json:"produce_code"`
+	// The codes are alphanumeric and case-insensitive, and are stored in upper case.
+	Code ProduceCode `json:"produce_code"`
 	// UnitPrice is a number with up to two decimal places
 	UnitPrice float64 `json:"produce_unit_price"`
+	// PLU is the optional IFPS price look-up number printed on produce stickers, e.g. 4011
+	PLU string `json:"plu,omitempty"`
+	// GTIN is the optional UPC/EAN barcode number, stored as a fourteen digit GTIN
+	GTIN string `json:"gtin,omitempty"`
+	// LocalizedNames holds display names keyed by BCP 47 language tag, e.g. {"es": "Melocotón"}
+	LocalizedNames map[string]string `json:"localized_names,omitempty"`
+	// Categories holds the ids of the categories the item is assigned to, see Category
+	Categories []string `json:"categories,omitempty"`
+	// Tags holds the ids of the tags on the item, see Tag
+	Tags []string `json:"tags,omitempty"`
+}
+
+// ProduceFilter selects produce items by name, unit price, category and tags.  Unset fields match every item.
+type ProduceFilter struct {
+	// Name matches items whose name contains the value, ignoring case
+	Name string `json:"name,omitempty"`
+	// MinPrice matches items with a unit price greater than or equal to the value
+	MinPrice *float64 `json:"min_price,omitempty"`
+	// MaxPrice matches items with a unit price less than or equal to the value
+	MaxPrice *float64 `json:"max_price,omitempty"`
+	// Category matches items assigned to the category.  DB.Find also matches items assigned to any
+	// category below it.
+	Category string `json:"category,omitempty"`
+	// Tags matches items carrying every one of the tags
+	Tags []string `json:"tags,omitempty"`
+
+	// subtree holds the ids of Category and the categories below it, set by DB.Find
+	subtree map[string]bool
+}
+
+// IsEmpty reports whether the filter has no criteria set and would match every item
+func (f ProduceFilter) IsEmpty() bool {
+	return f.Name == "" && f.MinPrice == nil && f.MaxPrice == nil && f.Category == "" && len(f.Tags) == 0
+}
+
+// Match reports whether the produce item meets every criteria set on the filter
+func (f ProduceFilter) Match(p *ProduceItem) bool {
+	if f.Name != "" && !strings.Contains(strings.ToLower(p.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	if f.MinPrice != nil && p.UnitPrice < *f.MinPrice {
+		return false
+	}
+	if f.MaxPrice != nil && p.UnitPrice > *f.MaxPrice {
+		return false
+	}
+	if f.Category != "" {
+		categories := f.subtree
+		if categories == nil {
+			categories = map[string]bool{strings.ToLower(f.Category): true}
+		}
+		if !containsAny(p.Categories, categories) {
+			return false
+		}
+	}
+	for _, t := range f.Tags {
+		if !containsAny(p.Tags, map[string]bool{strings.ToLower(t): true}) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAny reports whether any of ids is in set
+func containsAny(ids []string, set map[string]bool) bool {
+	for _, id := range ids {
+		if set[id] {
+			return true
+		}
+	}
+	return false
 }
 
 // DB is an in-memory store to track Produce for the store.
@@ -49,16 +126,183 @@ type DB struct {
 	logger *logrus.Logger
 	// mtx is a mutex used to lock and unlock Produce to ensure concurrent safety.
 	mtx *sync.Mutex
+	// requireCheckChar rejects new codes without a check character
+	requireCheckChar bool
+	// namePolicy controls which names are accepted for new items
+	namePolicy NamePolicy
+	// nameIndex maps case-folded names to codes.  It is only set, and kept in sync, when
+	// unique names are enforced.
+	nameIndex *uniqueIndex
+	// pluIndex and gtinIndex map identifiers to the code of the item that carries them
+	pluIndex  *uniqueIndex
+	gtinIndex *uniqueIndex
+	// searchIndex is the full-text index over produce names
+	searchIndex *searchIndex
+	// suggestIndex is the prefix trie over produce names and codes
+	suggestIndex *suggestIndex
+	// taxonomy holds the categories and tags and the items assigned to them
+	taxonomy *taxonomyIndex
+	// suppliers holds the suppliers and the produce each supplies
+	suppliers *supplierRegistry
+	// stores holds the store locations and their overrides of produce items
+	stores *storeRegistry
+	// quotaIndex caps the number of items.  It is only set, and kept in sync, when a quota applies.
+	quotaIndex *quotaIndex
+	// indexes holds every secondary index that must be kept in sync with Produce
+	indexes []secondaryIndex
 }
 
 // NewDB returns a new, clean db
 func NewDB(logger *logrus.Logger) *DB {
 
-	return &DB{
-		Produce: []*ProduceItem{},
-		logger:  logger,
-		mtx:     &sync.Mutex{},
+	d := &DB{
+		Produce:      []*ProduceItem{},
+		logger:       logger,
+		mtx:          &sync.Mutex{},
+		namePolicy:   DefaultNamePolicy(),
+		pluIndex:     newUniqueIndex(func(p *ProduceItem) string { return p.PLU }, ErrDuplicatePLU),
+		gtinIndex:    newUniqueIndex(func(p *ProduceItem) string { return p.GTIN }, ErrDuplicateGTIN),
+		searchIndex:  newSearchIndex(),
+		suggestIndex: newSuggestIndex(),
+		taxonomy:     newTaxonomyIndex(),
+		suppliers:    newSupplierRegistry(),
+		stores:       newStoreRegistry(),
+	}
+	d.indexes = []secondaryIndex{d.pluIndex, d.gtinIndex, d.searchIndex, d.suggestIndex, d.taxonomy}
+	return d
+}
+
+// SetRequireCheckChar turns on or off requiring a check character on the codes of new items.
+// Check characters that are sent are always verified.  Items already in the database, and lookups
+// by code, are not affected.
+func (d *DB) SetRequireCheckChar(require bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.requireCheckChar = require
+}
+
+// ParseCode validates a produce code for a new item and returns it in canonical form.
+// On top of the checks done by ParseProduceCode, codes without a check character are
+// rejected when the database requires one.
+func (d *DB) ParseCode(s string) (ProduceCode, error) {
+	code, err := ParseProduceCode(s)
+	if err != nil {
+		return "", err
+	}
+
+	d.mtx.Lock()
+	requireCheckChar := d.requireCheckChar
+	d.mtx.Unlock()
+
+	if requireCheckChar && !code.HasCheckChar() {
+		return "", ErrInvalidCheckChar
+	}
+	return code, nil
+}
+
+// SetNamePolicy changes the policy names of new items are checked against.
+// Items already in the database are not affected.
+func (d *DB) SetNamePolicy(np NamePolicy) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.namePolicy = np
+}
+
+// SetUniqueNames turns the case-insensitive unique name constraint on or off.  When it is on, adding
+// or updating an item to have the same name as a different item fails with ErrDuplicateName.
+// Turning it on fails with ErrDuplicateName, and leaves it off, if the database already holds
+// items whose names clash.
+func (d *DB) SetUniqueNames(unique bool) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	// drop any existing name index, it is rebuilt from scratch when turned on
+	indexes := d.indexes[:0]
+	for _, i := range d.indexes {
+		if i != d.nameIndex {
+			indexes = append(indexes, i)
+		}
+	}
+	d.indexes = indexes
+	d.nameIndex = nil
+
+	if !unique {
+		return nil
 	}
+
+	nameIndex := newUniqueIndex(nameKey, ErrDuplicateName)
+	for _, p := range d.Produce {
+		if err := nameIndex.check(p); err != nil {
+			return err
+		}
+		nameIndex.insert(p)
+	}
+	d.nameIndex = nameIndex
+	d.indexes = append(d.indexes, nameIndex)
+	return nil
+}
+
+// nameKey returns the name of the item normalized and case-folded so names that only
+// differ by case or whitespace have the same key
+func nameKey(p *ProduceItem) string {
+	return cases.Fold().String(NormalizeName(p.Name))
+}
+
+// ParseName validates a produce name against the database's name policy and
+// returns it normalized, see NormalizeName.
+func (d *DB) ParseName(n string) (string, error) {
+	d.mtx.Lock()
+	np := d.namePolicy
+	d.mtx.Unlock()
+
+	return np.Validate(n)
+}
+
+// validateLocalizedNames checks every localized name against the name policy and
+// stores the names under canonical language tags.
+func (d *DB) validateLocalizedNames(p *ProduceItem) error {
+	if len(p.LocalizedNames) == 0 {
+		p.LocalizedNames = nil
+		return nil
+	}
+
+	names := make(map[string]string, len(p.LocalizedNames))
+	for lang, n := range p.LocalizedNames {
+		tag, err := parseLangTag(lang)
+		if err != nil {
+			return ErrInvalidName
+		}
+		if names[tag], err = d.ParseName(n); err != nil {
+			return err
+		}
+	}
+	p.LocalizedNames = names
+	return nil
+}
+
+// GenerateCodes returns n new produce codes with valid check characters.  Each code is
+// unique within the batch and does not belong to any item currently in the database.
+// The codes are not reserved, they are only claimed once an item is added with them.
+func (d *DB) GenerateCodes(n int) ([]ProduceCode, error) {
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	codes := make([]ProduceCode, 0, n)
+	seen := map[ProduceCode]bool{}
+	for len(codes) < n {
+		code, err := GenerateProduceCode()
+		if err != nil {
+			return nil, err
+		}
+		if seen[code] || GetItemIndex(code, d.Produce, d.logger) != nil {
+			d.logger.Debugf("generated code %s collided, trying again", code)
+			continue
+		}
+		seen[code] = true
+		codes = append(codes, code)
+	}
+	return codes, nil
 }
 
 // List returns all Produce items in the database.
@@ -69,41 +313,224 @@ func (d *DB) List() []*ProduceItem {
 }
 
 // Get returns the item with the passed code
+// If the code is invalid a ErrInvalidCode is returned
 // If the item is not found a ErrNotFound is returned
-func (d *DB) Get(code string) (*ProduceItem, error) {
+func (d *DB) Get(code ProduceCode) (*ProduceItem, error) {
 
-	if !CodeIsValid(code, d.logger) {
-		return nil, ErrInvalidCode
+	code, err := ParseProduceCode(string(code))
+	if err != nil {
+		return nil, err
 	}
 
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
 	var idx *int
 	if idx = GetItemIndex(code, d.Produce, d.logger); idx == nil {
 		return &ProduceItem{}, ErrNotFound
 	}
-	d.mtx.Lock()
-	defer d.mtx.Unlock()
 	return d.Produce[*idx], nil
 
 }
 
 // Delete will look  for matching code in db and
-// if found remove the item.  If the produce code is not
+// if found remove the item.  If the produce code is
+// invalid an ErrInvalidCode error is returned and if it is not
 // found in the database an ErrNotFound error is returned.
-func (d *DB) Delete(code string) error {
+func (d *DB) Delete(code ProduceCode) error {
+
+	code, err := ParseProduceCode(string(code))
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
 
 	idx := GetItemIndex(code, d.Produce, d.logger)
 	if idx == nil {
 		return ErrNotFound
 	}
+	d.remove(*idx)
+
+	return nil
+
+}
+
+// DeleteAll removes every item with a code in codes, or nothing at all.  If any of
+// the codes are not found in the database no items are removed and an ErrNotFound
+// is returned along with the codes that were missing.  The codes must already be
+// valid, see ParseProduceCode.
+func (d *DB) DeleteAll(codes []ProduceCode) ([]ProduceCode, error) {
 
 	d.mtx.Lock()
-	d.Produce[*idx] = d.Produce[len(d.Produce)-1]
+	defer d.mtx.Unlock()
+
+	var missing []ProduceCode
+	for _, c := range codes {
+		if GetItemIndex(c, d.Produce, d.logger) == nil {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return missing, ErrNotFound
+	}
+
+	// look each code up again as remove shuffles the remaining items.
+	// repeated codes have already been removed by the time they are looked up again.
+	for _, c := range codes {
+		if idx := GetItemIndex(c, d.Produce, d.logger); idx != nil {
+			d.remove(*idx)
+		}
+	}
+
+	return nil, nil
+}
+
+// Find returns all produce items matching the filter.  Items in any category below
+// the filter's category match as well.
+func (d *DB) Find(f ProduceFilter) []*ProduceItem {
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if f.Category != "" {
+		f.subtree = d.taxonomy.subtree(strings.ToLower(f.Category))
+	}
+
+	found := []*ProduceItem{}
+	for _, p := range d.Produce {
+		if f.Match(p) {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// GetByPLU returns the item carrying the PLU.
+// If the PLU is invalid a ErrInvalidPLU is returned
+// If no item has the PLU a ErrNotFound is returned
+func (d *DB) GetByPLU(plu string) (*ProduceItem, error) {
+	plu, err := ParsePLU(plu)
+	if err != nil {
+		return nil, err
+	}
+	return d.getByIndex(d.pluIndex, plu)
+}
+
+// GetByGTIN returns the item carrying the GTIN.  Any of the GTIN-8, 12, 13 or 14 forms can be used.
+// If the GTIN is invalid a ErrInvalidGTIN is returned
+// If no item has the GTIN a ErrNotFound is returned
+func (d *DB) GetByGTIN(gtin string) (*ProduceItem, error) {
+	gtin, err := ParseGTIN(gtin)
+	if err != nil {
+		return nil, err
+	}
+	return d.getByIndex(d.gtinIndex, gtin)
+}
+
+// Search finds up to limit produce items whose names match the query, best match first, with
+// their names in the language lang where they have one.  Matching tolerates prefixes and typos,
+// see searchIndex.search.
+func (d *DB) Search(q string, limit int, lang string) []SearchResult {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.searchIndex.search(q, limit, lang)
+}
+
+// Suggest returns up to limit produce items whose name, any word in the name, or code
+// starts with prefix, see suggestIndex.suggest.
+func (d *DB) Suggest(prefix string, limit int) []*ProduceItem {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.suggestIndex.suggest(prefix, limit)
+}
+
+// getByIndex resolves key to an item through a unique index
+func (d *DB) getByIndex(u *uniqueIndex, key string) (*ProduceItem, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	code, ok := u.get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	idx := GetItemIndex(code, d.Produce, d.logger)
+	if idx == nil {
+		return nil, ErrNotFound
+	}
+	return d.Produce[*idx], nil
+}
+
+// checkIndexes returns the first conflict p has with any secondary index.
+// The caller must hold mtx.
+func (d *DB) checkIndexes(p *ProduceItem) error {
+	for _, i := range d.indexes {
+		if err := i.check(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert appends p and adds it to every secondary index.
+// The caller must hold mtx.
+func (d *DB) insert(p *ProduceItem) {
+	d.Produce = append(d.Produce, p)
+	for _, i := range d.indexes {
+		i.insert(p)
+	}
+}
+
+// replace swaps the item at idx for p and updates every secondary index.
+// The caller must hold mtx.
+func (d *DB) replace(idx int, p *ProduceItem) {
+	for _, i := range d.indexes {
+		i.remove(d.Produce[idx])
+	}
+	d.Produce[idx] = p
+	for _, i := range d.indexes {
+		i.insert(p)
+	}
+}
+
+// remove drops the item at idx by moving the last item into its place,
+// and drops it from every secondary index, its supplies and store overrides.
+// The caller must hold mtx.
+func (d *DB) remove(idx int) {
+	for _, i := range d.indexes {
+		i.remove(d.Produce[idx])
+	}
+	d.suppliers.forget(d.Produce[idx].Code)
+	d.stores.forget(d.Produce[idx].Code)
+	d.Produce[idx] = d.Produce[len(d.Produce)-1]
 	d.Produce[len(d.Produce)-1] = nil
 	d.Produce = d.Produce[:len(d.Produce)-1]
-	d.mtx.Unlock()
+}
 
-	return nil
+// sandbox returns a copy of the database that Add and Upsert can be run against without touching
+// d, so a dry run of a batch sees the items earlier in the batch just as the real run would.  The
+// copy holds the items and every index that can reject an item, such as the unique name, PLU and
+// GTIN indexes, the taxonomy and the quota, but not the search indexes, suppliers or stores.
+func (d *DB) sandbox() *DB {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
 
+	s := &DB{
+		Produce:          append([]*ProduceItem{}, d.Produce...),
+		logger:           d.logger,
+		mtx:              &sync.Mutex{},
+		requireCheckChar: d.requireCheckChar,
+		namePolicy:       d.namePolicy,
+		suppliers:        newSupplierRegistry(),
+		stores:           newStoreRegistry(),
+	}
+	for _, i := range d.indexes {
+		if c, ok := i.(cloneableIndex); ok {
+			s.indexes = append(s.indexes, c.clone())
+		}
+	}
+	return s
 }
 
 // Add creates new items in the database
@@ -111,38 +538,165 @@ func (d *DB) Delete(code string) error {
 // already exists with the same code.
 func (d *DB) Add(p *ProduceItem) error {
 
+	if err := d.validateItem(p); err != nil {
+		return err
+	}
+
+	// lock, check for an existing item with the same code, write, unlock
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if GetItemIndex(p.Code, d.Produce, d.logger) != nil {
+		return ErrDuplicateItem
+	}
+	if err := d.checkIndexes(p); err != nil {
+		return err
+	}
+	d.insert(p)
+
+	return nil
+}
+
+// Validate runs every check Add would run against the produce item, including
+// the check for an existing item with the same code, without writing to the database.
+// The unit price of p is rounded to two decimal places just as it would be by Add.
+func (d *DB) Validate(p *ProduceItem) error {
+
+	if err := d.validateItem(p); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if GetItemIndex(p.Code, d.Produce, d.logger) != nil {
+		return ErrDuplicateItem
+	}
+
+	return d.checkIndexes(p)
+}
+
+// UpsertOutcome describes what Upsert did, or would do, with a produce item
+type UpsertOutcome int
+
+const (
+	// UpsertCreated means no item existed with the code and the item was added
+	UpsertCreated UpsertOutcome = iota
+	// UpsertUpdated means an item existed with the code and it was replaced
+	UpsertUpdated
+	// UpsertUnchanged means an identical item already existed so nothing was written
+	UpsertUnchanged
+)
+
+// Upsert adds the produce item to the database, or replaces the existing item with the same code.
+// The whole item is replaced, so fields left out of p, such as its categories, tags, PLU, GTIN or
+// localized names, are cleared rather than kept from the existing item.  Replacing an item with an
+// identical one is a no-op and returns UpsertUnchanged.
+func (d *DB) Upsert(p *ProduceItem) (UpsertOutcome, error) {
+
+	if err := d.validateItem(p); err != nil {
+		return 0, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	idx := GetItemIndex(p.Code, d.Produce, d.logger)
+	outcome := upsertOutcome(p, d.Produce, idx)
+	if outcome == UpsertUnchanged {
+		return outcome, nil
+	}
+	if err := d.checkIndexes(p); err != nil {
+		return 0, err
+	}
+	if outcome == UpsertCreated {
+		d.insert(p)
+	} else {
+		d.replace(*idx, p)
+	}
+
+	return outcome, nil
+}
+
+// CheckUpsert runs every check Upsert would run against the produce item and reports what
+// Upsert would do with it, without writing to the database.
+func (d *DB) CheckUpsert(p *ProduceItem) (UpsertOutcome, error) {
+
+	if err := d.validateItem(p); err != nil {
+		return 0, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	outcome := upsertOutcome(p, d.Produce, GetItemIndex(p.Code, d.Produce, d.logger))
+	if outcome == UpsertUnchanged {
+		return outcome, nil
+	}
+	if err := d.checkIndexes(p); err != nil {
+		return 0, err
+	}
+	return outcome, nil
+}
+
+// upsertOutcome compares p with the item at idx, if any, to decide what an upsert would do.
+func upsertOutcome(p *ProduceItem, pi []*ProduceItem, idx *int) UpsertOutcome {
+	if idx == nil {
+		return UpsertCreated
+	}
+	if reflect.DeepEqual(*pi[*idx], *p) {
+		return UpsertUnchanged
+	}
+	return UpsertUpdated
+}
+
+// validateItem checks the code, name, and unit price of the produce item,
+// converts the code to upper case and rounds the unit price to two decimal places.
+func (d *DB) validateItem(p *ProduceItem) error {
+
 	// check for valid code
-	if !CodeIsValid(p.Code, d.logger) {
-		return ErrInvalidCode
+	code, err := d.ParseCode(string(p.Code))
+	if err != nil {
+		d.logger.Debug("ERR: code validation error: ", p.Code, err.Error())
+		return err
 	}
+	p.Code = code
 
-	// check if name is valid
-	if !NameIsValid(p.Name, d.logger) {
-		return ErrInvalidName
+	// check if name is valid, storing the normalized name
+	if p.Name, err = d.ParseName(p.Name); err != nil {
+		return err
+	}
+	if err = d.validateLocalizedNames(p); err != nil {
+		return err
 	}
 
 	// check if price is valid
-	var err error
 	if !PriceIsValid(p.UnitPrice, d.logger) {
 		return ErrInvalidUnitPrice
 	}
 
+	// check the optional identifiers, storing the GTIN in its fourteen digit form
+	if p.PLU != "" {
+		if p.PLU, err = ParsePLU(p.PLU); err != nil {
+			return err
+		}
+	}
+	if p.GTIN != "" {
+		if p.GTIN, err = ParseGTIN(p.GTIN); err != nil {
+			return err
+		}
+	}
+
+	// check the category and tag ids are well formed, that they exist is checked by the taxonomy index
+	if p.Categories, err = parseSlugs(p.Categories, ErrInvalidCategory); err != nil {
+		return err
+	}
+	if p.Tags, err = parseSlugs(p.Tags, ErrInvalidTag); err != nil {
+		return err
+	}
+
 	// ensure the produce unit price is at max two decimal places.
 	p.UnitPrice, err = strconv.ParseFloat(fmt.Sprintf("%0.2f", p.UnitPrice), 64)
 	if err != nil {
 		return ErrInvalidUnitPrice
 	}
 
-	// do a quick check to see if the produce code is already in the database
-	if GetItemIndex(p.Code, d.Produce, d.logger) != nil {
-		return ErrDuplicateItem
-	}
-
-	// lock, write, unlock
-	d.mtx.Lock()
-	d.Produce = append(d.Produce, p)
-	d.mtx.Unlock()
-
 	return nil
 }
 
@@ -159,33 +713,35 @@ func PriceIsValid(p float64, logger *logrus.Logger) bool {
 }
 
 // NameIsValid verifies that the name for a produce item is
-// alphanumeric and case-insensitive.
+// alphanumeric and case-insensitive according to the DefaultNamePolicy.
+// Letters from any script are allowed and whitespace is collapsed
+// before the name is checked.
 func NameIsValid(n string, logger *logrus.Logger) bool {
-	match, err := regexp.MatchString(`^[a-zA-Z0-9\s]+$`, n)
-	if err != nil {
-		logger.Debug("ERR: name validation error: ", n, match, err.Error())
+	if _, err := DefaultNamePolicy().Validate(n); err != nil {
+		logger.Debug("ERR: name validation error: ", n, err.Error())
 		return false
 	}
-	return match
+	return true
 }
 
 // CodeIsValid verifies that all produce codes are case-insensitive, alphanumeric strings
-// that are in four groups of four with each group separated by a hyphen.
+// that are in four groups of four with each group separated by a hyphen.  The whole string
+// must be a code, leading or trailing characters make it invalid, apart from a check character
+// after the last group, which must match the rest of the code (see HasValidCheckChar).
 // valid code example: aaa1-bbb2-ccc3-ddd4
 func CodeIsValid(c string, logger *logrus.Logger) bool {
-	match, err := regexp.MatchString("[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}", c)
-	if err != nil {
-		logger.Debug("ERR: code validation error: ", c, match, err.Error())
+	if _, err := ParseProduceCode(c); err != nil {
+		logger.Debug("ERR: code validation error: ", c, err.Error())
 		return false
 	}
-	return match
+	return true
 }
 
 // GetItemIndex returns a pointer to the zero-based index for the position the produce item is found
 // if no produce item is found, a nil value is returned.
-func GetItemIndex(c string, pi []*ProduceItem, logger *logrus.Logger) *int {
+func GetItemIndex(c ProduceCode, pi []*ProduceItem, logger *logrus.Logger) *int {
 	for i := 0; i < len(pi); i++ {
-		if strings.ToLower(c) == strings.ToLower(pi[i].Code) {
+		if strings.EqualFold(string(c), string(pi[i].Code)) {
 			logger.Debugf("code %s found at index %d", c, i)
 			return &i
 		}
@@ -73,6 +73,26 @@ func Test_CodeIsValid(t *testing.T) {
 			args: args{c: "e5t69ui3th15qr88", logger: logrus.New()},
 			want: false,
 		},
+		{
+			name: "seven-leading-chars",
+			args: args{c: "xxe5t6-9ui3-th15-qr88", logger: logrus.New()},
+			want: false,
+		},
+		{
+			name: "eight-trailing-chars",
+			args: args{c: "e5t6-9ui3-th15-qr88xxx", logger: logrus.New()},
+			want: false,
+		},
+		{
+			name: "nine-check-char",
+			args: args{c: "e5t6-9ui3-th15-qr88m", logger: logrus.New()},
+			want: true,
+		},
+		{
+			name: "ten-bad-check-char",
+			args: args{c: "e5t6-9ui3-th15-qr88n", logger: logrus.New()},
+			want: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -119,6 +139,26 @@ func Test_nameIsValid(t *testing.T) {
 			args: args{n: "I am Valid", logger: logrus.New()},
 			want: true,
 		},
+		{
+			name: "valid accented name",
+			args: args{n: "Jalapeño", logger: logrus.New()},
+			want: true,
+		},
+		{
+			name: "valid name with parentheses",
+			args: args{n: "Pak Choi (baby)", logger: logrus.New()},
+			want: true,
+		},
+		{
+			name: "invalid whitespace only name",
+			args: args{n: " \t\n ", logger: logrus.New()},
+			want: false,
+		},
+		{
+			name: "invalid empty name",
+			args: args{n: "", logger: logrus.New()},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -222,7 +262,7 @@ func TestDB_Get(t *testing.T) {
 		// add item to the db
 		db.Add(p)
 
-		if !CodeIsValid(p.Code, logger) {
+		if !CodeIsValid(p.Code.String(), logger) {
 			_, getErr := db.Get(p.Code)
 			a.Equal(ErrInvalidCode, getErr)
 		} else {
@@ -270,7 +310,7 @@ func TestDB_List(t *testing.T) {
 
 func Test_getItemIndex(t *testing.T) {
 	type args struct {
-		c      string
+		c      ProduceCode
 		pi     []*ProduceItem
 		logger *logrus.Logger
 	}
@@ -402,3 +442,164 @@ func ExamplePriceIsValid_second() {
 func intP(i int) *int {
 	return &i
 }
+
+func TestDB_Validate(t *testing.T) {
+	a := assert.New(t)
+	db := NewDB(logrus.New())
+	a.NoError(db.Add(&ProduceItem{Name: "carrot", Code: "1234-1234-1234-1234", UnitPrice: 1.02}))
+
+	p := &ProduceItem{Name: "bean", Code: "2345-2345-2345-2345", UnitPrice: 3.555}
+	a.NoError(db.Validate(p))
+	a.Equal(3.56, p.UnitPrice)
+
+	a.Equal(ErrDuplicateItem, db.Validate(&ProduceItem{Name: "carrot", Code: "1234-1234-1234-1234", UnitPrice: 1.02}))
+	a.Equal(ErrInvalidCode, db.Validate(&ProduceItem{Name: "carrot", Code: "1234", UnitPrice: 1.02}))
+	a.Equal(ErrInvalidName, db.Validate(&ProduceItem{Name: "c@rrot", Code: "3456-1234-1234-1234", UnitPrice: 1.02}))
+	a.Equal(ErrInvalidUnitPrice, db.Validate(&ProduceItem{Name: "carrot", Code: "3456-1234-1234-1234", UnitPrice: -1}))
+
+	// nothing was written
+	a.Len(db.List(), 1)
+}
+
+func TestDB_Upsert(t *testing.T) {
+	a := assert.New(t)
+	db := NewDB(logrus.New())
+
+	outcome, err := db.Upsert(&ProduceItem{Name: "carrot", Code: "1234-1234-ABCD-1234", UnitPrice: 1.02})
+	a.NoError(err)
+	a.Equal(UpsertCreated, outcome)
+
+	// same item, code in a different case
+	outcome, err = db.Upsert(&ProduceItem{Name: "carrot", Code: "1234-1234-abcd-1234", UnitPrice: 1.021})
+	a.NoError(err)
+	a.Equal(UpsertUnchanged, outcome)
+
+	// CheckUpsert reports without writing
+	outcome, err = db.CheckUpsert(&ProduceItem{Name: "carrot", Code: "1234-1234-ABCD-1234", UnitPrice: 0.99})
+	a.NoError(err)
+	a.Equal(UpsertUpdated, outcome)
+	a.Equal(1.02, db.Produce[0].UnitPrice)
+
+	outcome, err = db.Upsert(&ProduceItem{Name: "carrot", Code: "1234-1234-abcd-1234", UnitPrice: 0.99})
+	a.NoError(err)
+	a.Equal(UpsertUpdated, outcome)
+	a.Len(db.List(), 1)
+	a.Equal(0.99, db.Produce[0].UnitPrice)
+	a.Equal(ProduceCode("1234-1234-ABCD-1234"), db.Produce[0].Code)
+
+	_, err = db.Upsert(&ProduceItem{Name: "carrot", Code: "1234-1234-ABCD-1234", UnitPrice: -1})
+	a.Equal(ErrInvalidUnitPrice, err)
+
+	// the whole item is replaced, fields left out are cleared
+	_, err = db.Upsert(&ProduceItem{Name: "carrot", Code: "1234-1234-ABCD-1234", UnitPrice: 0.99, PLU: "4562", LocalizedNames: map[string]string{"es": "zanahoria"}})
+	a.NoError(err)
+	outcome, err = db.Upsert(&ProduceItem{Name: "carrot", Code: "1234-1234-ABCD-1234", UnitPrice: 0.99})
+	a.NoError(err)
+	a.Equal(UpsertUpdated, outcome)
+	p, err := db.Get("1234-1234-ABCD-1234")
+	a.NoError(err)
+	a.Empty(p.PLU)
+	a.Nil(p.LocalizedNames)
+}
+
+func TestDB_DeleteAll(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	missing, err := db.DeleteAll([]ProduceCode{"A12T-4GH7-QPL9-3N4M", "0000-0000-0000-0000"})
+	a.Equal(ErrNotFound, err)
+	a.Equal([]ProduceCode{"0000-0000-0000-0000"}, missing)
+	a.Len(db.List(), 4)
+
+	missing, err = db.DeleteAll([]ProduceCode{"A12T-4GH7-QPL9-3N4M", "a12t-4gh7-qpl9-3n4m", "TQ4C-VV6T-75ZX-1RMR"})
+	a.NoError(err)
+	a.Empty(missing)
+	a.Len(db.List(), 2)
+}
+
+func TestDB_Find(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	price := func(f float64) *float64 { return &f }
+
+	a.Len(db.Find(ProduceFilter{}), 4)
+	a.Len(db.Find(ProduceFilter{Name: "e"}), 4)
+	a.Len(db.Find(ProduceFilter{Name: "apple"}), 1)
+	a.Len(db.Find(ProduceFilter{MaxPrice: price(2.99)}), 2)
+	a.Len(db.Find(ProduceFilter{MinPrice: price(3.00)}), 2)
+	a.Len(db.Find(ProduceFilter{Name: "a", MinPrice: price(1), MaxPrice: price(3)}), 1)
+	a.Empty(db.Find(ProduceFilter{Name: "kiwi"}))
+}
+
+func TestDB_SetRequireCheckChar(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	// off by default, but a check character that is sent must match
+	a.NoError(db.Add(&ProduceItem{Name: "kiwi", Code: "0000-0000-0000-0001", UnitPrice: 1}))
+	a.Equal(ErrInvalidCheckChar, db.Add(&ProduceItem{Name: "kiwi", Code: "0000-0000-0000-00001", UnitPrice: 1}))
+
+	db.SetRequireCheckChar(true)
+	err = db.Add(&ProduceItem{Name: "kiwi", Code: "0000-0000-0000-0002", UnitPrice: 1})
+	a.Equal(ErrInvalidCheckChar, err)
+	a.ErrorIs(err, ErrInvalidCode)
+	a.NoError(db.Add(&ProduceItem{Name: "kiwi", Code: "0000-0000-0000-00000", UnitPrice: 1}))
+
+	// existing codes without a check character can still be looked up
+	_, err = db.Get("A12T-4GH7-QPL9-3N4M")
+	a.NoError(err)
+}
+
+func TestDB_GenerateCodes(t *testing.T) {
+	a := assert.New(t)
+	db := NewDB(logrus.New())
+	db.SetRequireCheckChar(true)
+
+	codes, err := db.GenerateCodes(10)
+	a.NoError(err)
+	a.Len(codes, 10)
+	for _, c := range codes {
+		a.NoError(db.Add(&ProduceItem{Name: "generated", Code: c, UnitPrice: 1}))
+	}
+}
+
+func TestDB_SetUniqueNames(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	// off by default
+	a.NoError(db.Add(&ProduceItem{Name: "gala apple", Code: "GALA-0000-0000-0001", UnitPrice: 1}))
+
+	// can't be turned on while names clash
+	a.Equal(ErrDuplicateName, db.SetUniqueNames(true))
+	a.NoError(db.Delete("GALA-0000-0000-0001"))
+	a.NoError(db.SetUniqueNames(true))
+
+	a.Equal(ErrDuplicateName, db.Add(&ProduceItem{Name: "GALA  apple", Code: "GALA-0000-0000-0002", UnitPrice: 1}))
+	a.Equal(ErrDuplicateName, db.Validate(&ProduceItem{Name: "gala apple", Code: "GALA-0000-0000-0002", UnitPrice: 1}))
+	_, err = db.Upsert(&ProduceItem{Name: "Gala Apple", Code: "A12T-4GH7-QPL9-3N4M", UnitPrice: 1})
+	a.Equal(ErrDuplicateName, err)
+
+	// an item can keep its own name when it is updated
+	outcome, err := db.Upsert(&ProduceItem{Name: "gala apple", Code: "TQ4C-VV6T-75ZX-1RMR", UnitPrice: 3.99})
+	a.NoError(err)
+	a.Equal(UpsertUpdated, outcome)
+
+	// renaming frees the old name
+	_, err = db.Upsert(&ProduceItem{Name: "Fuji Apple", Code: "TQ4C-VV6T-75ZX-1RMR", UnitPrice: 3.99})
+	a.NoError(err)
+	a.NoError(db.Add(&ProduceItem{Name: "Gala Apple", Code: "GALA-0000-0000-0002", UnitPrice: 1}))
+
+	// deleting frees the name too
+	a.NoError(db.Delete("GALA-0000-0000-0002"))
+	a.NoError(db.Add(&ProduceItem{Name: "Gala Apple", Code: "GALA-0000-0000-0003", UnitPrice: 1}))
+
+	// and turning it off allows clashes again
+	a.NoError(db.SetUniqueNames(false))
+	a.NoError(db.Add(&ProduceItem{Name: "Gala Apple", Code: "GALA-0000-0000-0004", UnitPrice: 1}))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// bucketIdleSweep is how often buckets that have refilled are dropped so clients that have gone
+// away don't hold memory
+const bucketIdleSweep = time.Minute
+
+// RateLimit lets a client make Burst requests at once, refilled at Rate requests a second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// bucket is the token bucket of one client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a set of token buckets, one per client, sharing a limit
+type RateLimiter struct {
+	limit     RateLimit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mtx       *sync.Mutex
+	now       func() time.Time
+}
+
+// NewRateLimiter returns a limiter where every client starts with a full bucket
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, buckets: map[string]*bucket{}, mtx: &sync.Mutex{}, now: time.Now}
+}
+
+// allow takes a token from the client's bucket.  It returns whether there was one, the tokens left,
+// and how long until the next token and until the bucket is full again.
+func (l *RateLimiter) allow(client string) (ok bool, remaining int, retryAfter, reset time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	burst := float64(l.limit.Burst)
+	if now.Sub(l.lastSweep) > bucketIdleSweep {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b := l.refill(client, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = seconds((1 - b.tokens) / l.limit.Rate)
+	}
+	return ok, int(b.tokens), retryAfter, seconds((burst - b.tokens) / l.limit.Rate)
+}
+
+// empty reports whether the client's bucket has no token left, without taking one, and how long
+// until it has one again
+func (l *RateLimiter) empty(client string) (bool, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.buckets[client] == nil {
+		return false, 0
+	}
+	b := l.refill(client, l.now())
+	if b.tokens >= 1 {
+		return false, 0
+	}
+	return true, seconds((1 - b.tokens) / l.limit.Rate)
+}
+
+// refill returns the client's bucket topped up with the tokens earned since it was last used,
+// starting it full for a new client.  The caller must hold mtx.
+func (l *RateLimiter) refill(client string, now time.Time) *bucket {
+	b := l.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	return b
+}
+
+// seconds converts a number of seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimits holds the limiter for each configured route and the default limiter for the rest.
+// Routes are matched by method and chi route pattern, e.g. GET /api/v1/produce, with tenant
+// routes sharing the limit of their shared catalogue route.
+type RateLimits struct {
+	routes map[string]*RateLimiter
+	// fallback applies to routes without a limit of their own.  No limit when nil.
+	fallback *RateLimiter
+}
+
+// ParseRateLimits reads rules separated by ;, each of the form route=requests/unit with an
+// optional :burst, e.g.
+//
+//	*=20/s:40;GET /api/v1/produce=5/s:10;POST /api/v1/produce=1/m
+//
+// The route * sets the default limit.  Units are s, m and h, and the burst defaults to the number
+// of requests.  An empty string turns rate limiting off and returns nil.
+func ParseRateLimits(s string) (*RateLimits, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	rl := &RateLimits{routes: map[string]*RateLimiter{}}
+	for _, rule := range strings.Split(s, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		route, limitStr, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected route=requests/unit", rule)
+		}
+		limit, err := parseRateLimit(strings.TrimSpace(limitStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q: %w", rule, err)
+		}
+
+		route = strings.Join(strings.Fields(route), " ")
+		if route == "*" {
+			rl.fallback = NewRateLimiter(limit)
+			continue
+		}
+		method, pattern, ok := strings.Cut(route, " ")
+		if !ok || !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("invalid rate limit route %q, expected * or METHOD /path", route)
+		}
+		rl.routes[strings.ToUpper(method)+" "+strings.TrimSuffix(pattern, "/")] = NewRateLimiter(limit)
+	}
+	return rl, nil
+}
+
+// parseRateLimit reads requests/unit[:burst]
+func parseRateLimit(s string) (RateLimit, error) {
+	rate, burstStr, hasBurst := strings.Cut(s, ":")
+	countStr, unit, ok := strings.Cut(rate, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("missing unit")
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count <= 0 {
+		return RateLimit{}, fmt.Errorf("requests must be a positive number")
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return RateLimit{}, fmt.Errorf("unit must be s, m or h")
+	}
+
+	limit := RateLimit{Rate: float64(count) / per.Seconds(), Burst: count}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burstStr); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("burst must be a positive number")
+		}
+	}
+	return limit, nil
+}
+
+// limiter returns the limiter for the method and route pattern, or nil if the route isn't limited
+func (rl *RateLimits) limiter(method, pattern string) *RateLimiter {
+	pattern = strings.TrimPrefix(pattern, "/tenants/{tenant}")
+	if l := rl.routes[method+" "+strings.TrimSuffix(pattern, "/")]; l != nil {
+		return l
+	}
+	return rl.fallback
+}
+
+// rateLimitClient identifies who a request is counted against: the authenticated caller, or the
+// client ip address for anonymous requests.  middleware.RealIP has already replaced RemoteAddr
+// with the address from X-Forwarded-For or X-Real-IP when a proxy set one.
+func rateLimitClient(r *http.Request) string {
+	if id := principalID(r.Context()); id != "" {
+		return id
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the ip address of the client, see rateLimitClient
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// peerAddrCtxKey is the context key of the request's connection address, see peerAddrMW
+type peerAddrCtxKey struct{}
+
+// peerAddrMW saves the address of the connection on the request context before middleware.RealIP
+// replaces RemoteAddr with one taken from the forwarding headers
+func peerAddrMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerAddrCtxKey{}, r.RemoteAddr)))
+	})
+}
+
+// peerIP returns the ip address of the connection the request came in on.  Unlike clientIP it
+// can't be picked by the client with an X-Forwarded-For or X-Real-IP header.
+func peerIP(r *http.Request) string {
+	addr, ok := r.Context().Value(peerAddrCtxKey{}).(string)
+	if !ok {
+		addr = r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return host
+}
+
+// rateLimitMW counts the request against the client's bucket for the route and rejects it with a
+// 429 when the bucket is empty.  Every limited response carries RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, and a 429 also has Retry-After, all in whole
+// seconds.  It must run on a route, with chi's route pattern complete, so is added with With.
+func (h *Handler) rateLimitMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rateLimits := h.settings().rateLimits
+		if rateLimits == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		l := rateLimits.limiter(r.Method, chi.RouteContext(r.Context()).RoutePattern())
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, remaining, retryAfter, reset := l.allow(rateLimitClient(r))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(l.limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeProblem(w, http.StatusTooManyRequests, "rate limit exceeded, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	a := assert.New(t)
+
+	rl, err := ParseRateLimits("")
+	a.NoError(err)
+	a.Nil(rl)
+
+	rl, err = ParseRateLimits("*=20/s:40; get  /api/v1/produce/ =5/m ;POST /api/v1/produce=1/h:3")
+	a.NoError(err)
+	a.Equal(RateLimit{Rate: 20, Burst: 40}, rl.fallback.limit)
+	a.Equal(RateLimit{Rate: 5.0 / 60, Burst: 5}, rl.routes["GET /api/v1/produce"].limit)
+	a.Equal(RateLimit{Rate: 1.0 / 3600, Burst: 3}, rl.routes["POST /api/v1/produce"].limit)
+
+	a.Equal(rl.routes["GET /api/v1/produce"], rl.limiter("GET", "/api/v1/produce/"))
+	a.Equal(rl.routes["GET /api/v1/produce"], rl.limiter("GET", "/tenants/{tenant}/api/v1/produce/"))
+	a.Equal(rl.fallback, rl.limiter("GET", "/api/v1/produce/{code}/"))
+
+	rl, err = ParseRateLimits("GET /api/v1/produce=5/s")
+	a.NoError(err)
+	a.Nil(rl.limiter("GET", "/api/v1/tags/"))
+
+	for _, s := range []string{
+		"*",
+		"*=5",
+		"*=5/d",
+		"*=0/s",
+		"*=five/s",
+		"*=5/s:0",
+		"*=5/s:x",
+		"GET=5/s",
+		"GET api/v1/produce=5/s",
+	} {
+		_, err := ParseRateLimits(s)
+		a.Error(err, s)
+	}
+}
+
+func TestRateLimiter_allow(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(1700000000, 0)
+	l := NewRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	// a full bucket allows a burst, then refills at the rate
+	for want := 2; want >= 0; want-- {
+		ok, remaining, _, _ := l.allow("a")
+		a.True(ok)
+		a.Equal(want, remaining)
+	}
+	ok, remaining, retryAfter, reset := l.allow("a")
+	a.False(ok)
+	a.Equal(0, remaining)
+	a.Equal(500*time.Millisecond, retryAfter)
+	a.Equal(1500*time.Millisecond, reset)
+
+	// other clients have their own bucket
+	ok, _, _, _ = l.allow("b")
+	a.True(ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _, _, _ = l.allow("a")
+	a.True(ok)
+	ok, _, _, _ = l.allow("a")
+	a.False(ok)
+
+	// buckets that have refilled are dropped once idle
+	now = now.Add(2 * time.Minute)
+	l.allow("c")
+	a.Len(l.buckets, 1)
+}
+
+func TestHandler_RateLimits(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	h.tenants = NewTenantRegistry()
+	a.NoError(h.tenants.Add(Tenant{ID: "acme", CredentialSHA256: credentialHash("acme-secret")}, NewDB(logger)))
+	rateLimits, err := ParseRateLimits("*=100/s;GET /api/v1/produce=2/h")
+	a.NoError(err)
+	h.updateSettings(func(s *liveSettings) { s.rateLimits = rateLimits })
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	get := func(path, realIP string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, &bytes.Buffer{})
+		a.NoError(err)
+		req.Header.Set("X-Real-IP", realIP)
+		if strings.HasPrefix(path, "/tenants/acme/") {
+			req.Header.Set(TenantHeader, "acme-secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	for want := 1; want >= 0; want-- {
+		rr := get("/api/v1/produce", "10.0.0.1")
+		a.Equal(200, rr.StatusCode)
+		a.Equal("2", rr.Header.Get("RateLimit-Limit"))
+		a.Equal(string(rune('0'+want)), rr.Header.Get("RateLimit-Remaining"))
+	}
+	rr := get("/api/v1/produce", "10.0.0.1")
+	a.Equal(429, rr.StatusCode)
+	a.Equal("application/problem+json", rr.Header.Get("Content-Type"))
+	a.Equal("1800", rr.Header.Get("Retry-After"))
+	a.Equal("3600", rr.Header.Get("RateLimit-Reset"))
+
+	// the tenant route shares the limit, other routes fall back to the default, and other
+	// clients are unaffected
+	a.Equal(429, get("/tenants/acme/api/v1/produce", "10.0.0.1").StatusCode)
+	rr = get("/api/v1/produce/A12T-4GH7-QPL9-3N4M", "10.0.0.1")
+	a.Equal(200, rr.StatusCode)
+	a.Equal("100", rr.Header.Get("RateLimit-Limit"))
+	a.Equal(200, get("/api/v1/produce", "10.0.0.2").StatusCode)
+	a.Equal("", get("/ping", "10.0.0.1").Header.Get("RateLimit-Limit"))
+}
+
+func TestHandler_RateLimitsIdempotencyRetry(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	rateLimits, err := ParseRateLimits("POST /api/v1/categories=1/m")
+	a.NoError(err)
+	now := time.Now()
+	rateLimits.limiter("POST", "/api/v1/categories").now = func() time.Time { return now }
+	h.updateSettings(func(s *liveSettings) { s.rateLimits = rateLimits })
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	post := func(key, body string) *http.Response {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/categories", bytes.NewBufferString(body))
+		a.NoError(err)
+		req.Header.Set(IdempotencyKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	a.Equal(201, post("key-1", `{"id": "fruit", "name": "Fruit"}`).StatusCode)
+	a.Equal(429, post("key-2", `{"id": "veg", "name": "Vegetables"}`).StatusCode)
+
+	// the 429 isn't replayed once the bucket has refilled, the retry is carried out
+	now = now.Add(time.Minute)
+	rr := post("key-2", `{"id": "veg", "name": "Vegetables"}`)
+	a.Equal(201, rr.StatusCode)
+	a.Empty(rr.Header.Get(IdempotentReplayHeader))
+}
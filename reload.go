@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/cors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configPollInterval is how often the config file is checked for changes
+	configPollInterval = 2 * time.Second
+	// defaultCORSMaxAge is how long browsers may cache preflight responses, the most not ignored
+	// by any of the major browsers
+	defaultCORSMaxAge = 5 * time.Minute
+)
+
+// liveSettings are the handler settings a config reload can change.  They are replaced as a
+// whole so each request sees one consistent set.
+type liveSettings struct {
+	// anonymousRead lets callers without credentials use viewer routes when authentication is on
+	anonymousRead bool
+	// rateLimits limits how often each client may call each route.  No limits when nil.
+	rateLimits *RateLimits
+	// maxBulkItems caps the items in one AddProduce request.  No cap when 0.
+	maxBulkItems int
+	cors         *cors.Cors
+}
+
+// newCORS returns the cors handler for the allowed origins
+func newCORS(origins []string, maxAge time.Duration) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", IdempotencyKeyHeader, TenantHeader, APIKeyHeader},
+		AllowCredentials: true,
+		MaxAge:           int(maxAge.Seconds()),
+	})
+}
+
+// settings returns the live settings in use
+func (h *Handler) settings() *liveSettings {
+	return h.live.Load()
+}
+
+// updateSettings replaces the live settings with a copy changed by update
+func (h *Handler) updateSettings(update func(s *liveSettings)) {
+	s := *h.live.Load()
+	update(&s)
+	h.live.Store(&s)
+}
+
+// applyConfig switches the handler to the reloadable settings in cfg: the log level, cors
+// options, rate limits, anonymous reads and bulk item cap
+func (h *Handler) applyConfig(cfg Config) error {
+	rateLimits, err := ParseRateLimits(cfg.RateLimits)
+	if err != nil {
+		return err
+	}
+	h.live.Store(&liveSettings{
+		anonymousRead: cfg.AnonymousRead,
+		rateLimits:    rateLimits,
+		maxBulkItems:  cfg.MaxBulkItems,
+		cors:          newCORS(cfg.CORSAllowedOrigins, time.Duration(cfg.CORSMaxAge)),
+	})
+	h.logger.SetLevel(logrus.Level(cfg.LogLevel))
+	return nil
+}
+
+// reloadConfig is applyConfig for a reload, where changed are the config keys that differ from
+// the running config.  The rate limiters and cors options are kept unless their keys changed, as
+// new rate limiters would give every client a full bucket.
+func (h *Handler) reloadConfig(cfg Config, changed []string) error {
+	s := *h.settings()
+	if slices.Contains(changed, "rate_limits") {
+		rateLimits, err := ParseRateLimits(cfg.RateLimits)
+		if err != nil {
+			return err
+		}
+		s.rateLimits = rateLimits
+	}
+	if slices.Contains(changed, "cors_allowed_origins") || slices.Contains(changed, "cors_max_age") {
+		s.cors = newCORS(cfg.CORSAllowedOrigins, time.Duration(cfg.CORSMaxAge))
+	}
+	s.anonymousRead = cfg.AnonymousRead
+	s.maxBulkItems = cfg.MaxBulkItems
+	h.live.Store(&s)
+	h.logger.SetLevel(logrus.Level(cfg.LogLevel))
+	return nil
+}
+
+// corsHandler is a cors handler wrapped around the rest of the middleware chain, and the cors
+// options it was built from
+type corsHandler struct {
+	cors    *cors.Cors
+	handler http.Handler
+}
+
+// corsMW applies the live cors options to the request.  The wrapped handler is built once for
+// each set of options, by the first request after they change.
+func (h *Handler) corsMW(next http.Handler) http.Handler {
+	var current atomic.Pointer[corsHandler]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := h.settings().cors
+		ch := current.Load()
+		if ch == nil || ch.cors != c {
+			ch = &corsHandler{cors: c, handler: c.Handler(next)}
+			current.Store(ch)
+		}
+		ch.handler.ServeHTTP(w, r)
+	})
+}
+
+// withReloadable returns c with the settings a reload may change taken from next
+func (c Config) withReloadable(next Config) Config {
+	c.LogLevel = next.LogLevel
+	c.CORSAllowedOrigins = next.CORSAllowedOrigins
+	c.CORSMaxAge = next.CORSMaxAge
+	c.RateLimits = next.RateLimits
+	c.AnonymousRead = next.AnonymousRead
+	c.MaxBulkItems = next.MaxBulkItems
+	return c
+}
+
+// changedKeys returns the config file keys whose values differ between a and b, sorted
+func changedKeys(a, b Config) []string {
+	flatA, flatB := flatten(a), flatten(b)
+	var keys []string
+	for k, v := range flatA {
+		if !reflect.DeepEqual(v, flatB[k]) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flatten returns the config as a map of config file keys, nested keys joined by dots
+func flatten(c Config) map[string]interface{} {
+	dat, _ := yaml.Marshal(c)
+	var m map[string]interface{}
+	yaml.Unmarshal(dat, &m)
+
+	flat := map[string]interface{}{}
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if nested, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", nested)
+				continue
+			}
+			flat[prefix+k] = v
+		}
+	}
+	walk("", m)
+	return flat
+}
+
+// Reloader re-reads the config on SIGHUP, and whenever the config file changes, and applies the
+// reloadable settings to the running handler.  Changes to any other setting are logged and
+// ignored until the server is restarted.  A config that fails to load is logged and the running
+// settings are kept.
+type Reloader struct {
+	h         *Handler
+	args      []string
+	lookupEnv func(string) (string, bool)
+	// current is the config in effect
+	current Config
+	// modTime and size of the config file when it was last read
+	modTime  time.Time
+	size     int64
+	interval time.Duration
+}
+
+// NewReloader returns a reloader for the handler, which was set up from cfg.  args and lookupEnv
+// are the command line and env variables cfg was loaded from, so a reload sees the same flags.
+func NewReloader(h *Handler, cfg Config, args []string, lookupEnv func(string) (string, bool)) *Reloader {
+	rl := &Reloader{h: h, args: args, lookupEnv: lookupEnv, current: cfg, interval: configPollInterval}
+	rl.modTime, rl.size = rl.stat()
+	return rl
+}
+
+// stat returns the modification time and size of the config file, zero when there is none
+func (rl *Reloader) stat() (time.Time, int64) {
+	if rl.current.File == "" {
+		return time.Time{}, 0
+	}
+	fi, err := os.Stat(rl.current.File)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return fi.ModTime(), fi.Size()
+}
+
+// Reload loads the config and applies the reloadable settings that changed.  It returns the
+// config file keys that changed but can't be reloaded.
+func (rl *Reloader) Reload() ([]string, error) {
+	next, _, err := LoadConfig(rl.args, rl.lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := rl.current.withReloadable(next)
+	changed := changedKeys(rl.current, applied)
+	if err := rl.h.reloadConfig(applied, changed); err != nil {
+		return nil, err
+	}
+	ignored := changedKeys(applied, next)
+	rl.current = applied
+
+	for _, k := range ignored {
+		rl.h.logger.Warnf("config setting %s changed but needs a restart to take effect, ignored", k)
+	}
+	if len(changed) > 0 {
+		rl.h.logger.Infof("config reloaded, changed %v", changed)
+	}
+	return ignored, nil
+}
+
+// Run reloads the config each time a signal arrives on hup and whenever the config file's
+// modification time or size changes, until ctx is cancelled
+func (rl *Reloader) Run(ctx context.Context, hup <-chan os.Signal) {
+	ticker := time.NewTicker(rl.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			modTime, size := rl.stat()
+			if modTime.Equal(rl.modTime) && size == rl.size {
+				continue
+			}
+		}
+		rl.modTime, rl.size = rl.stat()
+		if _, err := rl.Reload(); err != nil {
+			rl.h.logger.Errorf("config reload failed, keeping the running config: %s", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// reloadHandler returns a handler set up from the config file contents, and a reloader for it
+func reloadHandler(t *testing.T, contents string, env map[string]string) (*Handler, *Reloader, *test.Hook, string) {
+	t.Helper()
+	path := writeConfigFile(t, ".yaml", contents)
+	args := []string{"--config", path}
+	cfg, _, err := LoadConfig(args, envMap(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, hook := test.NewNullLogger()
+	db, err := LoadDB(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	if err := h.applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return h, NewReloader(h, cfg, args, envMap(env)), hook, path
+}
+
+func TestReloader_Reload(t *testing.T) {
+	a := assert.New(t)
+	h, rl, hook, path := reloadHandler(t, "log_level: 3\nport: 9000\n", nil)
+	db := h.DB
+	a.Equal(logrus.WarnLevel, h.logger.GetLevel())
+	a.Nil(h.settings().rateLimits)
+
+	a.NoError(os.WriteFile(path, []byte(`
+log_level: 5
+port: 9001
+unique_names: true
+cors_allowed_origins: [https://shop.example.com]
+rate_limits: "*=10/s"
+anonymous_read: true
+max_bulk_items: 100
+`), 0o600))
+	ignored, err := rl.Reload()
+	a.NoError(err)
+
+	// reloadable settings are applied, the rest are reported and left alone
+	a.Equal([]string{"port", "unique_names"}, ignored)
+	a.Equal(logrus.DebugLevel, h.logger.GetLevel())
+	s := h.settings()
+	a.NotNil(s.rateLimits)
+	a.True(s.anonymousRead)
+	a.Equal(100, s.maxBulkItems)
+	a.Equal(9000, rl.current.Port)
+	a.False(rl.current.UniqueNames)
+	a.Same(db, h.DB)
+	a.Equal(4, h.DB.Count())
+
+	// the rate limiters and cors options are only rebuilt when their settings change
+	a.NoError(os.WriteFile(path, []byte(`
+log_level: 5
+port: 9000
+cors_allowed_origins: [https://shop.example.com]
+rate_limits: "*=10/s"
+anonymous_read: false
+max_bulk_items: 100
+`), 0o600))
+	_, err = rl.Reload()
+	a.NoError(err)
+	a.False(h.settings().anonymousRead)
+	a.Same(s.rateLimits, h.settings().rateLimits)
+	a.Same(s.cors, h.settings().cors)
+	s = h.settings()
+
+	var warnings []string
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	a.Len(warnings, 2)
+	a.Contains(warnings[0], "port changed but needs a restart")
+
+	// the new cors origins are served straight away
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+	for origin, allowed := range map[string]string{"https://shop.example.com": "https://shop.example.com", "https://evil.example.com": ""} {
+		req, err := http.NewRequest("GET", ts.URL+"/api/v1/produce", nil)
+		a.NoError(err)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		resp.Body.Close()
+		a.Equal(allowed, resp.Header.Get("Access-Control-Allow-Origin"), origin)
+	}
+
+	// a config that fails to load keeps the running settings
+	a.NoError(os.WriteFile(path, []byte("log_level: 9\n"), 0o600))
+	_, err = rl.Reload()
+	a.Error(err)
+	a.Equal(logrus.DebugLevel, h.logger.GetLevel())
+	a.Same(s, h.settings())
+}
+
+func TestReloader_Run(t *testing.T) {
+	a := assert.New(t)
+	env := map[string]string{"LOGLEVEL": "3"}
+	h, rl, _, path := reloadHandler(t, "max_bulk_items: 10\n", env)
+	rl.interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		rl.Run(ctx, hup)
+		close(done)
+	}()
+
+	// a change to the file is picked up without a signal
+	a.NoError(os.WriteFile(path, []byte("max_bulk_items: 2000\n"), 0o600))
+	a.Eventually(func() bool { return h.settings().maxBulkItems == 2000 }, 5*time.Second, 10*time.Millisecond)
+
+	// SIGHUP reloads env variables too
+	env["LOGLEVEL"] = "6"
+	hup <- nil
+	a.Eventually(func() bool { return h.logger.GetLevel() == logrus.TraceLevel }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func Test_changedKeys(t *testing.T) {
+	a := assert.New(t)
+	c := DefaultConfig()
+	a.Empty(changedKeys(c, c))
+
+	next := c
+	next.JWT.Issuer = "https://sso.example.com"
+	next.CORSAllowedOrigins = []string{"https://shop.example.com"}
+	next.WriteTimeout = Duration(time.Minute * 2)
+	a.Equal([]string{"cors_allowed_origins", "jwt.issuer", "write_timeout"}, changedKeys(c, next))
+	a.Equal([]string{"jwt.issuer", "write_timeout"}, changedKeys(c.withReloadable(next), next))
+}
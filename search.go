@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+)
+
+// search scores for the ways a query term can match a term in a name.  An item's score is
+// the sum of the best score for each query term.
+const (
+	searchScoreExact  = 3.0
+	searchScorePrefix = 2.0
+	searchScoreTypo   = 1.0
+)
+
+// maxSearchQueryLength and maxSearchTerms bound a search query.  Each query term is compared with
+// every indexed term while the database is locked, so the work a query can ask for is capped.
+const (
+	maxSearchQueryLength = 200
+	maxSearchTerms       = 8
+)
+
+// SearchResult is a single produce item matching a search query
+type SearchResult struct {
+	// Produce is the matching produce item
+	Produce *ProduceItem `json:"produce"`
+	// Score is the relevance of the item to the query, higher is better
+	Score float64 `json:"score"`
+	// Highlight is the item name, html escaped, with the matching words wrapped in <em> tags
+	Highlight string `json:"highlight"`
+}
+
+// searchIndex is an inverted index from the words in produce names, localized names included,
+// to the items containing them.  It is kept in sync with the database as a secondaryIndex.
+type searchIndex struct {
+	// postings maps each term to the codes of the items whose names contain it
+	postings map[string]map[ProduceCode]bool
+	// items maps codes to the indexed items
+	items map[ProduceCode]*ProduceItem
+}
+
+// newSearchIndex returns an empty search index
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: map[string]map[ProduceCode]bool{}, items: map[ProduceCode]*ProduceItem{}}
+}
+
+// check never fails, any item can be searched
+func (s *searchIndex) check(p *ProduceItem) error {
+	return nil
+}
+
+func (s *searchIndex) insert(p *ProduceItem) {
+	s.items[p.Code] = p
+	for _, t := range itemTerms(p) {
+		if s.postings[t] == nil {
+			s.postings[t] = map[ProduceCode]bool{}
+		}
+		s.postings[t][p.Code] = true
+	}
+}
+
+func (s *searchIndex) remove(p *ProduceItem) {
+	delete(s.items, p.Code)
+	for _, t := range itemTerms(p) {
+		delete(s.postings[t], p.Code)
+		if len(s.postings[t]) == 0 {
+			delete(s.postings, t)
+		}
+	}
+}
+
+// search returns up to limit items matching the query, best match first.  Every query term is
+// matched against the indexed terms exactly, as a prefix, or with a small number of typos so
+// "grn peper" finds "Green Pepper".  Items matching more query terms, more closely, rank higher.
+// Only the terms returned by queryTerms are used.  The items are returned with their names in
+// the language lang where they have one, and it is that name that is highlighted.
+func (s *searchIndex) search(q string, limit int, lang string) []SearchResult {
+
+	type match struct {
+		score float64
+		terms map[string]bool
+	}
+	matches := map[ProduceCode]*match{}
+
+	for _, qt := range queryTerms(q) {
+		// best score this query term gives each item
+		best := map[ProduceCode]float64{}
+		matched := map[ProduceCode][]string{}
+		for term, codes := range s.postings {
+			score := scoreTerm(qt, term)
+			if score == 0 {
+				continue
+			}
+			for code := range codes {
+				if score > best[code] {
+					best[code] = score
+				}
+				matched[code] = append(matched[code], term)
+			}
+		}
+		for code, score := range best {
+			m := matches[code]
+			if m == nil {
+				m = &match{terms: map[string]bool{}}
+				matches[code] = m
+			}
+			m.score += score
+			for _, t := range matched[code] {
+				m.terms[t] = true
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(matches))
+	for code, m := range matches {
+		p := localize(s.items[code], lang)
+		results = append(results, SearchResult{Produce: p, Score: m.score, Highlight: highlight(p.Name, m.terms)})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if len(results[i].Produce.Name) != len(results[j].Produce.Name) {
+			return len(results[i].Produce.Name) < len(results[j].Produce.Name)
+		}
+		return results[i].Produce.Code < results[j].Produce.Code
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// scoreTerm scores how well the query term matches an indexed term, zero means no match
+func scoreTerm(qt, term string) float64 {
+	switch {
+	case qt == term:
+		return searchScoreExact
+	case strings.HasPrefix(term, qt):
+		return searchScorePrefix
+	}
+
+	maxTypos := maxSearchTypos(qt)
+	if maxTypos == 0 {
+		return 0
+	}
+
+	// a term more than maxTypos shorter than the query term can't match, and past the first
+	// len(qt)+maxTypos runes every prefix of a term is too long to, so the rest is dropped
+	q, t := []rune(qt), []rune(term)
+	if len(t) < len(q)-maxTypos {
+		return 0
+	}
+	if len(t) > len(q)+maxTypos {
+		t = t[:len(q)+maxTypos]
+	}
+	full, prefix := editDistance(q, t)
+	if full <= maxTypos || prefix <= maxTypos {
+		return searchScoreTypo
+	}
+	return 0
+}
+
+// maxSearchTypos is the number of typos tolerated in a query term.  Short terms must match
+// exactly or the results fill up with noise.
+func maxSearchTypos(qt string) int {
+	switch n := len([]rune(qt)); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the Levenshtein distance between a and b, and the smallest distance
+// between a and any prefix of b.  The prefix distance lets a partly typed word with a typo
+// match, e.g. "grn" is one edit from "gre", the start of "green".
+func editDistance(a, b []rune) (int, int) {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	prefix := prev[0]
+	for _, d := range prev {
+		prefix = min(prefix, d)
+	}
+	return prev[len(b)], prefix
+}
+
+// tokenize splits text into normalized, case-folded words
+func tokenize(text string) []string {
+	folded := cases.Fold().String(NormalizeName(text))
+	return strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+}
+
+// queryTerms returns the distinct terms of the search query.  Only the first maxSearchQueryLength
+// runes of the query, and the first maxSearchTerms terms, are used.
+func queryTerms(q string) []string {
+	if r := []rune(q); len(r) > maxSearchQueryLength {
+		q = string(r[:maxSearchQueryLength])
+	}
+	seen := map[string]bool{}
+	var terms []string
+	for _, t := range tokenize(q) {
+		if !seen[t] && len(terms) < maxSearchTerms {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// itemTerms returns the distinct terms in the item's name and localized names
+func itemTerms(p *ProduceItem) []string {
+	seen := map[string]bool{}
+	var terms []string
+	add := func(name string) {
+		for _, t := range tokenize(name) {
+			if !seen[t] {
+				seen[t] = true
+				terms = append(terms, t)
+			}
+		}
+	}
+	add(p.Name)
+	for _, n := range p.LocalizedNames {
+		add(n)
+	}
+	return terms
+}
+
+// highlight html escapes the name and wraps each word found in terms in <em> tags
+func highlight(name string, terms map[string]bool) string {
+	words := strings.Split(name, " ")
+	for i, w := range words {
+		escaped := html.EscapeString(w)
+		for _, t := range tokenize(w) {
+			if terms[t] {
+				escaped = "<em>" + escaped + "</em>"
+				break
+			}
+		}
+		words[i] = escaped
+	}
+	return strings.Join(words, " ")
+}
+
+// defaultSearchLimit and maxSearchLimit bound the number of results SearchProduce returns
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+)
+
+// SearchResults is the response returned by SearchProduce
+type SearchResults struct {
+	Results []SearchResult `json:"results"`
+}
+
+// SearchProduce returns up to limit items, 10 by default, whose names best match q, with the
+// matching words highlighted and given in the lang language where the item has one.
+func (h *Handler) SearchProduce(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(q) > maxSearchQueryLength || len(tokenize(q)) > maxSearchTerms {
+		err := fmt.Errorf("q must be at most %d characters and %d words", maxSearchQueryLength, maxSearchTerms)
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryLimit(r, defaultSearchLimit, maxSearchLimit)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lang, err := queryLang(r)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rs := SearchResults{Results: h.db(r).Search(q, limit, lang)}
+
+	dat, err := json.Marshal(rs)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, "error generating json data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_editDistance(t *testing.T) {
+	tests := []struct {
+		a, b         string
+		full, prefix int
+	}{
+		{"peper", "pepper", 1, 1},
+		{"grn", "green", 2, 1},
+		{"green", "green", 0, 0},
+		{"gre", "green", 2, 0},
+		{"apple", "peach", 5, 3},
+		{"", "kiwi", 4, 0},
+	}
+	for _, tt := range tests {
+		full, prefix := editDistance([]rune(tt.a), []rune(tt.b))
+		if full != tt.full || prefix != tt.prefix {
+			t.Errorf("editDistance(%q, %q) = %d, %d want %d, %d", tt.a, tt.b, full, prefix, tt.full, tt.prefix)
+		}
+	}
+}
+
+func Test_scoreTerm(t *testing.T) {
+	tests := []struct {
+		qt, term string
+		want     float64
+	}{
+		{"pepper", "pepper", searchScoreExact},
+		{"pep", "pepperoncini", searchScorePrefix},
+		{"pepr", "pepperoncini", searchScoreTypo},
+		{"grn", "green", searchScoreTypo},
+		{"peperonc", "pepperoncini", searchScoreTypo},
+		{"pepperoncini", "pepper", 0},
+		{"pq", "pepper", 0},
+		{"kiwi", "pepperoncini", 0},
+	}
+	for _, tt := range tests {
+		if got := scoreTerm(tt.qt, tt.term); got != tt.want {
+			t.Errorf("scoreTerm(%q, %q) = %v want %v", tt.qt, tt.term, got, tt.want)
+		}
+	}
+}
+
+func Test_queryTerms(t *testing.T) {
+	a := assert.New(t)
+	a.Equal([]string{"green", "pepper"}, queryTerms("Green  PEPPER green"))
+	a.Len(queryTerms(strings.Repeat("a b c d e f g h i j ", 3)), maxSearchTerms)
+	a.Len(queryTerms(strings.Repeat("a", 1000)), 1)
+	a.Equal(maxSearchQueryLength, len(queryTerms(strings.Repeat("a", 1000))[0]))
+}
+
+func TestDB_Search(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+	a.NoError(db.Add(&ProduceItem{Name: "Red Pepper", Code: "REDP-0000-0000-0001", UnitPrice: 1}))
+	a.NoError(db.Add(&ProduceItem{Name: "Jalapeño Pepper", Code: "JALA-0000-0000-0001", UnitPrice: 1,
+		LocalizedNames: map[string]string{"es": "Chile Jalapeño"}}))
+
+	// typos in every word still find the item, and it ranks first as both words match
+	results := db.Search("grn peper", 10, "")
+	a.NotEmpty(results)
+	a.Equal(ProduceCode("YRT6-72AS-K736-L4AR"), results[0].Produce.Code)
+	a.Equal("<em>Green</em> <em>Pepper</em>", results[0].Highlight)
+	a.Len(results, 3)
+
+	// prefixes rank ahead of typos, "gal" is one typo from the start of "jalapeño"
+	results = db.Search("gal", 10, "")
+	a.Len(results, 2)
+	a.Equal("<em>Gala</em> Apple", results[0].Highlight)
+	a.Equal("<em>Jalapeño</em> Pepper", results[1].Highlight)
+
+	// exact matches beat prefix matches
+	a.NoError(db.Add(&ProduceItem{Name: "Peaches", Code: "PEAC-0000-0000-0001", UnitPrice: 1}))
+	results = db.Search("peach", 10, "")
+	a.Len(results, 2)
+	a.Equal("Peach", results[0].Produce.Name)
+	a.Greater(results[0].Score, results[1].Score)
+
+	// case, accents and localized names
+	results = db.Search("JALAPEÑO", 10, "")
+	a.Len(results, 1)
+	results = db.Search("chile", 10, "")
+	a.Len(results, 1)
+	a.Equal("Jalapeño Pepper", results[0].Highlight)
+
+	// the name in the language asked for is returned and highlighted
+	results = db.Search("chile", 10, "es")
+	a.Len(results, 1)
+	a.Equal("Chile Jalapeño", results[0].Produce.Name)
+	a.Equal("<em>Chile</em> Jalapeño", results[0].Highlight)
+	a.Equal("Jalapeño Pepper", db.Search("chile", 10, "fr")[0].Produce.Name)
+
+	// limit
+	a.Len(db.Search("pepper", 2, ""), 2)
+
+	// the index follows updates and deletes
+	_, err = db.Upsert(&ProduceItem{Name: "Yellow Pepper", Code: "REDP-0000-0000-0001", UnitPrice: 1})
+	a.NoError(err)
+	a.Empty(db.Search("red", 10, ""))
+	a.Len(db.Search("yellow", 10, ""), 1)
+	a.NoError(db.Delete("REDP-0000-0000-0001"))
+	a.Empty(db.Search("yellow", 10, ""))
+
+	// nothing close enough
+	a.Empty(db.Search("xylophone", 10, ""))
+	a.Empty(db.Search("pq", 10, ""))
+}
+
+func TestHandler_SearchProduce(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "GET", "/api/v1/produce/search?q=grn+peper", nil)
+	a.Equal(200, rr.StatusCode)
+	var sr SearchResults
+	a.NoError(json.Unmarshal([]byte(body), &sr))
+	a.Equal("Green Pepper", sr.Results[0].Produce.Name)
+
+	rr, body = testRequest(t, ts, "GET", "/api/v1/produce/search?q=a&limit=1", nil)
+	a.Equal(200, rr.StatusCode)
+	sr = SearchResults{}
+	a.NoError(json.Unmarshal([]byte(body), &sr))
+	a.Len(sr.Results, 1)
+
+	tooLong := "/api/v1/produce/search?q=" + strings.Repeat("a", maxSearchQueryLength+1)
+	tooMany := "/api/v1/produce/search?q=" + strings.Repeat("a+", maxSearchTerms+1)
+	for _, path := range []string{"/api/v1/produce/search", "/api/v1/produce/search?q=%20", "/api/v1/produce/search?q=a&limit=0", "/api/v1/produce/search?q=a&limit=x", tooLong, tooMany} {
+		rr, _ = testRequest(t, ts, "GET", path, nil)
+		a.Equal(400, rr.StatusCode, path)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultReadHeaderTimeout is how long a client has to send the request headers
+	defaultReadHeaderTimeout = 5 * time.Second
+	// defaultReadTimeout is how long a client has to send the whole request
+	defaultReadTimeout = 30 * time.Second
+	// defaultWriteTimeout is how long a request has to be handled and the response written
+	defaultWriteTimeout = 60 * time.Second
+	// defaultIdleTimeout is how long a keep-alive connection is kept open between requests
+	defaultIdleTimeout = 5 * time.Second
+	// defaultShutdownTimeout is how long in-flight requests have to finish on shutdown
+	defaultShutdownTimeout = 30 * time.Second
+	// defaultMaxBodyBytes is the largest request body accepted
+	defaultMaxBodyBytes = 10 << 20
+)
+
+// maxBodyMW stops reading request bodies after maxBodyBytes.  Handlers see a *http.MaxBytesError
+// when they read past the limit.
+func (h *Handler) maxBodyMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.maxBodyBytes > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeErrorStatus returns the status for a request body that couldn't be decoded, a 413 when
+// it was larger than the body size limit and a 400 otherwise
+func decodeErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Flush writes out anything held in memory that is persisted, such as api key last-used times.
+// It is called once the server has stopped.
+func (h *Handler) Flush() error {
+	return h.apiKeys.Flush()
+}
+
+// runServer serves on every listener, over tls when srv has a tls config, until ctx is cancelled,
+// then stops accepting connections and waits up to shutdownTimeout for in-flight requests to
+// finish before closing the rest.  flush is called once no more requests are being handled.  An
+// error is returned if the server fails on any listener, which stops it on the others, in-flight
+// requests don't finish in time, or flush fails.
+func runServer(ctx context.Context, srv *http.Server, lns []net.Listener, shutdownTimeout time.Duration, flush func() error) error {
+	// Serve fills in an empty TLSConfig while setting up http/2, so check before serving
+	useTLS := srv.TLSConfig != nil
+	serveErr := make(chan error, len(lns))
+	for _, ln := range lns {
+		ln := ln
+		go func() {
+			if useTLS {
+				serveErr <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			serveErr <- srv.Serve(ln)
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-serveErr:
+		srv.Close()
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err = srv.Shutdown(shutdownCtx); err != nil {
+			srv.Close()
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return errors.Join(err, flush())
+}
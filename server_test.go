@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowServer starts runServer with a handler whose add pipeline sleeps for delay on every item.
+// started is closed once the first item reaches the slow stage.
+func slowServer(t *testing.T, delay, shutdownTimeout time.Duration, flush func() error) (url string, h *Handler, started chan struct{}, cancel context.CancelFunc, stopped chan error) {
+	t.Helper()
+	logger := logrus.New()
+	logger.Level = 1
+	h = NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	started = make(chan struct{})
+	var once sync.Once
+	h.UseStages(NewValidationStage(http.StatusInternalServerError, func(p ProduceItem) error {
+		once.Do(func() { close(started) })
+		time.Sleep(delay)
+		return nil
+	}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: LoadRouter(h), ReadHeaderTimeout: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped = make(chan error, 1)
+	go func() {
+		stopped <- runServer(ctx, srv, []net.Listener{ln}, shutdownTimeout, flush)
+	}()
+	return "http://" + ln.Addr().String(), h, started, cancel, stopped
+}
+
+// bulkPayload returns an AddProduce payload of n items
+func bulkPayload(n int) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"produce_name":"Kiwi %d","produce_code":"KIWI-0000-0000-%04d","produce_unit_price":1}`, i, i)
+	}
+	return "[" + strings.Join(items, ",") + "]"
+}
+
+func Test_runServer_drainsBulkAdd(t *testing.T) {
+	a := assert.New(t)
+	flushed := false
+	url, h, started, cancel, stopped := slowServer(t, 20*time.Millisecond, 5*time.Second, func() error {
+		flushed = true
+		return nil
+	})
+
+	type response struct {
+		status int
+		err    error
+	}
+	done := make(chan response, 1)
+	go func() {
+		resp, err := http.Post(url+"/api/v1/produce", "application/json", bytes.NewBufferString(bulkPayload(20)))
+		if err != nil {
+			done <- response{err: err}
+			return
+		}
+		resp.Body.Close()
+		done <- response{status: resp.StatusCode}
+	}()
+
+	// shut down while the bulk add is part way through
+	<-started
+	cancel()
+
+	rr := <-done
+	a.NoError(rr.err)
+	a.Equal(200, rr.status)
+	a.NoError(<-stopped)
+	a.True(flushed)
+	a.Equal(20, h.DB.Count())
+
+	// the server no longer accepts connections
+	_, err := http.Get(url + "/ping")
+	a.Error(err)
+}
+
+func Test_runServer_shutdownTimeout(t *testing.T) {
+	a := assert.New(t)
+	flushErr := errors.New("disk full")
+	url, _, started, cancel, stopped := slowServer(t, time.Second, 50*time.Millisecond, func() error {
+		return flushErr
+	})
+
+	go func() {
+		resp, err := http.Post(url+"/api/v1/produce", "application/json", bytes.NewBufferString(bulkPayload(1)))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+
+	// requests that don't finish in time are cut off, and flush still runs
+	err := <-stopped
+	a.ErrorIs(err, context.DeadlineExceeded)
+	a.ErrorIs(err, flushErr)
+}
+
+func TestHandler_Flush(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	a.NoError(h.Flush())
+
+	var err error
+	h.apiKeys, err = LoadAPIKeys(filepath.Join(t.TempDir(), "keys.json"), io.Discard, logger)
+	a.NoError(err)
+	created, err := h.apiKeys.Create("till", ScopeRead)
+	a.NoError(err)
+	h.apiKeys.authenticate(created.Key)
+	a.True(h.apiKeys.dirty)
+	a.NoError(h.Flush())
+	a.False(h.apiKeys.dirty)
+}
+
+func TestHandler_maxBodyMW(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	h.maxBodyBytes = 256
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(bulkPayload(10)))
+	a.Equal(413, rr.StatusCode)
+	a.Contains(body, "request body too large")
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/produce/bulk-delete", bytes.NewBufferString(`{"codes": [`+strings.Repeat(`"KIWI-0000-0000-0001",`, 20)+`"KIWI-0000-0000-0001"]}`))
+	a.Equal(413, rr.StatusCode)
+	a.Equal(0, h.DB.Count())
+
+	// the idempotency cache reads the body before the handler does
+	req, err := http.NewRequest("POST", ts.URL+"/api/v1/produce", bytes.NewBufferString(bulkPayload(10)))
+	a.NoError(err)
+	req.Header.Set(IdempotencyKeyHeader, "key-1")
+	resp, err := http.DefaultClient.Do(req)
+	if a.NoError(err) {
+		resp.Body.Close()
+		a.Equal(413, resp.StatusCode)
+	}
+
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(bulkPayload(1)))
+	a.Equal(200, rr.StatusCode)
+}
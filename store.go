@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ErrInvalidStore indicates a store id or name is not valid
+var ErrInvalidStore = errors.New("store is invalid")
+
+// ErrStoreNotFound will be used when the specified store is not found
+var ErrStoreNotFound = errors.New("store not found")
+
+// ErrDuplicateStore will be used when a store is trying to be added with an id that already exists
+var ErrDuplicateStore = errors.New("store already exists")
+
+// ErrInvalidOverride indicates a store override sets nothing or has an invalid unit price
+var ErrInvalidOverride = errors.New("store override is invalid")
+
+// Store is a location produce is sold at.  Every item in the database is sold at every store at its
+// base unit price unless the store overrides it, see StoreOverride.
+type Store struct {
+	// ID is the lower case slug that identifies the store, e.g. downtown
+	ID string `json:"id"`
+	// Name is the display name, checked against the same policy as produce names
+	Name string `json:"name"`
+	// Address is free text describing where the store is
+	Address string `json:"address,omitempty"`
+}
+
+// StoreOverride changes how a produce item is sold at one store.  Unset fields fall back to the
+// base item.
+type StoreOverride struct {
+	Code ProduceCode `json:"produce_code"`
+	// Available set to false stops the store selling the item
+	Available *bool `json:"available,omitempty"`
+	// UnitPrice replaces the item's unit price at the store
+	UnitPrice *float64 `json:"unit_price,omitempty"`
+}
+
+// storeRegistry holds the stores and their overrides.  It is guarded by the DB mutex.
+type storeRegistry struct {
+	stores map[string]*Store
+	// overrides maps store ids to the overrides for each produce code
+	overrides map[string]map[ProduceCode]StoreOverride
+}
+
+// newStoreRegistry returns a registry with no stores
+func newStoreRegistry() *storeRegistry {
+	return &storeRegistry{stores: map[string]*Store{}, overrides: map[string]map[ProduceCode]StoreOverride{}}
+}
+
+// forget drops every store's override of the produce code, used when the item is removed
+func (s *storeRegistry) forget(code ProduceCode) {
+	for _, overrides := range s.overrides {
+		delete(overrides, code)
+	}
+}
+
+// resolve applies the store's override, if any, to p.  It returns nil when the store does
+// not sell the item.
+func (s *storeRegistry) resolve(storeID string, p *ProduceItem) *ProduceItem {
+	o, ok := s.overrides[storeID][p.Code]
+	if !ok {
+		return p
+	}
+	if o.Available != nil && !*o.Available {
+		return nil
+	}
+	if o.UnitPrice != nil {
+		effective := *p
+		effective.UnitPrice = *o.UnitPrice
+		return &effective
+	}
+	return p
+}
+
+// validateStore checks the id and name of the store and stores them normalized
+func (d *DB) validateStore(s *Store) error {
+	var err error
+	if s.ID, err = parseSlug(s.ID, ErrInvalidStore); err != nil {
+		return err
+	}
+	if s.Name, err = d.ParseName(s.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddStore creates a new store.
+// If a store exists with the same id a ErrDuplicateStore is returned
+func (d *DB) AddStore(s *Store) error {
+
+	if err := d.validateStore(s); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[s.ID] != nil {
+		return ErrDuplicateStore
+	}
+	stored := *s
+	d.stores.stores[s.ID] = &stored
+	d.stores.overrides[s.ID] = map[ProduceCode]StoreOverride{}
+	return nil
+}
+
+// UpdateStore replaces the name and address of the store with the same id.
+// If the store is not found a ErrStoreNotFound is returned
+func (d *DB) UpdateStore(s *Store) error {
+
+	if err := d.validateStore(s); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[s.ID] == nil {
+		return ErrStoreNotFound
+	}
+	stored := *s
+	d.stores.stores[s.ID] = &stored
+	return nil
+}
+
+// GetStore returns the store with the passed id
+// If the store is not found a ErrStoreNotFound is returned
+func (d *DB) GetStore(id string) (*Store, error) {
+	id, err := parseSlug(id, ErrStoreNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	s := d.stores.stores[id]
+	if s == nil {
+		return nil, ErrStoreNotFound
+	}
+	stored := *s
+	return &stored, nil
+}
+
+// ListStores returns every store sorted by id
+func (d *DB) ListStores() []*Store {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	ss := make([]*Store, 0, len(d.stores.stores))
+	for _, s := range d.stores.stores {
+		stored := *s
+		ss = append(ss, &stored)
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].ID < ss[j].ID })
+	return ss
+}
+
+// DeleteStore removes the store with the passed id along with its overrides.
+// If the store is not found a ErrStoreNotFound is returned
+func (d *DB) DeleteStore(id string) error {
+	id, err := parseSlug(id, ErrStoreNotFound)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[id] == nil {
+		return ErrStoreNotFound
+	}
+	delete(d.stores.stores, id)
+	delete(d.stores.overrides, id)
+	return nil
+}
+
+// SetStoreOverride changes the availability or unit price of a produce item at the store, replacing
+// any previous override.  At least one of Available or UnitPrice must be set.  The unit price is
+// rounded to two decimal places.
+// If the store or item is not found a ErrStoreNotFound or ErrNotFound is returned
+func (d *DB) SetStoreOverride(storeID string, o *StoreOverride) error {
+
+	storeID, err := parseSlug(storeID, ErrStoreNotFound)
+	if err != nil {
+		return err
+	}
+	if o.Code, err = ParseProduceCode(string(o.Code)); err != nil {
+		return err
+	}
+	if o.Available == nil && o.UnitPrice == nil {
+		return ErrInvalidOverride
+	}
+	if o.UnitPrice != nil {
+		if !PriceIsValid(*o.UnitPrice, d.logger) {
+			return ErrInvalidOverride
+		}
+		price, err := strconv.ParseFloat(fmt.Sprintf("%0.2f", *o.UnitPrice), 64)
+		if err != nil {
+			return ErrInvalidOverride
+		}
+		o.UnitPrice = &price
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[storeID] == nil {
+		return ErrStoreNotFound
+	}
+	if GetItemIndex(o.Code, d.Produce, d.logger) == nil {
+		return ErrNotFound
+	}
+	d.stores.overrides[storeID][o.Code] = *o
+	return nil
+}
+
+// DeleteStoreOverride removes the store's override of the produce item so the base item applies again.
+// If the store has no override for the item a ErrNotFound is returned
+func (d *DB) DeleteStoreOverride(storeID string, code ProduceCode) error {
+	storeID, err := parseSlug(storeID, ErrStoreNotFound)
+	if err != nil {
+		return err
+	}
+	if code, err = ParseProduceCode(string(code)); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[storeID] == nil {
+		return ErrStoreNotFound
+	}
+	if _, ok := d.stores.overrides[storeID][code]; !ok {
+		return ErrNotFound
+	}
+	delete(d.stores.overrides[storeID], code)
+	return nil
+}
+
+// StoreOverrides returns every override at the store sorted by produce code.
+// If the store is not found a ErrStoreNotFound is returned
+func (d *DB) StoreOverrides(storeID string) ([]StoreOverride, error) {
+	storeID, err := parseSlug(storeID, ErrStoreNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[storeID] == nil {
+		return nil, ErrStoreNotFound
+	}
+	overrides := make([]StoreOverride, 0, len(d.stores.overrides[storeID]))
+	for _, o := range d.stores.overrides[storeID] {
+		overrides = append(overrides, o)
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Code < overrides[j].Code })
+	return overrides, nil
+}
+
+// StoreCatalogue returns the effective catalogue of the store: every item the store sells with
+// the store's unit price applied.
+// If the store is not found a ErrStoreNotFound is returned
+func (d *DB) StoreCatalogue(storeID string) ([]*ProduceItem, error) {
+	storeID, err := parseSlug(storeID, ErrStoreNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[storeID] == nil {
+		return nil, ErrStoreNotFound
+	}
+	catalogue := make([]*ProduceItem, 0, len(d.Produce))
+	for _, p := range d.Produce {
+		if effective := d.stores.resolve(storeID, p); effective != nil {
+			catalogue = append(catalogue, effective)
+		}
+	}
+	return catalogue, nil
+}
+
+// GetStoreItem returns the produce item with the passed code as sold at the store.
+// If the store is not found a ErrStoreNotFound is returned
+// If the item is not found, or the store does not sell it, a ErrNotFound is returned
+func (d *DB) GetStoreItem(storeID string, code ProduceCode) (*ProduceItem, error) {
+	storeID, err := parseSlug(storeID, ErrStoreNotFound)
+	if err != nil {
+		return nil, err
+	}
+	if code, err = ParseProduceCode(string(code)); err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stores.stores[storeID] == nil {
+		return nil, ErrStoreNotFound
+	}
+	idx := GetItemIndex(code, d.Produce, d.logger)
+	if idx == nil {
+		return nil, ErrNotFound
+	}
+	effective := d.stores.resolve(storeID, d.Produce[*idx])
+	if effective == nil {
+		return nil, ErrNotFound
+	}
+	return effective, nil
+}
+
+// ListStores returns a json array of every store, sorted by id
+func (h *Handler) ListStores(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, r, http.StatusOK, h.db(r).ListStores())
+}
+
+// GetStore returns the store with the id in the path, or a 404 if it is not found
+func (h *Handler) GetStore(w http.ResponseWriter, r *http.Request) {
+	s, err := h.db(r).GetStore(chi.URLParam(r, "id"))
+	h.writeItem(w, r, s, err)
+}
+
+// AddStore creates the store in the json body, e.g. {"id": "downtown", "name": "Downtown",
+// "address": "1 Main St"}, and returns it with a 201.  A store with the same id gets a 409 and an
+// invalid store a 400.
+func (h *Handler) AddStore(w http.ResponseWriter, r *http.Request) {
+	var s Store
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db(r).AddStore(&s); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	h.writeJSON(w, r, http.StatusCreated, s)
+}
+
+// UpdateStore replaces the name and address of the store with the id in the path with those in
+// the json body
+func (h *Handler) UpdateStore(w http.ResponseWriter, r *http.Request) {
+	var s Store
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.ID = chi.URLParam(r, "id")
+	err := h.db(r).UpdateStore(&s)
+	h.writeItem(w, r, s, err)
+}
+
+// DeleteStore removes the store with the id in the path, and its overrides, and returns a 204
+func (h *Handler) DeleteStore(w http.ResponseWriter, r *http.Request) {
+	if err := h.db(r).DeleteStore(chi.URLParam(r, "id")); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GetStoreProduce returns a json array of the effective catalogue of the store with the id in the
+// path: every item it sells at the price it sells it for.  Passing lang, e.g. ?lang=es, returns each
+// name in that language where the item has one.
+func (h *Handler) GetStoreProduce(w http.ResponseWriter, r *http.Request) {
+	lang, err := queryLang(r)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := h.db(r).StoreCatalogue(chi.URLParam(r, "id"))
+	if err == nil && lang != "" {
+		for i := range p {
+			p[i] = localize(p[i], lang)
+		}
+	}
+	h.writeItem(w, r, p, err)
+}
+
+// GetStoreItem returns the item with the code in the path as sold at the store with the id in the
+// path.  Items the store does not sell get a 404.
+func (h *Handler) GetStoreItem(w http.ResponseWriter, r *http.Request) {
+	lang, err := queryLang(r)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := h.db(r).GetStoreItem(chi.URLParam(r, "id"), produceCodeFromContext(r.Context()))
+	if err == nil {
+		p = localize(p, lang)
+	}
+	h.writeItem(w, r, p, err)
+}
+
+// ListStoreOverrides returns a json array of every override at the store with the id in the path
+func (h *Handler) ListStoreOverrides(w http.ResponseWriter, r *http.Request) {
+	overrides, err := h.db(r).StoreOverrides(chi.URLParam(r, "id"))
+	h.writeItem(w, r, overrides, err)
+}
+
+// SetStoreOverride overrides the item with the code in the path at the store with the id in the path
+// using the json body, e.g. {"available": false} or {"unit_price": 2.49}.  The stored override is
+// returned.  An override that sets nothing or has a negative price gets a 400.
+func (h *Handler) SetStoreOverride(w http.ResponseWriter, r *http.Request) {
+	var o StoreOverride
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o.Code = produceCodeFromContext(r.Context())
+	err := h.db(r).SetStoreOverride(chi.URLParam(r, "id"), &o)
+	h.writeItem(w, r, o, err)
+}
+
+// DeleteStoreOverride removes the override of the item with the code in the path at the store with
+// the id in the path and returns a 204, or a 404 if there is none
+func (h *Handler) DeleteStoreOverride(w http.ResponseWriter, r *http.Request) {
+	if err := h.db(r).DeleteStoreOverride(chi.URLParam(r, "id"), produceCodeFromContext(r.Context())); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Stores(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	a.NoError(db.AddStore(&Store{ID: "Downtown", Name: "Downtown", Address: "1 Main St"}))
+	a.NoError(db.AddStore(&Store{ID: "airport", Name: "Airport"}))
+	a.ErrorIs(db.AddStore(&Store{ID: "downtown", Name: "Downtown"}), ErrDuplicateStore)
+	a.ErrorIs(db.AddStore(&Store{ID: "up town", Name: "Uptown"}), ErrInvalidStore)
+	a.ErrorIs(db.UpdateStore(&Store{ID: "uptown", Name: "Uptown"}), ErrStoreNotFound)
+	a.NoError(db.UpdateStore(&Store{ID: "airport", Name: "Airport Terminal"}))
+	s, err := db.GetStore("AIRPORT")
+	a.NoError(err)
+	a.Equal("Airport Terminal", s.Name)
+	a.Len(db.ListStores(), 2)
+
+	// without overrides a store sells everything at the base price
+	catalogue, err := db.StoreCatalogue("downtown")
+	a.NoError(err)
+	a.Equal(db.List(), catalogue)
+
+	no, price := false, 1.999
+	a.NoError(db.SetStoreOverride("downtown", &StoreOverride{Code: "a12t-4gh7-qpl9-3n4m", Available: &no}))
+	a.NoError(db.SetStoreOverride("downtown", &StoreOverride{Code: "E5T6-9UI3-TH15-QR88", UnitPrice: &price}))
+	a.ErrorIs(db.SetStoreOverride("downtown", &StoreOverride{Code: "E5T6-9UI3-TH15-QR88"}), ErrInvalidOverride)
+	negative := -1.0
+	a.ErrorIs(db.SetStoreOverride("downtown", &StoreOverride{Code: "E5T6-9UI3-TH15-QR88", UnitPrice: &negative}), ErrInvalidOverride)
+	a.ErrorIs(db.SetStoreOverride("uptown", &StoreOverride{Code: "E5T6-9UI3-TH15-QR88", Available: &no}), ErrStoreNotFound)
+	a.ErrorIs(db.SetStoreOverride("downtown", &StoreOverride{Code: "AAAA-0000-0000-0000", Available: &no}), ErrNotFound)
+
+	catalogue, err = db.StoreCatalogue("downtown")
+	a.NoError(err)
+	a.Len(catalogue, 3)
+	p, err := db.GetStoreItem("downtown", "E5T6-9UI3-TH15-QR88")
+	a.NoError(err)
+	a.Equal(2.0, p.UnitPrice)
+	_, err = db.GetStoreItem("downtown", "A12T-4GH7-QPL9-3N4M")
+	a.ErrorIs(err, ErrNotFound)
+
+	// overrides don't touch the base item or other stores
+	base, _ := db.Get("E5T6-9UI3-TH15-QR88")
+	a.Equal(2.99, base.UnitPrice)
+	p, err = db.GetStoreItem("airport", "A12T-4GH7-QPL9-3N4M")
+	a.NoError(err)
+	a.Equal(3.46, p.UnitPrice)
+
+	overrides, err := db.StoreOverrides("downtown")
+	a.NoError(err)
+	a.Len(overrides, 2)
+	a.NoError(db.DeleteStoreOverride("downtown", "A12T-4GH7-QPL9-3N4M"))
+	a.ErrorIs(db.DeleteStoreOverride("downtown", "A12T-4GH7-QPL9-3N4M"), ErrNotFound)
+	_, err = db.GetStoreItem("downtown", "A12T-4GH7-QPL9-3N4M")
+	a.NoError(err)
+
+	// deleting an item drops its overrides, deleting a store drops all of them
+	a.NoError(db.Delete("E5T6-9UI3-TH15-QR88"))
+	overrides, _ = db.StoreOverrides("downtown")
+	a.Empty(overrides)
+	a.NoError(db.DeleteStore("downtown"))
+	a.ErrorIs(db.DeleteStore("downtown"), ErrStoreNotFound)
+	_, err = db.StoreCatalogue("downtown")
+	a.ErrorIs(err, ErrStoreNotFound)
+}
+
+func TestHandler_Stores(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "POST", "/api/v1/stores", bytes.NewBufferString(`{"id": "downtown", "name": "Downtown"}`))
+	a.Equal(201, rr.StatusCode)
+	a.JSONEq(`{"id": "downtown", "name": "Downtown"}`, body)
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/stores", bytes.NewBufferString(`{"id": "downtown", "name": "Downtown"}`))
+	a.Equal(409, rr.StatusCode)
+	rr, body = testRequest(t, ts, "PUT", "/api/v1/stores/downtown", bytes.NewBufferString(`{"name": "Downtown", "address": "1 Main St"}`))
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"id": "downtown", "name": "Downtown", "address": "1 Main St"}`, body)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/stores", nil)
+	a.Equal(200, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/stores/uptown", nil)
+	a.Equal(404, rr.StatusCode)
+
+	rr, body = testRequest(t, ts, "PUT", "/api/v1/stores/downtown/overrides/E5T6-9UI3-TH15-QR88", bytes.NewBufferString(`{"unit_price": 2.49}`))
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"produce_code": "E5T6-9UI3-TH15-QR88", "unit_price": 2.49}`, body)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/stores/downtown/overrides/A12T-4GH7-QPL9-3N4M", bytes.NewBufferString(`{"available": false}`))
+	a.Equal(200, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/stores/downtown/overrides/A12T-4GH7-QPL9-3N4M", bytes.NewBufferString(`{}`))
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/stores/uptown/overrides/A12T-4GH7-QPL9-3N4M", bytes.NewBufferString(`{"available": false}`))
+	a.Equal(404, rr.StatusCode)
+	rr, body = testRequest(t, ts, "GET", "/api/v1/stores/downtown/overrides", nil)
+	a.Equal(200, rr.StatusCode)
+	var overrides []StoreOverride
+	a.NoError(json.Unmarshal([]byte(body), &overrides))
+	a.Len(overrides, 2)
+
+	rr, body = testRequest(t, ts, "GET", "/api/v1/stores/downtown/produce", nil)
+	a.Equal(200, rr.StatusCode)
+	var items []*ProduceItem
+	a.NoError(json.Unmarshal([]byte(body), &items))
+	a.ElementsMatch([]string{"Peach", "Green Pepper", "Gala Apple"}, names(items))
+	rr, body = testRequest(t, ts, "GET", "/api/v1/stores/downtown/produce/E5T6-9UI3-TH15-QR88", nil)
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"produce_name": "Peach", "produce_code": "E5T6-9UI3-TH15-QR88", "produce_unit_price": 2.49}`, body)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/stores/downtown/produce/A12T-4GH7-QPL9-3N4M", nil)
+	a.Equal(404, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/stores/uptown/produce", nil)
+	a.Equal(404, rr.StatusCode)
+
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/stores/downtown/overrides/A12T-4GH7-QPL9-3N4M", nil)
+	a.Equal(204, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/stores/downtown/produce/A12T-4GH7-QPL9-3N4M", nil)
+	a.Equal(200, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/stores/downtown", nil)
+	a.Equal(204, rr.StatusCode)
+}
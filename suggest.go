@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+)
+
+// defaultSuggestLimit and maxSuggestLimit bound the number of suggestions SuggestProduce returns
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 50
+)
+
+// trieNode is a single node in the suggest trie.  Child runes are kept sorted so a depth-first
+// walk visits keys in order without sorting on every lookup.
+type trieNode struct {
+	// keys holds the runes of the children in sorted order
+	keys []rune
+	// children maps each rune to its child node
+	children map[rune]*trieNode
+	// codes holds the items whose key ends at this node
+	codes map[ProduceCode]bool
+}
+
+// suggestIndex is a prefix trie over produce names, each word in the name, and codes with and
+// without hyphens.  It is kept in sync with the database as a secondaryIndex and serves type-ahead
+// lookups in time proportional to the prefix length and number of suggestions, not catalogue size.
+type suggestIndex struct {
+	root *trieNode
+	// items maps codes to the indexed items
+	items map[ProduceCode]*ProduceItem
+}
+
+// newSuggestIndex returns an empty suggest index
+func newSuggestIndex() *suggestIndex {
+	return &suggestIndex{root: &trieNode{}, items: map[ProduceCode]*ProduceItem{}}
+}
+
+// check never fails, any item can be suggested
+func (s *suggestIndex) check(p *ProduceItem) error {
+	return nil
+}
+
+func (s *suggestIndex) insert(p *ProduceItem) {
+	s.items[p.Code] = p
+	for _, k := range suggestKeys(p) {
+		n := s.root
+		for _, r := range k {
+			child, ok := n.children[r]
+			if !ok {
+				child = &trieNode{}
+				if n.children == nil {
+					n.children = map[rune]*trieNode{}
+				}
+				n.children[r] = child
+				i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= r })
+				n.keys = append(n.keys, 0)
+				copy(n.keys[i+1:], n.keys[i:])
+				n.keys[i] = r
+			}
+			n = child
+		}
+		if n.codes == nil {
+			n.codes = map[ProduceCode]bool{}
+		}
+		n.codes[p.Code] = true
+	}
+}
+
+func (s *suggestIndex) remove(p *ProduceItem) {
+	delete(s.items, p.Code)
+	for _, k := range suggestKeys(p) {
+		s.removeKey(s.root, []rune(k), p.Code)
+	}
+}
+
+// removeKey drops code from the node at the end of key and prunes nodes left empty.
+// It reports whether n itself is now empty.
+func (s *suggestIndex) removeKey(n *trieNode, key []rune, code ProduceCode) bool {
+	if len(key) == 0 {
+		delete(n.codes, code)
+	} else if child, ok := n.children[key[0]]; ok && s.removeKey(child, key[1:], code) {
+		delete(n.children, key[0])
+		i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= key[0] })
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	}
+	return len(n.codes) == 0 && len(n.children) == 0
+}
+
+// suggest returns up to limit items with a key starting with prefix.  Items whose key matches
+// the prefix exactly come first, followed by the rest in alphabetical order of key.
+func (s *suggestIndex) suggest(prefix string, limit int) []*ProduceItem {
+	n := s.root
+	for _, r := range suggestKey(prefix) {
+		if n = n.children[r]; n == nil {
+			return []*ProduceItem{}
+		}
+	}
+
+	found := []*ProduceItem{}
+	seen := map[ProduceCode]bool{}
+	var walk func(n *trieNode) bool
+	walk = func(n *trieNode) bool {
+		// codes in a node are sorted so results are stable between calls
+		codes := make([]ProduceCode, 0, len(n.codes))
+		for c := range n.codes {
+			codes = append(codes, c)
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		for _, c := range codes {
+			if seen[c] {
+				continue
+			}
+			seen[c] = true
+			found = append(found, s.items[c])
+			if len(found) == limit {
+				return false
+			}
+		}
+		for _, r := range n.keys {
+			if !walk(n.children[r]) {
+				return false
+			}
+		}
+		return true
+	}
+	walk(n)
+	return found
+}
+
+// suggestKey normalizes text the same way for both indexing and lookups
+func suggestKey(text string) string {
+	return cases.Fold().String(NormalizeName(text))
+}
+
+// suggestKeys returns the keys an item is indexed under: the full name, the name starting at
+// each later word so "pep" finds "Green Pepper", and the code with and without hyphens.
+func suggestKeys(p *ProduceItem) []string {
+	name := suggestKey(p.Name)
+	keys := []string{name}
+	for i, r := range name {
+		if r == ' ' {
+			keys = append(keys, name[i+1:])
+		}
+	}
+	code := suggestKey(string(p.Code))
+	return append(keys, code, strings.ReplaceAll(code, "-", ""))
+}
+
+// Suggestions is the response returned by SuggestProduce
+type Suggestions struct {
+	Suggestions []*ProduceItem `json:"suggestions"`
+}
+
+// SuggestProduce serves type-ahead suggestions for a partly typed name or code.  The prefix query
+// parameter is required and matched against the start of the name, the start of any word in the
+// name, and the start of the code with or without hyphens.  An optional limit, 10 by default and
+// at most 50, caps the number of suggestions.
+func (h *Handler) SuggestProduce(w http.ResponseWriter, r *http.Request) {
+
+	prefix := r.URL.Query().Get("prefix")
+	if strings.TrimSpace(prefix) == "" {
+		http.Error(w, "prefix is required", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryLimit(r, defaultSuggestLimit, maxSuggestLimit)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dat, err := json.Marshal(Suggestions{Suggestions: h.db(r).Suggest(prefix, limit)})
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, "error generating json data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func names(items []*ProduceItem) []string {
+	n := make([]string, len(items))
+	for i, p := range items {
+		n[i] = p.Name
+	}
+	return n
+}
+
+func TestDB_Suggest(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+	a.NoError(db.Add(&ProduceItem{Name: "Pear", Code: "PEAR-0000-0000-0001", UnitPrice: 1}))
+	a.NoError(db.Add(&ProduceItem{Name: "Peaches", Code: "PCHS-0000-0000-0001", UnitPrice: 1}))
+
+	// an exact key comes first, then the rest alphabetically
+	a.Equal([]string{"Peach", "Peaches", "Pear"}, names(db.Suggest("pea", 10)))
+	a.Equal([]string{"Peach", "Peaches"}, names(db.Suggest("PEAC", 10)))
+
+	// later words in the name, codes with and without hyphens
+	a.Equal([]string{"Green Pepper"}, names(db.Suggest("pep", 10)))
+	a.Equal([]string{"Lettuce"}, names(db.Suggest("a12t-4g", 10)))
+	a.Equal([]string{"Lettuce"}, names(db.Suggest("A12T4GH", 10)))
+
+	// an item matching on several keys is only suggested once
+	a.NoError(db.Add(&ProduceItem{Name: "Pea Pea", Code: "PEAP-0000-0000-0001", UnitPrice: 1}))
+	a.Equal([]string{"Pea Pea", "Peach"}, names(db.Suggest("pea", 2)))
+
+	// the trie follows updates and deletes, pruning empty branches
+	_, err = db.Upsert(&ProduceItem{Name: "Quince", Code: "PEAR-0000-0000-0001", UnitPrice: 1})
+	a.NoError(err)
+	a.Equal([]string{"Quince"}, names(db.Suggest("q", 10)))
+	a.NotContains(names(db.Suggest("pear", 10)), "Pear")
+	a.NoError(db.Delete("PEAR-0000-0000-0001"))
+	a.Empty(db.Suggest("q", 10))
+	a.Empty(db.suggestIndex.root.children['q'])
+
+	a.Empty(db.Suggest("xyz", 10))
+}
+
+func TestHandler_SuggestProduce(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "GET", "/api/v1/produce/suggest?prefix=gr", nil)
+	a.Equal(200, rr.StatusCode)
+	var s Suggestions
+	a.NoError(json.Unmarshal([]byte(body), &s))
+	a.Equal([]string{"Green Pepper"}, names(s.Suggestions))
+
+	rr, body = testRequest(t, ts, "GET", "/api/v1/produce/suggest?prefix=zz", nil)
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"suggestions":[]}`, body)
+
+	for _, path := range []string{"/api/v1/produce/suggest", "/api/v1/produce/suggest?prefix=%20", "/api/v1/produce/suggest?prefix=a&limit=51"} {
+		rr, _ = testRequest(t, ts, "GET", path, nil)
+		a.Equal(400, rr.StatusCode, path)
+	}
+}
+
+// benchmarkSuggestIndex builds a trie over n generated items
+func benchmarkSuggestIndex(n int) *suggestIndex {
+	words := []string{"Red", "Green", "Yellow", "Gala", "Fuji", "Baby", "Sweet", "Organic",
+		"Apple", "Pepper", "Lettuce", "Peach", "Pear", "Onion", "Carrot", "Potato", "Tomato", "Kiwi"}
+	rnd := rand.New(rand.NewSource(1))
+	s := newSuggestIndex()
+	for i := 0; i < n; i++ {
+		s.insert(&ProduceItem{
+			Name: fmt.Sprintf("%s %s %s %d", words[rnd.Intn(len(words))], words[rnd.Intn(len(words))],
+				words[rnd.Intn(len(words))], i),
+			Code: ProduceCode(fmt.Sprintf("%04X-%04X-%04X-%04X", rnd.Intn(1<<16), rnd.Intn(1<<16), rnd.Intn(1<<16), i%(1<<16))),
+		})
+	}
+	return s
+}
+
+func BenchmarkSuggest(b *testing.B) {
+	s := benchmarkSuggestIndex(100000)
+	for _, prefix := range []string{"p", "pepp", "green pepper 1", "a1", "zzz"} {
+		b.Run(prefix, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.suggest(prefix, defaultSuggestLimit)
+			}
+		})
+	}
+}
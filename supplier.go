@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ErrInvalidSupplier indicates a supplier id or name is not valid
+var ErrInvalidSupplier = errors.New("supplier is invalid")
+
+// ErrSupplierNotFound will be used when the specified supplier is not found
+var ErrSupplierNotFound = errors.New("supplier not found")
+
+// ErrDuplicateSupplier will be used when a supplier is trying to be added with an id that already exists
+var ErrDuplicateSupplier = errors.New("supplier already exists")
+
+// ErrSupplierInUse will be used when deleting a supplier that still supplies produce without
+// cascading the delete
+var ErrSupplierInUse = errors.New("supplier still supplies produce")
+
+// ErrInvalidSupply indicates the cost price or lead time of a supply link is not valid
+var ErrInvalidSupply = errors.New("supply cost price or lead time is invalid")
+
+// Supplier is a grower or wholesaler produce is sourced from
+type Supplier struct {
+	// ID is the lower case slug that identifies the supplier, e.g. sunny-acres
+	ID string `json:"id"`
+	// Name is the display name, checked against the same policy as produce names
+	Name string `json:"name"`
+	// Contact is free text such as an email address or phone number
+	Contact string `json:"contact,omitempty"`
+}
+
+// Supply links a supplier to a produce item it supplies.  An item can have many suppliers and
+// a supplier can supply many items.
+type Supply struct {
+	SupplierID string      `json:"supplier_id"`
+	Code       ProduceCode `json:"produce_code"`
+	// CostPrice is what the supplier charges per unit, a number with up to two decimal places
+	CostPrice float64 `json:"cost_price"`
+	// LeadTimeDays is the number of days between ordering and delivery
+	LeadTimeDays int `json:"lead_time_days"`
+}
+
+// supplierRegistry holds the suppliers and what each supplies.  It is guarded by the DB mutex.
+type supplierRegistry struct {
+	suppliers map[string]*Supplier
+	// supplies maps supplier ids to the produce codes they supply
+	supplies map[string]map[ProduceCode]Supply
+}
+
+// newSupplierRegistry returns a registry with no suppliers
+func newSupplierRegistry() *supplierRegistry {
+	return &supplierRegistry{suppliers: map[string]*Supplier{}, supplies: map[string]map[ProduceCode]Supply{}}
+}
+
+// forget drops every supply of the produce code, used when the item is removed
+func (s *supplierRegistry) forget(code ProduceCode) {
+	for id, supplies := range s.supplies {
+		delete(supplies, code)
+		if len(supplies) == 0 {
+			delete(s.supplies, id)
+		}
+	}
+}
+
+// list returns the supplies matching keep sorted by produce code then supplier id
+func (s *supplierRegistry) list(keep func(Supply) bool) []Supply {
+	found := []Supply{}
+	for _, supplies := range s.supplies {
+		for _, sp := range supplies {
+			if keep(sp) {
+				found = append(found, sp)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Code != found[j].Code {
+			return found[i].Code < found[j].Code
+		}
+		return found[i].SupplierID < found[j].SupplierID
+	})
+	return found
+}
+
+// validateSupplier checks the id and name of the supplier and stores them normalized
+func (d *DB) validateSupplier(s *Supplier) error {
+	var err error
+	if s.ID, err = parseSlug(s.ID, ErrInvalidSupplier); err != nil {
+		return err
+	}
+	if s.Name, err = d.ParseName(s.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddSupplier creates a new supplier.
+// If a supplier exists with the same id a ErrDuplicateSupplier is returned
+func (d *DB) AddSupplier(s *Supplier) error {
+
+	if err := d.validateSupplier(s); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.suppliers.suppliers[s.ID] != nil {
+		return ErrDuplicateSupplier
+	}
+	stored := *s
+	d.suppliers.suppliers[s.ID] = &stored
+	return nil
+}
+
+// UpdateSupplier replaces the name and contact of the supplier with the same id.
+// If the supplier is not found a ErrSupplierNotFound is returned
+func (d *DB) UpdateSupplier(s *Supplier) error {
+
+	if err := d.validateSupplier(s); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.suppliers.suppliers[s.ID] == nil {
+		return ErrSupplierNotFound
+	}
+	stored := *s
+	d.suppliers.suppliers[s.ID] = &stored
+	return nil
+}
+
+// GetSupplier returns the supplier with the passed id
+// If the supplier is not found a ErrSupplierNotFound is returned
+func (d *DB) GetSupplier(id string) (*Supplier, error) {
+	id, err := parseSlug(id, ErrSupplierNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	s := d.suppliers.suppliers[id]
+	if s == nil {
+		return nil, ErrSupplierNotFound
+	}
+	stored := *s
+	return &stored, nil
+}
+
+// ListSuppliers returns every supplier sorted by id
+func (d *DB) ListSuppliers() []*Supplier {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	ss := make([]*Supplier, 0, len(d.suppliers.suppliers))
+	for _, s := range d.suppliers.suppliers {
+		stored := *s
+		ss = append(ss, &stored)
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].ID < ss[j].ID })
+	return ss
+}
+
+// DeleteSupplier removes the supplier with the passed id.  By default a supplier that still supplies
+// any produce is not removed and a ErrSupplierInUse is returned.  When cascade is set its supplies
+// are removed along with it.
+// If the supplier is not found a ErrSupplierNotFound is returned
+func (d *DB) DeleteSupplier(id string, cascade bool) error {
+	id, err := parseSlug(id, ErrSupplierNotFound)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.suppliers.suppliers[id] == nil {
+		return ErrSupplierNotFound
+	}
+	if len(d.suppliers.supplies[id]) > 0 && !cascade {
+		return ErrSupplierInUse
+	}
+	delete(d.suppliers.supplies, id)
+	delete(d.suppliers.suppliers, id)
+	return nil
+}
+
+// SetSupply records that the supplier supplies the produce item at the cost price and lead time,
+// replacing any previous terms.  The cost price is rounded to two decimal places.
+// If the supplier or item is not found a ErrSupplierNotFound or ErrNotFound is returned
+// If the cost price is negative or the lead time is negative a ErrInvalidSupply is returned
+func (d *DB) SetSupply(sp *Supply) error {
+
+	id, err := parseSlug(sp.SupplierID, ErrSupplierNotFound)
+	if err != nil {
+		return err
+	}
+	sp.SupplierID = id
+	if sp.Code, err = ParseProduceCode(string(sp.Code)); err != nil {
+		return err
+	}
+	if !PriceIsValid(sp.CostPrice, d.logger) || sp.LeadTimeDays < 0 {
+		return ErrInvalidSupply
+	}
+	if sp.CostPrice, err = strconv.ParseFloat(fmt.Sprintf("%0.2f", sp.CostPrice), 64); err != nil {
+		return ErrInvalidSupply
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.suppliers.suppliers[sp.SupplierID] == nil {
+		return ErrSupplierNotFound
+	}
+	if GetItemIndex(sp.Code, d.Produce, d.logger) == nil {
+		return ErrNotFound
+	}
+	if d.suppliers.supplies[sp.SupplierID] == nil {
+		d.suppliers.supplies[sp.SupplierID] = map[ProduceCode]Supply{}
+	}
+	d.suppliers.supplies[sp.SupplierID][sp.Code] = *sp
+	return nil
+}
+
+// DeleteSupply removes the link between the supplier and the produce item.
+// If the supplier does not supply the item a ErrNotFound is returned
+func (d *DB) DeleteSupply(supplierID string, code ProduceCode) error {
+	supplierID, err := parseSlug(supplierID, ErrSupplierNotFound)
+	if err != nil {
+		return err
+	}
+	if code, err = ParseProduceCode(string(code)); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.suppliers.suppliers[supplierID] == nil {
+		return ErrSupplierNotFound
+	}
+	if _, ok := d.suppliers.supplies[supplierID][code]; !ok {
+		return ErrNotFound
+	}
+	delete(d.suppliers.supplies[supplierID], code)
+	if len(d.suppliers.supplies[supplierID]) == 0 {
+		delete(d.suppliers.supplies, supplierID)
+	}
+	return nil
+}
+
+// SuppliesBySupplier returns everything the supplier supplies, sorted by produce code.
+// If the supplier is not found a ErrSupplierNotFound is returned
+func (d *DB) SuppliesBySupplier(supplierID string) ([]Supply, error) {
+	supplierID, err := parseSlug(supplierID, ErrSupplierNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.suppliers.suppliers[supplierID] == nil {
+		return nil, ErrSupplierNotFound
+	}
+	return d.suppliers.list(func(sp Supply) bool { return sp.SupplierID == supplierID }), nil
+}
+
+// SuppliesByCode returns every supplier's terms for the produce item, sorted by supplier id.
+// If the item is not found a ErrNotFound is returned
+func (d *DB) SuppliesByCode(code ProduceCode) ([]Supply, error) {
+	code, err := ParseProduceCode(string(code))
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if GetItemIndex(code, d.Produce, d.logger) == nil {
+		return nil, ErrNotFound
+	}
+	return d.suppliers.list(func(sp Supply) bool { return sp.Code == code }), nil
+}
+
+// ListSuppliers returns a json array of every supplier, sorted by id
+func (h *Handler) ListSuppliers(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, r, http.StatusOK, h.db(r).ListSuppliers())
+}
+
+// GetSupplier returns the supplier with the id in the path, or a 404 if it is not found
+func (h *Handler) GetSupplier(w http.ResponseWriter, r *http.Request) {
+	s, err := h.db(r).GetSupplier(chi.URLParam(r, "id"))
+	h.writeItem(w, r, s, err)
+}
+
+// AddSupplier creates the supplier in the json body, e.g. {"id": "sunny-acres", "name": "Sunny Acres",
+// "contact": "orders@sunnyacres.example"}, and returns it with a 201.  A supplier with the same id gets
+// a 409 and an invalid supplier a 400.
+func (h *Handler) AddSupplier(w http.ResponseWriter, r *http.Request) {
+	var s Supplier
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db(r).AddSupplier(&s); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	h.writeJSON(w, r, http.StatusCreated, s)
+}
+
+// UpdateSupplier replaces the name and contact of the supplier with the id in the path with those in
+// the json body
+func (h *Handler) UpdateSupplier(w http.ResponseWriter, r *http.Request) {
+	var s Supplier
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.ID = chi.URLParam(r, "id")
+	err := h.db(r).UpdateSupplier(&s)
+	h.writeItem(w, r, s, err)
+}
+
+// DeleteSupplier removes the supplier with the id in the path and returns a 204.  A supplier that still
+// supplies produce gets a 409 unless ?cascade=true is passed, see DB.DeleteSupplier.
+func (h *Handler) DeleteSupplier(w http.ResponseWriter, r *http.Request) {
+	cascade, err := queryBool(r, "cascade")
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db(r).DeleteSupplier(chi.URLParam(r, "id"), cascade); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// ListSupplierProduce returns a json array of everything the supplier with the id in the path
+// supplies, with cost price and lead time
+func (h *Handler) ListSupplierProduce(w http.ResponseWriter, r *http.Request) {
+	sps, err := h.db(r).SuppliesBySupplier(chi.URLParam(r, "id"))
+	h.writeItem(w, r, sps, err)
+}
+
+// SetSupplierProduce records that the supplier in the path supplies the produce code in the path on
+// the terms in the json body, e.g. {"cost_price": 1.25, "lead_time_days": 3}.  Existing terms are
+// replaced.  The stored supply is returned.
+func (h *Handler) SetSupplierProduce(w http.ResponseWriter, r *http.Request) {
+	var sp Supply
+	if err := json.NewDecoder(r.Body).Decode(&sp); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sp.SupplierID = chi.URLParam(r, "id")
+	sp.Code = produceCodeFromContext(r.Context())
+	err := h.db(r).SetSupply(&sp)
+	h.writeItem(w, r, sp, err)
+}
+
+// DeleteSupplierProduce removes the link between the supplier and produce code in the path and
+// returns a 204, or a 404 if the supplier does not supply the item
+func (h *Handler) DeleteSupplierProduce(w http.ResponseWriter, r *http.Request) {
+	if err := h.db(r).DeleteSupply(chi.URLParam(r, "id"), produceCodeFromContext(r.Context())); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// ListProduceSuppliers returns a json array of every supplier's terms for the produce code in the path
+func (h *Handler) ListProduceSuppliers(w http.ResponseWriter, r *http.Request) {
+	sps, err := h.db(r).SuppliesByCode(produceCodeFromContext(r.Context()))
+	h.writeItem(w, r, sps, err)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Suppliers(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	a.NoError(db.AddSupplier(&Supplier{ID: "Sunny-Acres", Name: "Sunny Acres"}))
+	a.NoError(db.AddSupplier(&Supplier{ID: "valley-farms", Name: "Valley Farms", Contact: "orders@valley.example"}))
+	a.ErrorIs(db.AddSupplier(&Supplier{ID: "sunny-acres", Name: "Sunny Acres"}), ErrDuplicateSupplier)
+	a.ErrorIs(db.AddSupplier(&Supplier{ID: "sunny acres", Name: "Sunny Acres"}), ErrInvalidSupplier)
+	a.ErrorIs(db.AddSupplier(&Supplier{ID: "hill-top"}), ErrInvalidName)
+
+	s, err := db.GetSupplier("SUNNY-ACRES")
+	a.NoError(err)
+	a.Equal(&Supplier{ID: "sunny-acres", Name: "Sunny Acres"}, s)
+	_, err = db.GetSupplier("hill-top")
+	a.ErrorIs(err, ErrSupplierNotFound)
+	a.NoError(db.UpdateSupplier(&Supplier{ID: "sunny-acres", Name: "Sunny Acres", Contact: "555-0100"}))
+	a.ErrorIs(db.UpdateSupplier(&Supplier{ID: "hill-top", Name: "Hill Top"}), ErrSupplierNotFound)
+	a.Len(db.ListSuppliers(), 2)
+
+	// supplies link many suppliers to many items
+	sp := &Supply{SupplierID: "sunny-acres", Code: "a12t-4gh7-qpl9-3n4m", CostPrice: 1.999, LeadTimeDays: 2}
+	a.NoError(db.SetSupply(sp))
+	a.Equal(2.0, sp.CostPrice)
+	a.Equal(ProduceCode("A12T-4GH7-QPL9-3N4M"), sp.Code)
+	a.NoError(db.SetSupply(&Supply{SupplierID: "sunny-acres", Code: "E5T6-9UI3-TH15-QR88", CostPrice: 1.5}))
+	a.NoError(db.SetSupply(&Supply{SupplierID: "valley-farms", Code: "A12T-4GH7-QPL9-3N4M", CostPrice: 2.5, LeadTimeDays: 1}))
+	a.ErrorIs(db.SetSupply(&Supply{SupplierID: "hill-top", Code: "A12T-4GH7-QPL9-3N4M"}), ErrSupplierNotFound)
+	a.ErrorIs(db.SetSupply(&Supply{SupplierID: "sunny-acres", Code: "AAAA-0000-0000-0000"}), ErrNotFound)
+	a.ErrorIs(db.SetSupply(&Supply{SupplierID: "sunny-acres", Code: "A12T-4GH7-QPL9-3N4M", CostPrice: -1}), ErrInvalidSupply)
+	a.ErrorIs(db.SetSupply(&Supply{SupplierID: "sunny-acres", Code: "A12T-4GH7-QPL9-3N4M", LeadTimeDays: -1}), ErrInvalidSupply)
+
+	sps, err := db.SuppliesByCode("A12T-4GH7-QPL9-3N4M")
+	a.NoError(err)
+	a.Equal([]Supply{
+		{SupplierID: "sunny-acres", Code: "A12T-4GH7-QPL9-3N4M", CostPrice: 2, LeadTimeDays: 2},
+		{SupplierID: "valley-farms", Code: "A12T-4GH7-QPL9-3N4M", CostPrice: 2.5, LeadTimeDays: 1},
+	}, sps)
+	sps, err = db.SuppliesBySupplier("sunny-acres")
+	a.NoError(err)
+	a.Len(sps, 2)
+
+	// removing one supply leaves the other suppliers of the item alone
+	a.NoError(db.DeleteSupply("valley-farms", "A12T-4GH7-QPL9-3N4M"))
+	a.ErrorIs(db.DeleteSupply("valley-farms", "A12T-4GH7-QPL9-3N4M"), ErrNotFound)
+	sps, _ = db.SuppliesByCode("A12T-4GH7-QPL9-3N4M")
+	a.Len(sps, 1)
+
+	// deleting an item drops its supplies
+	a.NoError(db.Delete("E5T6-9UI3-TH15-QR88"))
+	sps, _ = db.SuppliesBySupplier("sunny-acres")
+	a.Len(sps, 1)
+
+	a.ErrorIs(db.DeleteSupplier("sunny-acres", false), ErrSupplierInUse)
+	a.NoError(db.DeleteSupplier("valley-farms", false))
+	a.NoError(db.DeleteSupplier("sunny-acres", true))
+	a.Empty(db.ListSuppliers())
+	sps, _ = db.SuppliesByCode("A12T-4GH7-QPL9-3N4M")
+	a.Empty(sps)
+}
+
+func TestHandler_Suppliers(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "POST", "/api/v1/suppliers", bytes.NewBufferString(`{"id": "sunny-acres", "name": "Sunny Acres"}`))
+	a.Equal(201, rr.StatusCode)
+	a.JSONEq(`{"id": "sunny-acres", "name": "Sunny Acres"}`, body)
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/suppliers", bytes.NewBufferString(`{"id": "sunny-acres", "name": "Sunny Acres"}`))
+	a.Equal(409, rr.StatusCode)
+	rr, body = testRequest(t, ts, "PUT", "/api/v1/suppliers/sunny-acres", bytes.NewBufferString(`{"name": "Sunny Acres", "contact": "555-0100"}`))
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"id": "sunny-acres", "name": "Sunny Acres", "contact": "555-0100"}`, body)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/suppliers/sunny-acres", nil)
+	a.Equal(200, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/suppliers/hill-top", nil)
+	a.Equal(404, rr.StatusCode)
+	rr, body = testRequest(t, ts, "GET", "/api/v1/suppliers", nil)
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`[{"id": "sunny-acres", "name": "Sunny Acres", "contact": "555-0100"}]`, body)
+
+	rr, body = testRequest(t, ts, "PUT", "/api/v1/suppliers/sunny-acres/produce/a12t-4gh7-qpl9-3n4m", bytes.NewBufferString(`{"cost_price": 1.25, "lead_time_days": 3}`))
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"supplier_id": "sunny-acres", "produce_code": "A12T-4GH7-QPL9-3N4M", "cost_price": 1.25, "lead_time_days": 3}`, body)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/suppliers/sunny-acres/produce/AAAA-0000-0000-0000", bytes.NewBufferString(`{"cost_price": 1}`))
+	a.Equal(404, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/suppliers/sunny-acres/produce/not-a-code", bytes.NewBufferString(`{"cost_price": 1}`))
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/suppliers/sunny-acres/produce/A12T-4GH7-QPL9-3N4M", bytes.NewBufferString(`{"cost_price": -1}`))
+	a.Equal(400, rr.StatusCode)
+
+	var sps []Supply
+	rr, body = testRequest(t, ts, "GET", "/api/v1/suppliers/sunny-acres/produce", nil)
+	a.Equal(200, rr.StatusCode)
+	a.NoError(json.Unmarshal([]byte(body), &sps))
+	a.Len(sps, 1)
+	rr, body = testRequest(t, ts, "GET", "/api/v1/produce/A12T-4GH7-QPL9-3N4M/suppliers", nil)
+	a.Equal(200, rr.StatusCode)
+	a.NoError(json.Unmarshal([]byte(body), &sps))
+	a.Len(sps, 1)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/produce/AAAA-0000-0000-0000/suppliers", nil)
+	a.Equal(404, rr.StatusCode)
+
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/suppliers/sunny-acres", nil)
+	a.Equal(409, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/suppliers/sunny-acres/produce/A12T-4GH7-QPL9-3N4M", nil)
+	a.Equal(204, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/suppliers/sunny-acres/produce/A12T-4GH7-QPL9-3N4M", nil)
+	a.Equal(404, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/suppliers/sunny-acres", nil)
+	a.Equal(204, rr.StatusCode)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ErrInvalidTag indicates a tag id or name is not valid, or an item references a tag that does not exist
+var ErrInvalidTag = errors.New("tag is invalid")
+
+// ErrTagNotFound will be used when the specified tag is not found
+var ErrTagNotFound = errors.New("tag not found")
+
+// ErrDuplicateTag will be used when a tag is trying to be added with an id that already exists
+var ErrDuplicateTag = errors.New("tag already exists")
+
+// ErrTagInUse will be used when deleting a tag that is still on items without cascading the delete
+var ErrTagInUse = errors.New("tag is in use")
+
+// Tag is a free-form label such as organic or seasonal.  Unlike categories tags are flat.
+type Tag struct {
+	// ID is the lower case slug that identifies the tag, e.g. organic
+	ID string `json:"id"`
+	// Name is an optional display name, checked against the same policy as produce names
+	Name string `json:"name,omitempty"`
+}
+
+// validateTag checks the id and name of the tag and stores them normalized
+func (d *DB) validateTag(t *Tag) error {
+	var err error
+	if t.ID, err = parseSlug(t.ID, ErrInvalidTag); err != nil {
+		return err
+	}
+	if t.Name != "" {
+		if t.Name, err = d.ParseName(t.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddTag creates a new tag.
+// If a tag exists with the same id a ErrDuplicateTag is returned
+func (d *DB) AddTag(t *Tag) error {
+
+	if err := d.validateTag(t); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.taxonomy.tags[t.ID] != nil {
+		return ErrDuplicateTag
+	}
+	stored := *t
+	d.taxonomy.tags[t.ID] = &stored
+	return nil
+}
+
+// UpdateTag renames the tag with the same id.
+// If the tag is not found a ErrTagNotFound is returned
+func (d *DB) UpdateTag(t *Tag) error {
+
+	if err := d.validateTag(t); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.taxonomy.tags[t.ID] == nil {
+		return ErrTagNotFound
+	}
+	stored := *t
+	d.taxonomy.tags[t.ID] = &stored
+	return nil
+}
+
+// GetTag returns the tag with the passed id
+// If the tag is not found a ErrTagNotFound is returned
+func (d *DB) GetTag(id string) (*Tag, error) {
+	id, err := parseSlug(id, ErrTagNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	t := d.taxonomy.tags[id]
+	if t == nil {
+		return nil, ErrTagNotFound
+	}
+	stored := *t
+	return &stored, nil
+}
+
+// ListTags returns every tag sorted by id
+func (d *DB) ListTags() []*Tag {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	ts := make([]*Tag, 0, len(d.taxonomy.tags))
+	for _, t := range d.taxonomy.tags {
+		stored := *t
+		ts = append(ts, &stored)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].ID < ts[j].ID })
+	return ts
+}
+
+// DeleteTag removes the tag with the passed id.  By default a tag that is on any item is not removed
+// and a ErrTagInUse is returned.  When cascade is set the tag is also taken off every item.
+// If the tag is not found a ErrTagNotFound is returned
+func (d *DB) DeleteTag(id string, cascade bool) error {
+	id, err := parseSlug(id, ErrTagNotFound)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.taxonomy.tags[id] == nil {
+		return ErrTagNotFound
+	}
+
+	codes := d.taxonomy.tagItems[id]
+	if len(codes) > 0 {
+		if !cascade {
+			return ErrTagInUse
+		}
+		drop := map[string]bool{id: true}
+		d.unassign(codes, func(p *ProduceItem) { p.Tags = without(p.Tags, drop) })
+	}
+	delete(d.taxonomy.tags, id)
+	return nil
+}
+
+// ListTags returns a json array of every tag, sorted by id
+func (h *Handler) ListTags(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, r, http.StatusOK, h.db(r).ListTags())
+}
+
+// GetTag returns the tag with the id in the path, or a 404 if it is not found
+func (h *Handler) GetTag(w http.ResponseWriter, r *http.Request) {
+	t, err := h.db(r).GetTag(chi.URLParam(r, "id"))
+	h.writeItem(w, r, t, err)
+}
+
+// AddTag creates the tag in the json body, e.g. {"id": "organic", "name": "Organic"}, and returns it
+// with a 201.  A tag with the same id gets a 409 and an invalid tag a 400.
+func (h *Handler) AddTag(w http.ResponseWriter, r *http.Request) {
+	var t Tag
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db(r).AddTag(&t); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	h.writeJSON(w, r, http.StatusCreated, t)
+}
+
+// UpdateTag replaces the name of the tag with the id in the path with the one in the json body
+func (h *Handler) UpdateTag(w http.ResponseWriter, r *http.Request) {
+	var t Tag
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.ID = chi.URLParam(r, "id")
+	err := h.db(r).UpdateTag(&t)
+	h.writeItem(w, r, t, err)
+}
+
+// DeleteTag removes the tag with the id in the path and returns a 204.  A tag on any item gets a 409
+// unless ?cascade=true is passed, see DB.DeleteTag.
+func (h *Handler) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	cascade, err := queryBool(r, "cascade")
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db(r).DeleteTag(chi.URLParam(r, "id"), cascade); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Tags(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	a.NoError(db.AddTag(&Tag{ID: "Organic"}))
+	a.NoError(db.AddTag(&Tag{ID: "seasonal", Name: "In Season"}))
+	a.ErrorIs(db.AddTag(&Tag{ID: "organic"}), ErrDuplicateTag)
+	a.ErrorIs(db.AddTag(&Tag{ID: "-organic"}), ErrInvalidTag)
+	a.ErrorIs(db.AddTag(&Tag{ID: "local", Name: "<b>"}), ErrInvalidName)
+
+	tag, err := db.GetTag("ORGANIC")
+	a.NoError(err)
+	a.Equal(&Tag{ID: "organic"}, tag)
+	_, err = db.GetTag("local")
+	a.ErrorIs(err, ErrTagNotFound)
+
+	a.NoError(db.UpdateTag(&Tag{ID: "organic", Name: "Organic"}))
+	a.ErrorIs(db.UpdateTag(&Tag{ID: "local"}), ErrTagNotFound)
+	ts := db.ListTags()
+	a.Len(ts, 2)
+	a.Equal(&Tag{ID: "organic", Name: "Organic"}, ts[0])
+
+	// deletes are restricted while the tag is on an item, cascading takes it off
+	_, err = db.SetTags("A12T-4GH7-QPL9-3N4M", []string{"organic", "seasonal"})
+	a.NoError(err)
+	a.ErrorIs(db.DeleteTag("organic", false), ErrTagInUse)
+	a.NoError(db.DeleteTag("organic", true))
+	p, err := db.Get("A12T-4GH7-QPL9-3N4M")
+	a.NoError(err)
+	a.Equal([]string{"seasonal"}, p.Tags)
+	a.ErrorIs(db.DeleteTag("organic", true), ErrTagNotFound)
+}
+
+func TestHandler_Tags(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	ts := httptest.NewServer(LoadRouter(NewHandler(db, runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "POST", "/api/v1/tags", bytes.NewBufferString(`{"id": "organic"}`))
+	a.Equal(201, rr.StatusCode)
+	a.JSONEq(`{"id": "organic"}`, body)
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/tags", bytes.NewBufferString(`{"id": "organic"}`))
+	a.Equal(409, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/tags", bytes.NewBufferString(`{"id": "not a slug"}`))
+	a.Equal(400, rr.StatusCode)
+
+	rr, body = testRequest(t, ts, "PUT", "/api/v1/tags/organic", bytes.NewBufferString(`{"name": "Organic"}`))
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"id": "organic", "name": "Organic"}`, body)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/tags/local", bytes.NewBufferString(`{"name": "Local"}`))
+	a.Equal(404, rr.StatusCode)
+
+	rr, body = testRequest(t, ts, "GET", "/api/v1/tags", nil)
+	a.Equal(200, rr.StatusCode)
+	var tags []*Tag
+	a.NoError(json.Unmarshal([]byte(body), &tags))
+	a.Equal([]*Tag{{ID: "organic", Name: "Organic"}}, tags)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/tags/organic", nil)
+	a.Equal(200, rr.StatusCode)
+
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/produce/A12T-4GH7-QPL9-3N4M/tags", bytes.NewBufferString(`{"tags": ["organic"]}`))
+	a.Equal(200, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/tags/organic", nil)
+	a.Equal(409, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/tags/organic?cascade=true", nil)
+	a.Equal(204, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "GET", "/api/v1/tags/organic", nil)
+	a.Equal(404, rr.StatusCode)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxSlugLength is the longest category or tag id allowed
+const maxSlugLength = 64
+
+// slugRegex matches category and tag ids: lower case letters and digits in words joined by
+// single hyphens, e.g. leafy-greens
+var slugRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// parseSlug validates a category or tag id and returns it in lower case.  err is returned
+// when the id is not valid.
+func parseSlug(s string, err error) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) > maxSlugLength || !slugRegex.MatchString(s) {
+		return "", err
+	}
+	return s, nil
+}
+
+// parseSlugs validates a list of category or tag ids and returns them sorted with duplicates
+// dropped so equal lists compare equal.  An empty list is returned as nil.
+func parseSlugs(ss []string, err error) ([]string, error) {
+	if len(ss) == 0 {
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	slugs := make([]string, 0, len(ss))
+	for _, s := range ss {
+		slug, e := parseSlug(s, err)
+		if e != nil {
+			return nil, e
+		}
+		if !seen[slug] {
+			seen[slug] = true
+			slugs = append(slugs, slug)
+		}
+	}
+	sort.Strings(slugs)
+	return slugs, nil
+}
+
+// taxonomyIndex holds the categories and tags and tracks which items are assigned to each.
+// As a secondaryIndex it rejects items that reference a category or tag that does not exist,
+// and the links it keeps let categories and tags in use be found without a scan.
+type taxonomyIndex struct {
+	categories map[string]*Category
+	tags       map[string]*Tag
+	// categoryItems and tagItems map ids to the codes of the items assigned to them
+	categoryItems map[string]map[ProduceCode]bool
+	tagItems      map[string]map[ProduceCode]bool
+}
+
+// newTaxonomyIndex returns an index with no categories or tags
+func newTaxonomyIndex() *taxonomyIndex {
+	return &taxonomyIndex{
+		categories:    map[string]*Category{},
+		tags:          map[string]*Tag{},
+		categoryItems: map[string]map[ProduceCode]bool{},
+		tagItems:      map[string]map[ProduceCode]bool{},
+	}
+}
+
+func (t *taxonomyIndex) check(p *ProduceItem) error {
+	for _, id := range p.Categories {
+		if t.categories[id] == nil {
+			return fmt.Errorf("%w: %s does not exist", ErrInvalidCategory, id)
+		}
+	}
+	for _, id := range p.Tags {
+		if t.tags[id] == nil {
+			return fmt.Errorf("%w: %s does not exist", ErrInvalidTag, id)
+		}
+	}
+	return nil
+}
+
+func (t *taxonomyIndex) insert(p *ProduceItem) {
+	link(t.categoryItems, p.Categories, p.Code)
+	link(t.tagItems, p.Tags, p.Code)
+}
+
+func (t *taxonomyIndex) remove(p *ProduceItem) {
+	unlink(t.categoryItems, p.Categories, p.Code)
+	unlink(t.tagItems, p.Tags, p.Code)
+}
+
+func (t *taxonomyIndex) clone() secondaryIndex {
+	c := newTaxonomyIndex()
+	for id, cat := range t.categories {
+		c.categories[id] = cat
+	}
+	for id, tag := range t.tags {
+		c.tags[id] = tag
+	}
+	for id, codes := range t.categoryItems {
+		for code := range codes {
+			link(c.categoryItems, []string{id}, code)
+		}
+	}
+	for id, codes := range t.tagItems {
+		for code := range codes {
+			link(c.tagItems, []string{id}, code)
+		}
+	}
+	return c
+}
+
+// link records code against each id
+func link(items map[string]map[ProduceCode]bool, ids []string, code ProduceCode) {
+	for _, id := range ids {
+		if items[id] == nil {
+			items[id] = map[ProduceCode]bool{}
+		}
+		items[id][code] = true
+	}
+}
+
+// unlink drops code from each id
+func unlink(items map[string]map[ProduceCode]bool, ids []string, code ProduceCode) {
+	for _, id := range ids {
+		delete(items[id], code)
+		if len(items[id]) == 0 {
+			delete(items, id)
+		}
+	}
+}
+
+// children returns the ids of the categories directly below id
+func (t *taxonomyIndex) children(id string) []string {
+	var ids []string
+	for _, c := range t.categories {
+		if c.ParentID == id {
+			ids = append(ids, c.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// subtree returns the ids of the category and every category below it.
+// An unknown id returns an empty set.
+func (t *taxonomyIndex) subtree(id string) map[string]bool {
+	ids := map[string]bool{}
+	if t.categories[id] == nil {
+		return ids
+	}
+	pending := []string{id}
+	for len(pending) > 0 {
+		id, pending = pending[0], pending[1:]
+		ids[id] = true
+		pending = append(pending, t.children(id)...)
+	}
+	return ids
+}
+
+// SetCategories replaces the categories the item with the passed code is assigned to and
+// returns the updated item.  Every category must exist.
+// If the code or a category id is invalid an ErrInvalidCode or ErrInvalidCategory is returned
+// If the item is not found a ErrNotFound is returned
+func (d *DB) SetCategories(code ProduceCode, ids []string) (*ProduceItem, error) {
+	ids, err := parseSlugs(ids, ErrInvalidCategory)
+	if err != nil {
+		return nil, err
+	}
+	return d.updateItem(code, func(p *ProduceItem) { p.Categories = ids })
+}
+
+// SetTags replaces the tags on the item with the passed code and returns the updated item.
+// Every tag must exist.
+// If the code or a tag id is invalid an ErrInvalidCode or ErrInvalidTag is returned
+// If the item is not found a ErrNotFound is returned
+func (d *DB) SetTags(code ProduceCode, ids []string) (*ProduceItem, error) {
+	ids, err := parseSlugs(ids, ErrInvalidTag)
+	if err != nil {
+		return nil, err
+	}
+	return d.updateItem(code, func(p *ProduceItem) { p.Tags = ids })
+}
+
+// updateItem applies update to a copy of the item with the passed code and stores the copy
+// in its place, provided it passes every secondary index check.
+func (d *DB) updateItem(code ProduceCode, update func(p *ProduceItem)) (*ProduceItem, error) {
+
+	code, err := ParseProduceCode(string(code))
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	idx := GetItemIndex(code, d.Produce, d.logger)
+	if idx == nil {
+		return nil, ErrNotFound
+	}
+	p := *d.Produce[*idx]
+	update(&p)
+	if err := d.checkIndexes(&p); err != nil {
+		return nil, err
+	}
+	d.replace(*idx, &p)
+	return &p, nil
+}
+
+// unassign removes the categories or tags selected by drop from every item with a code in codes.
+// The caller must hold mtx.
+func (d *DB) unassign(codes map[ProduceCode]bool, drop func(p *ProduceItem)) {
+	for code := range codes {
+		if idx := GetItemIndex(code, d.Produce, d.logger); idx != nil {
+			p := *d.Produce[*idx]
+			drop(&p)
+			d.replace(*idx, &p)
+		}
+	}
+}
+
+// without returns ids less any in drop, or nil if none are left
+func without(ids []string, drop map[string]bool) []string {
+	var kept []string
+	for _, id := range ids {
+		if !drop[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// CategoriesRequest is the payload accepted by SetProduceCategories
+type CategoriesRequest struct {
+	Categories []string `json:"categories"`
+}
+
+// TagsRequest is the payload accepted by SetProduceTags
+type TagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// SetProduceCategories replaces the categories of the item with the code in the path with those in
+// a CategoriesRequest, e.g. {"categories": ["citrus"]}.  An empty list removes the item from every
+// category.  The updated item is returned.  Unknown or invalid categories get a 400 and a missing
+// item a 404.
+func (h *Handler) SetProduceCategories(w http.ResponseWriter, r *http.Request) {
+	var req CategoriesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := h.db(r).SetCategories(produceCodeFromContext(r.Context()), req.Categories)
+	h.writeItem(w, r, p, err)
+}
+
+// SetProduceTags replaces the tags on the item with the code in the path with those in a TagsRequest,
+// e.g. {"tags": ["organic"]}.  An empty list removes every tag.  The updated item is returned.
+// Unknown or invalid tags get a 400 and a missing item a 404.
+func (h *Handler) SetProduceTags(w http.ResponseWriter, r *http.Request) {
+	var req TagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := h.db(r).SetTags(produceCodeFromContext(r.Context()), req.Tags)
+	h.writeItem(w, r, p, err)
+}
+
+// writeItem writes v as json with a 200, or the error with its status code
+func (h *Handler) writeItem(w http.ResponseWriter, r *http.Request, v interface{}, err error) {
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, v)
+}
+
+// writeJSON writes v as json with the passed status code
+func (h *Handler) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		handlerErrorLogger(r, err, h.logger)
+		http.Error(w, "error generating json data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(dat)
+}
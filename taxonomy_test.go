@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSlugs(t *testing.T) {
+	tests := []struct {
+		in      []string
+		want    []string
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{}, nil, false},
+		{[]string{"Organic", " local ", "organic"}, []string{"local", "organic"}, false},
+		{[]string{"leafy-greens"}, []string{"leafy-greens"}, false},
+		{[]string{"leafy--greens"}, nil, true},
+		{[]string{"leafy_greens"}, nil, true},
+		{[]string{""}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSlugs(tt.in, ErrInvalidTag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSlugs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+// taxonomyDB returns the default database with fruit > citrus > lemons categories and an organic tag
+func taxonomyDB(t *testing.T) *DB {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+	a.NoError(db.AddCategory(&Category{ID: "fruit", Name: "Fruit"}))
+	a.NoError(db.AddCategory(&Category{ID: "citrus", Name: "Citrus", ParentID: "fruit"}))
+	a.NoError(db.AddCategory(&Category{ID: "lemons", Name: "Lemons", ParentID: "citrus"}))
+	a.NoError(db.AddCategory(&Category{ID: "vegetables", Name: "Vegetables"}))
+	a.NoError(db.AddTag(&Tag{ID: "organic"}))
+	return db
+}
+
+func TestDB_SetCategories(t *testing.T) {
+	a := assert.New(t)
+	db := taxonomyDB(t)
+
+	p, err := db.SetCategories("e5t6-9ui3-th15-qr88", []string{"Fruit", "fruit"})
+	a.NoError(err)
+	a.Equal([]string{"fruit"}, p.Categories)
+	a.NoError(db.Add(&ProduceItem{Name: "Meyer Lemon", Code: "MEYR-0000-0000-0001", UnitPrice: 1,
+		Categories: []string{"lemons"}, Tags: []string{"organic"}}))
+
+	_, err = db.SetCategories("E5T6-9UI3-TH15-QR88", []string{"nuts"})
+	a.ErrorIs(err, ErrInvalidCategory)
+	_, err = db.SetCategories("E5T6-9UI3-TH15-QR88", []string{"not valid"})
+	a.ErrorIs(err, ErrInvalidCategory)
+	_, err = db.SetCategories("AAAA-0000-0000-0000", []string{"fruit"})
+	a.ErrorIs(err, ErrNotFound)
+	_, err = db.SetTags("E5T6-9UI3-TH15-QR88", []string{"local"})
+	a.ErrorIs(err, ErrInvalidTag)
+	a.ErrorIs(db.Add(&ProduceItem{Name: "Lime", Code: "LIME-0000-0000-0001", UnitPrice: 1, Categories: []string{"limes"}}),
+		ErrInvalidCategory)
+
+	// the category filter covers the whole subtree
+	a.Len(db.Find(ProduceFilter{Category: "fruit"}), 2)
+	a.Len(db.Find(ProduceFilter{Category: "Citrus"}), 1)
+	a.Empty(db.Find(ProduceFilter{Category: "vegetables"}))
+	a.Empty(db.Find(ProduceFilter{Category: "nuts"}))
+	a.Len(db.Find(ProduceFilter{Tags: []string{"organic"}}), 1)
+	a.Len(db.Find(ProduceFilter{Category: "fruit", Tags: []string{"organic"}}), 1)
+
+	// an empty list clears the assignment
+	p, err = db.SetCategories("E5T6-9UI3-TH15-QR88", nil)
+	a.NoError(err)
+	a.Nil(p.Categories)
+	a.Len(db.Find(ProduceFilter{Category: "fruit"}), 1)
+}
+
+func TestHandler_ProduceTaxonomy(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	ts := httptest.NewServer(LoadRouter(NewHandler(taxonomyDB(t), runtime.NumCPU(), logger)))
+	defer ts.Close()
+
+	rr, body := testRequest(t, ts, "PUT", "/api/v1/produce/E5T6-9UI3-TH15-QR88/categories", bytes.NewBufferString(`{"categories": ["citrus"]}`))
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"produce_name": "Peach", "produce_code": "E5T6-9UI3-TH15-QR88", "produce_unit_price": 2.99, "categories": ["citrus"]}`, body)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/produce/E5T6-9UI3-TH15-QR88/categories", bytes.NewBufferString(`{"categories": ["nuts"]}`))
+	a.Equal(400, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/produce/AAAA-0000-0000-0000/categories", bytes.NewBufferString(`{"categories": ["fruit"]}`))
+	a.Equal(404, rr.StatusCode)
+	rr, _ = testRequest(t, ts, "PUT", "/api/v1/produce/YRT6-72AS-K736-L4AR/tags", bytes.NewBufferString(`{"tags": ["organic"]}`))
+	a.Equal(200, rr.StatusCode)
+
+	payload := `[{"produce_name": "Lemon", "produce_code": "LEMN-0000-0000-0001", "produce_unit_price": 0.5, "categories": ["lemons"], "tags": ["organic"]}]`
+	rr, _ = testRequest(t, ts, "POST", "/api/v1/produce", bytes.NewBufferString(payload))
+	a.Equal(200, rr.StatusCode)
+
+	tests := []struct {
+		path  string
+		names []string
+	}{
+		{"/api/v1/produce?category=fruit", []string{"Peach", "Lemon"}},
+		{"/api/v1/produce?category=lemons", []string{"Lemon"}},
+		{"/api/v1/produce?tag=organic", []string{"Green Pepper", "Lemon"}},
+		{"/api/v1/produce?category=fruit&tag=organic", []string{"Lemon"}},
+		{"/api/v1/produce?category=vegetables", []string{}},
+	}
+	for _, tt := range tests {
+		rr, body = testRequest(t, ts, "GET", tt.path, nil)
+		a.Equal(200, rr.StatusCode, tt.path)
+		var items []*ProduceItem
+		a.NoError(json.Unmarshal([]byte(body), &items))
+		a.ElementsMatch(tt.names, names(items), tt.path)
+	}
+	for _, path := range []string{"/api/v1/produce?category=nuts", "/api/v1/produce?tag=local"} {
+		rr, _ = testRequest(t, ts, "GET", path, nil)
+		a.Equal(400, rr.StatusCode, path)
+	}
+
+	// bulk delete by category
+	rr, body = testRequest(t, ts, "POST", "/api/v1/produce/bulk-delete", bytes.NewBufferString(`{"filter": {"category": "citrus"}}`))
+	a.Equal(200, rr.StatusCode)
+	var rs DeleteResults
+	a.NoError(json.Unmarshal([]byte(body), &rs))
+	a.Len(rs.Results, 2)
+	rr, _ = testRequest(t, ts, "DELETE", "/api/v1/categories/lemons", nil)
+	a.Equal(204, rr.StatusCode)
+}
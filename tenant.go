@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TenantHeader is the request header partner sellers send their tenant credential in
+const TenantHeader = "X-Tenant-Key"
+
+// defaultTenantID names the shared catalogue served to requests that don't select a tenant
+const defaultTenantID = "default"
+
+// ErrInvalidTenant indicates a tenant in the tenants file has an invalid id, a missing or invalid
+// credential hash, or the same id or credential as another tenant
+var ErrInvalidTenant = errors.New("tenant is invalid")
+
+// ErrQuotaExceeded will be used when adding an item would take a tenant's catalogue past its quota
+var ErrQuotaExceeded = errors.New("item quota exceeded")
+
+// Tenant is a partner seller with a catalogue of its own.  Produce codes only need to be unique
+// within a tenant and no request can read or change another tenant's catalogue.
+type Tenant struct {
+	// ID is the lower case slug that identifies the tenant, used in /tenants/{id}/api/v1 paths
+	ID string `json:"id"`
+	// Name is the display name of the tenant
+	Name string `json:"name,omitempty"`
+	// CredentialSHA256 is the hex encoded sha256 hash of the credential the tenant sends in the
+	// X-Tenant-Key header.  It is required and every request for the tenant must carry the credential.
+	CredentialSHA256 string `json:"credential_sha256,omitempty"`
+	// MaxItems caps the number of produce items in the tenant's catalogue, zero for no limit
+	MaxItems int `json:"max_items,omitempty"`
+}
+
+// tenantEntry is a registered tenant and its catalogue
+type tenantEntry struct {
+	Tenant
+	db *DB
+}
+
+// TenantRegistry maps tenants, by id and by credential, to their catalogues.  It is built at
+// startup and read-only afterwards so needs no locking.
+type TenantRegistry struct {
+	tenants map[string]*tenantEntry
+	// credentials maps credential hashes to tenants
+	credentials map[string]*tenantEntry
+}
+
+// NewTenantRegistry returns a registry with no tenants
+func NewTenantRegistry() *TenantRegistry {
+	return &TenantRegistry{tenants: map[string]*tenantEntry{}, credentials: map[string]*tenantEntry{}}
+}
+
+// Add registers the tenant with db as its catalogue and applies the tenant's item quota to db.
+// The id "default" is reserved for the shared catalogue.  A tenant without a credential is
+// rejected, as anyone could otherwise read and change its catalogue.
+func (tr *TenantRegistry) Add(t Tenant, db *DB) error {
+	id, err := parseSlug(t.ID, ErrInvalidTenant)
+	if err != nil {
+		return err
+	}
+	if id == defaultTenantID || tr.tenants[id] != nil {
+		return fmt.Errorf("%w: %s is already in use", ErrInvalidTenant, id)
+	}
+	t.ID = id
+	if t.CredentialSHA256 == "" {
+		return fmt.Errorf("%w: %s has no credential_sha256", ErrInvalidTenant, id)
+	}
+	hash, err := hex.DecodeString(t.CredentialSHA256)
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("%w: credential_sha256 of %s is not a sha256 hash", ErrInvalidTenant, id)
+	}
+	t.CredentialSHA256 = hex.EncodeToString(hash)
+	if tr.credentials[t.CredentialSHA256] != nil {
+		return fmt.Errorf("%w: credential of %s is already in use", ErrInvalidTenant, id)
+	}
+	if t.MaxItems < 0 {
+		return fmt.Errorf("%w: max_items of %s is negative", ErrInvalidTenant, id)
+	}
+	if err := db.SetMaxItems(t.MaxItems); err != nil {
+		return err
+	}
+
+	e := &tenantEntry{Tenant: t, db: db}
+	tr.tenants[id] = e
+	tr.credentials[t.CredentialSHA256] = e
+	return nil
+}
+
+// byID returns the tenant with the id, or nil if there is none
+func (tr *TenantRegistry) byID(id string) *tenantEntry {
+	if tr == nil {
+		return nil
+	}
+	return tr.tenants[id]
+}
+
+// byCredential returns the tenant the credential belongs to, or nil if there is none
+func (tr *TenantRegistry) byCredential(credential string) *tenantEntry {
+	if tr == nil {
+		return nil
+	}
+	return tr.credentials[credentialHash(credential)]
+}
+
+// credentialHash returns the hex encoded sha256 hash of a tenant credential
+func credentialHash(credential string) string {
+	hash := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(hash[:])
+}
+
+// LoadTenants reads the tenants file, a json array of Tenant, and registers each tenant with a
+// catalogue returned by newDB.  Every tenant must have a credential_sha256.  An empty path returns a registry with no tenants.
+func LoadTenants(path string, newDB func() (*DB, error)) (*TenantRegistry, error) {
+	tr := NewTenantRegistry()
+	if path == "" {
+		return tr, nil
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []Tenant
+	if err := json.Unmarshal(dat, &tenants); err != nil {
+		return nil, fmt.Errorf("reading tenants file %s: %w", path, err)
+	}
+	for _, t := range tenants {
+		db, err := newDB()
+		if err != nil {
+			return nil, err
+		}
+		if err := tr.Add(t, db); err != nil {
+			return nil, err
+		}
+	}
+	return tr, nil
+}
+
+// tenantCtxKey is the context key tenantMW stores the selected tenant under
+type tenantCtxKey struct{}
+
+// withTenant returns a copy of ctx holding the tenant
+func withTenant(ctx context.Context, t *tenantEntry) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, t)
+}
+
+// tenantFromContext returns the tenant stored by tenantMW, or nil for the shared catalogue
+func tenantFromContext(ctx context.Context) *tenantEntry {
+	t, _ := ctx.Value(tenantCtxKey{}).(*tenantEntry)
+	return t
+}
+
+// tenantID returns the id of the tenant the request is for, "default" for the shared catalogue
+func tenantID(ctx context.Context) string {
+	if t := tenantFromContext(ctx); t != nil {
+		return t.ID
+	}
+	return defaultTenantID
+}
+
+// db returns the catalogue the request is for: the tenant's own when one was selected by
+// tenantMW, otherwise the shared catalogue.
+func (h *Handler) db(r *http.Request) *DB {
+	if t := tenantFromContext(r.Context()); t != nil {
+		return t.db
+	}
+	return h.DB
+}
+
+// tenantMW selects the tenant a request is for from the tenant path variable, the X-Tenant-Key
+// header, or both.  An unknown tenant gets a 404 and an unknown credential a 401, counted with
+// failed authentications so credentials can't be guessed, see authThrottled.  A tenant's
+// credential must always be sent, and a credential for one tenant can't be used on another tenant's
+// path; both get a 403.  Requests with neither are served the shared catalogue.
+func (h *Handler) tenantMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var t *tenantEntry
+		if id := chi.URLParam(r, "tenant"); id != "" {
+			if t = h.tenants.byID(id); t == nil {
+				http.Error(w, "tenant not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		credential := r.Header.Get(TenantHeader)
+		switch {
+		case credential != "":
+			if h.authThrottled(w, r) {
+				return
+			}
+			ct := h.tenants.byCredential(credential)
+			if ct == nil {
+				h.authFailures.allow(peerIP(r))
+				http.Error(w, "unknown tenant credential", http.StatusUnauthorized)
+				return
+			}
+			if t != nil && t != ct {
+				http.Error(w, "credential does not belong to this tenant", http.StatusForbidden)
+				return
+			}
+			t = ct
+		case t != nil:
+			http.Error(w, "tenant credential required", http.StatusForbidden)
+			return
+		}
+
+		if t != nil {
+			r = r.WithContext(withTenant(r.Context(), t))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TenantInfo describes the tenant a request is for, returned by GetTenant
+type TenantInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	ItemCount int    `json:"item_count"`
+	MaxItems  int    `json:"max_items,omitempty"`
+}
+
+// GetTenant returns the id, item count and quota of the tenant the request is for
+func (h *Handler) GetTenant(w http.ResponseWriter, r *http.Request) {
+	info := TenantInfo{ID: defaultTenantID}
+	if t := tenantFromContext(r.Context()); t != nil {
+		info = TenantInfo{ID: t.ID, Name: t.Name, MaxItems: t.MaxItems}
+	}
+	info.ItemCount = h.db(r).Count()
+	h.writeJSON(w, r, http.StatusOK, info)
+}
+
+// quotaIndex rejects new items once the catalogue holds max items.  Replacing an item
+// that is already stored is always allowed.
+type quotaIndex struct {
+	max   int
+	codes map[ProduceCode]bool
+}
+
+func (q *quotaIndex) check(p *ProduceItem) error {
+	if !q.codes[p.Code] && len(q.codes) >= q.max {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (q *quotaIndex) insert(p *ProduceItem) {
+	q.codes[p.Code] = true
+}
+
+func (q *quotaIndex) remove(p *ProduceItem) {
+	delete(q.codes, p.Code)
+}
+
+func (q *quotaIndex) clone() secondaryIndex {
+	c := &quotaIndex{max: q.max, codes: make(map[ProduceCode]bool, len(q.codes))}
+	for code := range q.codes {
+		c.codes[code] = true
+	}
+	return c
+}
+
+// SetMaxItems caps the number of items the database holds, zero removes the cap.  Adding an item
+// past the cap fails with ErrQuotaExceeded.  Setting a cap below the number of items already held
+// fails with ErrQuotaExceeded and leaves the cap unchanged.
+func (d *DB) SetMaxItems(max int) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if max > 0 && len(d.Produce) > max {
+		return ErrQuotaExceeded
+	}
+
+	indexes := d.indexes[:0]
+	for _, i := range d.indexes {
+		if i != d.quotaIndex {
+			indexes = append(indexes, i)
+		}
+	}
+	d.indexes = indexes
+	d.quotaIndex = nil
+
+	if max <= 0 {
+		return nil
+	}
+	quotaIndex := &quotaIndex{max: max, codes: map[ProduceCode]bool{}}
+	for _, p := range d.Produce {
+		quotaIndex.insert(p)
+	}
+	d.quotaIndex = quotaIndex
+	d.indexes = append(d.indexes, quotaIndex)
+	return nil
+}
+
+// Count returns the number of produce items in the database
+func (d *DB) Count() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return len(d.Produce)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantRegistry_Add(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	tr := NewTenantRegistry()
+
+	a.NoError(tr.Add(Tenant{ID: "Acme", CredentialSHA256: credentialHash("acme-secret")}, NewDB(logger)))
+	a.NotNil(tr.byID("acme"))
+	a.Equal(tr.byID("acme"), tr.byCredential("acme-secret"))
+	a.Nil(tr.byCredential("wrong"))
+
+	globex := credentialHash("globex-secret")
+	tests := []Tenant{
+		{ID: "acme", CredentialSHA256: globex},
+		{ID: "default", CredentialSHA256: globex},
+		{ID: "not valid", CredentialSHA256: globex},
+		{ID: "globex"},
+		{ID: "globex", CredentialSHA256: "abc"},
+		{ID: "globex", CredentialSHA256: credentialHash("acme-secret")},
+		{ID: "globex", CredentialSHA256: globex, MaxItems: -1},
+	}
+	for _, tt := range tests {
+		a.ErrorIs(tr.Add(tt, NewDB(logger)), ErrInvalidTenant, tt.ID)
+	}
+
+	// a quota below the items already held is rejected
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	a.ErrorIs(tr.Add(Tenant{ID: "globex", CredentialSHA256: globex, MaxItems: 2}, db), ErrQuotaExceeded)
+
+	var nilRegistry *TenantRegistry
+	a.Nil(nilRegistry.byID("acme"))
+	a.Nil(nilRegistry.byCredential("acme-secret"))
+}
+
+func TestLoadTenants(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	newDB := func() (*DB, error) { return NewDB(logger), nil }
+
+	tr, err := LoadTenants("", newDB)
+	a.NoError(err)
+	a.Empty(tr.tenants)
+
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	tenants := fmt.Sprintf(`[{"id": "acme", "name": "Acme Farms", "credential_sha256": %q, "max_items": 10}, {"id": "globex", "credential_sha256": %q}]`,
+		credentialHash("acme-secret"), credentialHash("globex-secret"))
+	a.NoError(os.WriteFile(path, []byte(tenants), 0600))
+	tr, err = LoadTenants(path, newDB)
+	a.NoError(err)
+	a.Len(tr.tenants, 2)
+	a.NotSame(tr.byID("acme").db, tr.byID("globex").db)
+
+	a.NoError(os.WriteFile(path, []byte(`[{"id": "acme"}]`), 0600))
+	_, err = LoadTenants(path, newDB)
+	a.ErrorIs(err, ErrInvalidTenant)
+	a.NoError(os.WriteFile(path, []byte(fmt.Sprintf(`[{"id": "acme", "credential_sha256": %q}, {"id": "acme", "credential_sha256": %q}]`,
+		credentialHash("acme-secret"), credentialHash("globex-secret"))), 0600))
+	_, err = LoadTenants(path, newDB)
+	a.ErrorIs(err, ErrInvalidTenant)
+	a.NoError(os.WriteFile(path, []byte(`{`), 0600))
+	_, err = LoadTenants(path, newDB)
+	a.Error(err)
+	_, err = LoadTenants(filepath.Join(t.TempDir(), "missing.json"), newDB)
+	a.Error(err)
+}
+
+func TestDB_SetMaxItems(t *testing.T) {
+	a := assert.New(t)
+	db, err := LoadDB(logrus.New())
+	a.NoError(err)
+
+	a.ErrorIs(db.SetMaxItems(3), ErrQuotaExceeded)
+	a.NoError(db.SetMaxItems(5))
+	a.NoError(db.Add(&ProduceItem{Name: "Kiwi", Code: "KIWI-0000-0000-0001", UnitPrice: 1}))
+	a.ErrorIs(db.Add(&ProduceItem{Name: "Lime", Code: "LIME-0000-0000-0001", UnitPrice: 1}), ErrQuotaExceeded)
+
+	// updating an item at the quota is fine, and deleting frees a slot
+	_, err = db.Upsert(&ProduceItem{Name: "Golden Kiwi", Code: "KIWI-0000-0000-0001", UnitPrice: 2})
+	a.NoError(err)
+	a.NoError(db.Delete("KIWI-0000-0000-0001"))
+	a.NoError(db.Add(&ProduceItem{Name: "Lime", Code: "LIME-0000-0000-0001", UnitPrice: 1}))
+
+	a.NoError(db.SetMaxItems(0))
+	a.NoError(db.Add(&ProduceItem{Name: "Kiwi", Code: "KIWI-0000-0000-0001", UnitPrice: 1}))
+	a.Equal(6, db.Count())
+}
+
+func TestHandler_Tenants(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	db, err := LoadDB(logger)
+	a.NoError(err)
+	h := NewHandler(db, runtime.NumCPU(), logger)
+	h.tenants = NewTenantRegistry()
+	a.NoError(h.tenants.Add(Tenant{ID: "acme", CredentialSHA256: credentialHash("acme-secret"), MaxItems: 1}, NewDB(logger)))
+	a.NoError(h.tenants.Add(Tenant{ID: "globex", CredentialSHA256: credentialHash("globex-secret")}, NewDB(logger)))
+	ts := httptest.NewServer(LoadRouter(h))
+	defer ts.Close()
+
+	do := func(method, path, credential, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		a.NoError(err)
+		if credential != "" {
+			req.Header.Set(TenantHeader, credential)
+		}
+		req.Header.Set(IdempotencyKeyHeader, "same-key")
+		resp, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		resp.Body.Close()
+		return resp, buf.String()
+	}
+	lettuce := `[{"produce_name": "Lettuce", "produce_code": "A12T-4GH7-QPL9-3N4M", "produce_unit_price": 1}]`
+
+	// the same code can be added by each tenant, a shared key doesn't replay another tenant's response
+	rr, body := do("POST", "/api/v1/produce", "acme-secret", lettuce)
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, "201: added")
+	a.Empty(rr.Header.Get(IdempotentReplayHeader))
+	rr, body = do("POST", "/tenants/globex/api/v1/produce", "globex-secret", lettuce)
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, "201: added")
+
+	// the acme quota of one item is used up
+	rr, body = do("POST", "/tenants/acme/api/v1/produce", "acme-secret",
+		`[{"produce_name": "Peach", "produce_code": "E5T6-9UI3-TH15-QR88", "produce_unit_price": 1}]`)
+	a.Equal(200, rr.StatusCode)
+	a.Contains(body, "403: item quota exceeded")
+
+	// each tenant only sees its own catalogue
+	var items []*ProduceItem
+	_, body = do("GET", "/api/v1/produce", "acme-secret", "")
+	a.NoError(json.Unmarshal([]byte(body), &items))
+	a.Len(items, 1)
+	a.Equal(1.0, items[0].UnitPrice)
+	_, body = do("GET", "/api/v1/produce", "", "")
+	a.NoError(json.Unmarshal([]byte(body), &items))
+	a.Len(items, 4)
+	a.Equal(3.46, items[0].UnitPrice)
+
+	// a tenant deleting an item doesn't touch anyone else's
+	rr, _ = do("DELETE", "/tenants/globex/api/v1/produce/A12T-4GH7-QPL9-3N4M", "globex-secret", "")
+	a.Equal(204, rr.StatusCode)
+	rr, _ = do("GET", "/api/v1/produce/A12T-4GH7-QPL9-3N4M", "acme-secret", "")
+	a.Equal(200, rr.StatusCode)
+	rr, _ = do("GET", "/api/v1/produce/A12T-4GH7-QPL9-3N4M", "", "")
+	a.Equal(200, rr.StatusCode)
+
+	rr, body = do("GET", "/api/v1/tenant", "acme-secret", "")
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"id": "acme", "item_count": 1, "max_items": 1}`, body)
+	rr, body = do("GET", "/api/v1/tenant", "", "")
+	a.Equal(200, rr.StatusCode)
+	a.JSONEq(`{"id": "default", "item_count": 4}`, body)
+
+	tests := []struct {
+		path       string
+		credential string
+		status     int
+	}{
+		{"/tenants/initech/api/v1/produce", "", 404},
+		{"/api/v1/produce", "wrong", 401},
+		{"/tenants/acme/api/v1/produce", "", 403},
+		{"/tenants/acme/api/v1/produce", "acme-secret", 200},
+		{"/tenants/globex/api/v1/produce", "acme-secret", 403},
+		{"/tenants/globex/api/v1/produce", "", 403},
+		{"/tenants/globex/api/v1/produce", "globex-secret", 200},
+	}
+	for _, tt := range tests {
+		rr, _ = do("GET", tt.path, tt.credential, "")
+		a.Equal(tt.status, rr.StatusCode, tt.path)
+	}
+}
+
+func TestHandler_TenantCredentialLimit(t *testing.T) {
+	a := assert.New(t)
+	logger := logrus.New()
+	logger.Level = 1
+	h := NewHandler(NewDB(logger), runtime.NumCPU(), logger)
+	h.tenants = NewTenantRegistry()
+	a.NoError(h.tenants.Add(Tenant{ID: "acme", CredentialSHA256: credentialHash("acme-secret")}, NewDB(logger)))
+	now := time.Now()
+	h.authFailures.now = func() time.Time { return now }
+	router := LoadRouter(h)
+
+	get := func(credential, peerIP string) int {
+		req := httptest.NewRequest("GET", "/api/v1/produce", nil)
+		req.RemoteAddr = peerIP + ":40000"
+		req.Header.Set(TenantHeader, credential)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < authFailureLimit.Burst; i++ {
+		a.Equal(401, get("guess", "10.0.0.1"))
+	}
+	// once the failures are used up even the right credential isn't checked
+	a.Equal(429, get("acme-secret", "10.0.0.1"))
+	a.Equal(200, get("acme-secret", "10.0.0.2"))
+	now = now.Add(time.Minute)
+	a.Equal(200, get("acme-secret", "10.0.0.1"))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certCheckInterval is how often the certificate files are checked for rotation
+const certCheckInterval = 10 * time.Second
+
+// Client certificate verification modes
+const (
+	// ClientAuthRequire rejects connections without a client certificate signed by the client CAs
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies client certificates that are sent, and lets clients without one
+	// authenticate another way
+	ClientAuthOptional = "optional"
+)
+
+// TLSConfig holds the settings newTLSConfig builds the server's tls config from
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM server certificate chain and private key.  TLS is off
+	// when they aren't set.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile is a PEM bundle of the CAs client certificates are verified against, turning
+	// on mutual TLS
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is require or optional, defaults to require
+	ClientAuth string `yaml:"client_auth"`
+	// ClientRoleMap maps certificate common names, prefixed cn:, and organizational units,
+	// prefixed ou:, to roles, e.g. "ou:store-systems=editor,cn:pos-7=viewer"
+	ClientRoleMap string `yaml:"client_role_map"`
+}
+
+// Enabled reports whether the server serves TLS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// certReloader serves the certificate in the cert and key files, reloading them when either
+// file changes so rotated certificates are picked up without a restart.  A certificate that
+// fails to load is logged and the current one kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logrus.Logger
+	now      func() time.Time
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// certMod and keyMod are the modification times of the files when last loaded
+	certMod time.Time
+	keyMod  time.Time
+	// checked is when the files were last checked for changes
+	checked time.Time
+}
+
+// newCertReloader loads the certificate and key files
+func newCertReloader(certFile, keyFile string, logger *logrus.Logger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger, now: time.Now}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	cr.checked = cr.now()
+	return cr, nil
+}
+
+// modTimes returns the modification times of the cert and key files
+func (cr *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	fi, err := os.Stat(cr.certFile)
+	if err != nil {
+		return certMod, keyMod, err
+	}
+	certMod = fi.ModTime()
+	if fi, err = os.Stat(cr.keyFile); err != nil {
+		return certMod, keyMod, err
+	}
+	return certMod, fi.ModTime(), nil
+}
+
+// load reads the certificate and key files
+func (cr *certReloader) load() error {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading tls certificate %s: %w", cr.certFile, err)
+	}
+	cr.cert, cr.certMod, cr.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files have changed
+// since they were last checked.  It is used as tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if now := cr.now(); now.Sub(cr.checked) >= certCheckInterval {
+		cr.checked = now
+		certMod, keyMod, err := cr.modTimes()
+		if err == nil && (!certMod.Equal(cr.certMod) || !keyMod.Equal(cr.keyMod)) {
+			err = cr.load()
+			if err == nil {
+				cr.logger.Infof("reloaded tls certificate %s", cr.certFile)
+			}
+		}
+		if err != nil {
+			cr.logger.Errorf("keeping the current tls certificate: %s", err)
+		}
+	}
+	return cr.cert, nil
+}
+
+// newTLSConfig returns the server tls config for c, or nil when TLS is off.  Client certificates
+// are verified against the client CAs when a bundle is configured.
+func newTLSConfig(c TLSConfig, logger *logrus.Logger) (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	cr, err := newCertReloader(c.CertFile, c.KeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: cr.GetCertificate}
+
+	if c.ClientCAFile != "" {
+		dat, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(dat) {
+			return nil, fmt.Errorf("client ca file %s has no PEM certificates", c.ClientCAFile)
+		}
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		if c.ClientAuth == ClientAuthOptional {
+			tc.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tc, nil
+}
+
+// ClientCertAuth identifies callers by the verified client certificate of their connection
+type ClientCertAuth struct {
+	// roleMap maps "cn:<common name>" and "ou:<organizational unit>" to roles
+	roleMap map[string]Role
+}
+
+// NewClientCertAuth returns the client certificate authenticator for c, or nil when client
+// certificates aren't verified
+func NewClientCertAuth(c TLSConfig) (*ClientCertAuth, error) {
+	if !c.Enabled() || c.ClientCAFile == "" {
+		return nil, nil
+	}
+	roleMap, err := parseClientRoleMap(c.ClientRoleMap)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientCertAuth{roleMap: roleMap}, nil
+}
+
+// parseClientRoleMap parses a client certificate role map.  Every key must name a common name with
+// cn: or an organizational unit with ou:, so a certificate can't get a role by putting a mapped
+// common name in its organizational unit or the other way round.
+func parseClientRoleMap(s string) (map[string]Role, error) {
+	roleMap, err := parseRoleMap(s)
+	if err != nil {
+		return nil, err
+	}
+	for name := range roleMap {
+		if !strings.HasPrefix(name, "cn:") && !strings.HasPrefix(name, "ou:") {
+			return nil, fmt.Errorf("invalid client role mapping %q, expected cn:<common name> or ou:<organizational unit>", name)
+		}
+	}
+	return roleMap, nil
+}
+
+// principal returns the caller identified by the connection's verified client certificate.  The
+// subject is the certificate's common name and the role the highest one mapped from its common
+// name or organizational units.  It returns nil when there is no certificate or none of its names
+// are mapped, so the caller is treated as anonymous.
+func (a *ClientCertAuth) principal(cs *tls.ConnectionState) *Principal {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := cs.VerifiedChains[0][0]
+	role := a.roleMap["cn:"+cert.Subject.CommonName]
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if r := a.roleMap["ou:"+ou]; roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	if role == "" {
+		return nil
+	}
+	return &Principal{Subject: cert.Subject.CommonName, Role: role, Source: "mtls"}
+}
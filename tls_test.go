@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a certificate and its key for tls tests
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newTestCert issues a certificate for the subject, signed by parent or self-signed as a CA when
+// parent is nil
+func newTestCert(t *testing.T, serial int64, subject pkix.Name, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer := &testCert{cert: tmpl, key: key}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+	if c.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// write writes the certificate and key as PEM files in dir, returning their paths
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func Test_certReloader(t *testing.T) {
+	a := assert.New(t)
+	dir := t.TempDir()
+	ca := newTestCert(t, 1, pkix.Name{CommonName: "big-produce ca"}, nil)
+	certFile, keyFile := newTestCert(t, 2, pkix.Name{CommonName: "big-produce"}, ca).write(t, dir, "server")
+	logger, hook := test.NewNullLogger()
+
+	cr, err := newCertReloader(certFile, keyFile, logger)
+	if !a.NoError(err) {
+		return
+	}
+	now := time.Now()
+	cr.now = func() time.Time { return now }
+	serial := func() int64 {
+		c, err := cr.GetCertificate(nil)
+		a.NoError(err)
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		a.NoError(err)
+		return leaf.SerialNumber.Int64()
+	}
+	a.Equal(int64(2), serial())
+
+	// a rotated certificate is served once the files are next checked
+	newTestCert(t, 3, pkix.Name{CommonName: "big-produce"}, ca).write(t, dir, "server")
+	later := now.Add(time.Minute)
+	a.NoError(os.Chtimes(certFile, later, later))
+	a.NoError(os.Chtimes(keyFile, later, later))
+	a.Equal(int64(2), serial())
+	now = now.Add(certCheckInterval)
+	a.Equal(int64(3), serial())
+
+	// a certificate that doesn't match its key keeps the current one
+	newTestCert(t, 4, pkix.Name{CommonName: "big-produce"}, ca).write(t, dir, "other")
+	dat, err := os.ReadFile(filepath.Join(dir, "other.crt"))
+	a.NoError(err)
+	a.NoError(os.WriteFile(certFile, dat, 0o600))
+	later = later.Add(time.Minute)
+	a.NoError(os.Chtimes(certFile, later, later))
+	now = now.Add(certCheckInterval)
+	a.Equal(int64(3), serial())
+	a.Equal(logrus.ErrorLevel, hook.LastEntry().Level)
+
+	_, err = newCertReloader(filepath.Join(dir, "missing.crt"), keyFile, logger)
+	a.Error(err)
+}
+
+func TestClientCertAuth_principal(t *testing.T) {
+	a := assert.New(t)
+	auth, err := NewClientCertAuth(TLSConfig{CertFile: "server.crt", KeyFile: "server.key", ClientCAFile: "ca.crt", ClientRoleMap: "ou:store-systems=editor,cn:pos-7=viewer,ou:back-office=admin"})
+	a.NoError(err)
+	ca := newTestCert(t, 1, pkix.Name{CommonName: "big-produce ca"}, nil)
+	verified := func(subject pkix.Name) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{newTestCert(t, 2, subject, ca).cert, ca.cert}}}
+	}
+
+	a.Nil(auth.principal(nil))
+	a.Nil(auth.principal(&tls.ConnectionState{}))
+	a.Equal(&Principal{Subject: "pos-7", Role: RoleEditor, Source: "mtls"}, auth.principal(verified(pkix.Name{CommonName: "pos-7", OrganizationalUnit: []string{"store-systems"}})))
+	a.Equal(&Principal{Subject: "pos-8", Role: RoleAdmin, Source: "mtls"}, auth.principal(verified(pkix.Name{CommonName: "pos-8", OrganizationalUnit: []string{"store-systems", "back-office"}})))
+	a.Equal(&Principal{Subject: "pos-7", Role: RoleViewer, Source: "mtls"}, auth.principal(verified(pkix.Name{CommonName: "pos-7"})))
+	// common names and organizational units are mapped separately
+	a.Nil(auth.principal(verified(pkix.Name{CommonName: "store-systems"})))
+	a.Nil(auth.principal(verified(pkix.Name{CommonName: "kiosk", OrganizationalUnit: []string{"pos-7"}})))
+	a.Nil(auth.principal(verified(pkix.Name{CommonName: "kiosk"})))
+
+	// no client ca means client certificates aren't used
+	auth, err = NewClientCertAuth(TLSConfig{CertFile: "server.crt", KeyFile: "server.key"})
+	a.NoError(err)
+	a.Nil(auth)
+	_, err = NewClientCertAuth(TLSConfig{CertFile: "server.crt", KeyFile: "server.key", ClientCAFile: "ca.crt", ClientRoleMap: "cn:pos=owner"})
+	a.Error(err)
+	_, err = NewClientCertAuth(TLSConfig{CertFile: "server.crt", KeyFile: "server.key", ClientCAFile: "ca.crt", ClientRoleMap: "pos-7=viewer"})
+	a.Error(err)
+}
+
+func TestHandler_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, 1, pkix.Name{CommonName: "big-produce ca"}, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, 2, pkix.Name{CommonName: "big-produce"}, ca).write(t, dir, "server")
+	till := newTestCert(t, 3, pkix.Name{CommonName: "till-4", OrganizationalUnit: []string{"store-systems"}}, ca)
+	kiosk := newTestCert(t, 4, pkix.Name{CommonName: "kiosk"}, ca)
+	// visitor has an organizational unit that is only mapped as a common name
+	visitor := newTestCert(t, 7, pkix.Name{CommonName: "visitor", OrganizationalUnit: []string{"kiosk"}}, ca)
+	otherCA := newTestCert(t, 5, pkix.Name{CommonName: "someone else's ca"}, nil)
+	stranger := newTestCert(t, 6, pkix.Name{CommonName: "till-9", OrganizationalUnit: []string{"store-systems"}}, otherCA)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// serve starts a tls server with the client auth mode and returns its url
+	serve := func(t *testing.T, clientAuth string, anonymousRead bool) string {
+		c := TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: clientAuth, ClientRoleMap: "ou:store-systems=editor,cn:kiosk=viewer"}
+		logger := logrus.New()
+		logger.Level = 1
+		db, err := LoadDB(logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := NewHandler(db, runtime.NumCPU(), logger)
+		h.updateSettings(func(s *liveSettings) { s.anonymousRead = anonymousRead })
+		if h.clientCerts, err = NewClientCertAuth(c); err != nil {
+			t.Fatal(err)
+		}
+		tc, err := newTLSConfig(c, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: LoadRouter(h), TLSConfig: tc, ErrorLog: log.New(io.Discard, "", 0)}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- runServer(ctx, srv, []net.Listener{ln}, defaultShutdownTimeout, func() error { return nil })
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-stopped
+		})
+		return "https://" + ln.Addr().String()
+	}
+	// do sends the request with the client certificate, returning 0 when the handshake fails
+	do := func(t *testing.T, url, method, path, body string, cert *testCert) int {
+		tc := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			// always present the certificate, even one the server's CAs don't accept, which the
+			// client would otherwise leave out
+			tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert.tls, nil }
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		defer client.CloseIdleConnections()
+		req, err := http.NewRequest(method, url+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name         string
+		server       string
+		method, path string
+		body         string
+		cert         *testCert
+		status       int
+	}{
+		{"store system reads", "", "GET", "/api/v1/produce", "", till, 200},
+		{"store system adds", "", "POST", "/api/v1/categories", `{"id": "fruit", "name": "Fruit"}`, till, 201},
+		{"store system deletes", "", "DELETE", "/api/v1/produce/A12T-4GH7-QPL9-3N4M", "", till, 403},
+		{"kiosk reads", "", "GET", "/api/v1/produce", "", kiosk, 200},
+		{"kiosk adds", "", "POST", "/api/v1/categories", `{"id": "fruit", "name": "Fruit"}`, kiosk, 403},
+		{"no certificate", "", "GET", "/api/v1/produce", "", nil, 0},
+		{"untrusted certificate", "", "GET", "/api/v1/produce", "", stranger, 0},
+		{"optional without certificate", ClientAuthOptional, "GET", "/api/v1/produce", "", nil, 401},
+		{"optional with certificate", ClientAuthOptional, "GET", "/api/v1/produce", "", kiosk, 200},
+		{"optional untrusted certificate", ClientAuthOptional, "GET", "/api/v1/produce", "", stranger, 0},
+		{"unmapped certificate", "", "GET", "/api/v1/produce", "", visitor, 401},
+		{"unmapped certificate anonymous read", "anonymous", "GET", "/api/v1/produce", "", visitor, 200},
+		{"unmapped certificate anonymous add", "anonymous", "POST", "/api/v1/categories", `{"id": "fruit", "name": "Fruit"}`, visitor, 401},
+	}
+	urls := map[string]string{"": serve(t, "", false), ClientAuthOptional: serve(t, ClientAuthOptional, false), "anonymous": serve(t, "", true)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.status, do(t, urls[tt.server], tt.method, tt.path, tt.body, tt.cert))
+		})
+	}
+}